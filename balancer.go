@@ -0,0 +1,286 @@
+package httpcache
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	BalancerRoundRobin       = "round_robin"
+	BalancerLeastOutstanding = "least_outstanding"
+	BalancerWeighted         = "weighted"
+	BalancerConsistentHash   = "consistent_hash"
+
+	DefaultBalancer     = BalancerRoundRobin
+	DefaultHashReplicas = 100
+)
+
+type (
+	// Balancer picks the upstream a request is sent to. Update
+	// is called with all the members of the pool whenever they
+	// change, Pick chooses among the candidates, which are the
+	// members currently able to take requests
+	Balancer interface {
+		Update(upstreams []*Upstream)
+		Pick(reqKey ReqKeyT, candidates []*Upstream) *Upstream
+	}
+
+	RoundRobinBalancer struct {
+		next uint64
+	}
+
+	LeastOutstandingBalancer struct {
+		next uint64
+	}
+
+	// WeightedBalancer is the smooth weighted round robin of
+	// nginx, which spreads the picks of heavy upstreams over
+	// the cycle instead of sending them in bursts
+	WeightedBalancer struct {
+		current map[*Upstream]int
+		lock    *sync.Mutex
+	}
+
+	// ConsistentHashBalancer sends a key to the same upstream
+	// for as long as it is a candidate. Each upstream is put on
+	// the ring replicas times its weight
+	ConsistentHashBalancer struct {
+		replicas int
+
+		ring   []uint64
+		owners map[uint64]*Upstream
+		lock   *sync.RWMutex
+	}
+)
+
+func NewBalancer(strategy string, hashReplicas int) (balancer Balancer, err error) {
+
+	switch strategy {
+
+	case "", BalancerRoundRobin:
+		balancer = &RoundRobinBalancer{}
+
+	case BalancerLeastOutstanding:
+		balancer = &LeastOutstandingBalancer{}
+
+	case BalancerWeighted:
+		balancer = &WeightedBalancer{
+			current: make(map[*Upstream]int),
+			lock:    &sync.Mutex{},
+		}
+
+	case BalancerConsistentHash:
+
+		if hashReplicas <= 0 {
+			hashReplicas = DefaultHashReplicas
+		}
+
+		balancer = &ConsistentHashBalancer{
+			replicas: hashReplicas,
+			owners:   make(map[uint64]*Upstream),
+			lock:     &sync.RWMutex{},
+		}
+
+	default:
+		err = errors.New("Unknown load balancing strategy " + strategy)
+		return
+	}
+
+	return
+}
+
+func (balancer *RoundRobinBalancer) Update(upstreams []*Upstream) {
+	return
+}
+
+func (balancer *RoundRobinBalancer) Pick(reqKey ReqKeyT, candidates []*Upstream) (upstream *Upstream) {
+
+	if len(candidates) == 0 {
+		return
+	}
+
+	upstream = candidates[atomic.AddUint64(&balancer.next, 1)%uint64(len(candidates))]
+
+	return
+}
+
+func (balancer *LeastOutstandingBalancer) Update(upstreams []*Upstream) {
+	return
+}
+
+func (balancer *LeastOutstandingBalancer) Pick(reqKey ReqKeyT, candidates []*Upstream) (upstream *Upstream) {
+
+	var (
+		least       []*Upstream
+		outstanding int64
+		lowest      int64
+	)
+
+	if len(candidates) == 0 {
+		return
+	}
+
+	for _, candidate := range candidates {
+
+		switch outstanding = candidate.Outstanding(); {
+		case len(least) == 0 || outstanding < lowest:
+			least, lowest = []*Upstream{candidate}, outstanding
+		case outstanding == lowest:
+			least = append(least, candidate)
+		}
+	}
+
+	// Ties are broken round robin among the least busy
+	upstream = least[atomic.AddUint64(&balancer.next, 1)%uint64(len(least))]
+
+	return
+}
+
+func (balancer *WeightedBalancer) Update(upstreams []*Upstream) {
+
+	var (
+		current map[*Upstream]int
+	)
+
+	balancer.lock.Lock()
+	defer balancer.lock.Unlock()
+
+	current = make(map[*Upstream]int, len(upstreams))
+
+	for _, upstream := range upstreams {
+		current[upstream] = balancer.current[upstream]
+	}
+
+	balancer.current = current
+
+	return
+}
+
+func (balancer *WeightedBalancer) Pick(reqKey ReqKeyT, candidates []*Upstream) (upstream *Upstream) {
+
+	var (
+		total int
+	)
+
+	balancer.lock.Lock()
+	defer balancer.lock.Unlock()
+
+	for _, candidate := range candidates {
+
+		balancer.current[candidate] += candidate.Weight
+		total += candidate.Weight
+
+		if upstream == nil || balancer.current[candidate] > balancer.current[upstream] {
+			upstream = candidate
+		}
+	}
+
+	if upstream != nil {
+		balancer.current[upstream] -= total
+	}
+
+	return
+}
+
+func (balancer *ConsistentHashBalancer) Update(upstreams []*Upstream) {
+
+	var (
+		ring   []uint64
+		owners map[uint64]*Upstream
+	)
+
+	owners = make(map[uint64]*Upstream)
+
+	for _, upstream := range upstreams {
+
+		for replica := 0; replica < balancer.replicas*upstream.Weight; replica++ {
+
+			point := hashKey(upstream.Name + "#" + strconv.Itoa(replica))
+
+			if _, isPresent := owners[point]; isPresent {
+				continue
+			}
+
+			owners[point] = upstream
+			ring = append(ring, point)
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i] < ring[j]
+	})
+
+	balancer.lock.Lock()
+	balancer.ring, balancer.owners = ring, owners
+	balancer.lock.Unlock()
+
+	return
+}
+
+func (balancer *ConsistentHashBalancer) Pick(reqKey ReqKeyT, candidates []*Upstream) (upstream *Upstream) {
+
+	var (
+		isCandidate map[*Upstream]bool
+		point       uint64
+		start       int
+	)
+
+	if len(candidates) == 0 {
+		return
+	}
+
+	isCandidate = make(map[*Upstream]bool, len(candidates))
+
+	for _, candidate := range candidates {
+		isCandidate[candidate] = true
+	}
+
+	balancer.lock.RLock()
+	defer balancer.lock.RUnlock()
+
+	point = hashKey(string(reqKey))
+
+	start = sort.Search(len(balancer.ring), func(idx int) bool {
+		return balancer.ring[idx] >= point
+	})
+
+	// Walk clockwise from the point of the key to the first
+	// upstream which is a candidate, so that keys of an
+	// unavailable upstream are spread over the next ones
+	for idx := 0; idx < len(balancer.ring); idx++ {
+
+		owner := balancer.owners[balancer.ring[(start+idx)%len(balancer.ring)]]
+
+		if isCandidate[owner] {
+			upstream = owner
+			return
+		}
+	}
+
+	upstream = candidates[0]
+
+	return
+}
+
+// hashKey is FNV-1a mixed with the finalizer of splitmix64,
+// without which names only differing by their last characters,
+// like the replicas of an upstream, end up next to each other
+func hashKey(key string) (hash uint64) {
+
+	var (
+		hasher = fnv.New64a()
+	)
+
+	hasher.Write([]byte(key))
+	hash = hasher.Sum64()
+
+	hash = (hash ^ (hash >> 30)) * 0xbf58476d1ce4e5b9
+	hash = (hash ^ (hash >> 27)) * 0x94d049bb133111eb
+	hash ^= hash >> 31
+
+	return
+}
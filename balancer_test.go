@@ -0,0 +1,183 @@
+package httpcache
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func newTestUpstreams(weights ...int) (upstreams []*Upstream) {
+
+	for idx, weight := range weights {
+		upstreams = append(upstreams, &Upstream{Name: string(rune('a' + idx)), Weight: weight})
+	}
+
+	return
+}
+
+func getTestPicks(balancer Balancer, candidates []*Upstream, count int) (picks string) {
+
+	var (
+		names []string
+	)
+
+	for idx := 0; idx < count; idx++ {
+		names = append(names, balancer.Pick(ReqKeyT(strconv.Itoa(idx)), candidates).Name)
+	}
+
+	picks = strings.Join(names, "")
+
+	return
+}
+
+func TestWeightedBalancerPick(t *testing.T) {
+
+	var (
+		testCases = []struct {
+			name    string
+			weights []int
+			picks   string
+		}{
+			{name: "equal weights", weights: []int{1, 1, 1}, picks: "abcabc"},
+			{name: "heavy upstream spread", weights: []int{5, 1, 1}, picks: "aabacaaaabacaa"},
+			{name: "two to one", weights: []int{2, 1}, picks: "abaaba"},
+			{name: "single", weights: []int{3}, picks: "aaa"},
+		}
+	)
+
+	for _, testCase := range testCases {
+
+		balancer, err := NewBalancer(BalancerWeighted, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		upstreams := newTestUpstreams(testCase.weights...)
+		balancer.Update(upstreams)
+
+		if picks := getTestPicks(balancer, upstreams, len(testCase.picks)); picks != testCase.picks {
+			t.Errorf("%s: picked %s instead of %s", testCase.name, picks, testCase.picks)
+		}
+	}
+}
+
+func TestWeightedBalancerSkipsUnavailable(t *testing.T) {
+
+	var (
+		balancer  Balancer
+		upstreams = newTestUpstreams(5, 1, 1)
+		err       error
+	)
+
+	if balancer, err = NewBalancer(BalancerWeighted, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	balancer.Update(upstreams)
+
+	if picks := getTestPicks(balancer, upstreams[1:], 4); picks != "bcbc" {
+		t.Fatalf("Picked %s among the available upstreams", picks)
+	}
+
+	if upstream := balancer.Pick("", nil); upstream != nil {
+		t.Fatalf("Picked %s without candidates", upstream.Name)
+	}
+}
+
+func TestConsistentHashBalancerPick(t *testing.T) {
+
+	var (
+		balancer  Balancer
+		upstreams = newTestUpstreams(1, 1, 1, 2)
+		owners    = make(map[ReqKeyT]*Upstream)
+		counts    = make(map[*Upstream]int)
+		err       error
+	)
+
+	if balancer, err = NewBalancer(BalancerConsistentHash, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	balancer.Update(upstreams)
+
+	for idx := 0; idx < 5000; idx++ {
+
+		reqKey := ReqKeyT("key" + strconv.Itoa(idx))
+
+		owners[reqKey] = balancer.Pick(reqKey, upstreams)
+		counts[owners[reqKey]]++
+
+		if balancer.Pick(reqKey, upstreams) != owners[reqKey] {
+			t.Fatalf("Key %s moved between picks", reqKey)
+		}
+	}
+
+	// The double weight upstream takes about twice the keys
+	if ratio := float64(counts[upstreams[3]]) / float64(counts[upstreams[0]]); ratio < 1.5 || ratio > 2.5 {
+		t.Errorf("Weighted upstream takes %v times the keys", ratio)
+	}
+
+	// Without b, only its keys move and they are spread over
+	// the others
+	moved := make(map[*Upstream]int)
+
+	for reqKey, owner := range owners {
+
+		upstream := balancer.Pick(reqKey, []*Upstream{upstreams[0], upstreams[2], upstreams[3]})
+
+		switch {
+		case owner != upstreams[1] && upstream != owner:
+			t.Fatalf("Key %s of %s moved to %s", reqKey, owner.Name, upstream.Name)
+		case owner == upstreams[1]:
+			moved[upstream]++
+		}
+	}
+
+	if len(moved) < 2 {
+		t.Errorf("Keys of the unavailable upstream only went to %d upstream", len(moved))
+	}
+
+	// A new ring keeps the keys of the remaining upstreams
+	balancer.Update(upstreams[:3])
+
+	for reqKey, owner := range owners {
+		if owner != upstreams[3] && balancer.Pick(reqKey, upstreams[:3]) != owner {
+			t.Fatalf("Key %s of %s moved after the removal of d", reqKey, owner.Name)
+		}
+	}
+}
+
+func TestLeastOutstandingBalancerPick(t *testing.T) {
+
+	var (
+		balancer  Balancer
+		upstreams = newTestUpstreams(1, 1, 1)
+		err       error
+	)
+
+	if balancer, err = NewBalancer(BalancerLeastOutstanding, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	upstreams[0].outstanding = 2
+	upstreams[1].outstanding = 1
+	upstreams[2].outstanding = 3
+
+	if upstream := balancer.Pick("", upstreams); upstream != upstreams[1] {
+		t.Fatalf("Picked %s instead of the least busy upstream", upstream.Name)
+	}
+
+	// Ties are spread instead of going to the first upstream
+	upstreams[0].outstanding = 1
+
+	if picks := getTestPicks(balancer, upstreams, 4); strings.Count(picks, "a") != 2 || strings.Count(picks, "b") != 2 {
+		t.Fatalf("Ties picked as %s", picks)
+	}
+}
+
+func TestNewBalancerUnknownStrategy(t *testing.T) {
+
+	if _, err := NewBalancer("random", 0); err == nil {
+		t.Fatal("Unknown strategy accepted")
+	}
+}
@@ -0,0 +1,166 @@
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+const (
+	DefaultBodyMemoryBytes = 1 << 20
+	DefaultBodyMaxBytes    = 64 << 20
+)
+
+type (
+	// BufferedBody keeps a copy of the request body so that
+	// it can be read more than once. Reading the form values
+	// for the cache key drains req.Body, the body proxied
+	// upstream is always replayed from here instead. Bodies
+	// larger than the memory limit are spilled to a temp file
+	BufferedBody struct {
+		data []byte
+		file *os.File
+		size int64
+	}
+
+	bodyCtxtKeyT struct{}
+)
+
+var (
+	bodyCtxtKey = bodyCtxtKeyT{}
+)
+
+func NewBufferedBody(body io.Reader, memoryBytes int64, maxBytes int64,
+	tempDir string) (bufferedBody *BufferedBody, err error) {
+
+	var (
+		buffer  *bytes.Buffer
+		written int64
+	)
+
+	bufferedBody = &BufferedBody{}
+	buffer = &bytes.Buffer{}
+
+	if written, err = io.Copy(buffer, io.LimitReader(body, memoryBytes+1)); err != nil {
+		return
+	}
+
+	if written <= memoryBytes {
+		bufferedBody.data = buffer.Bytes()
+		bufferedBody.size = written
+		return
+	}
+
+	if bufferedBody.file, err = ioutil.TempFile(tempDir, "httpcache-body-"); err != nil {
+		return
+	}
+
+	if written, err = io.Copy(bufferedBody.file, io.MultiReader(buffer,
+		io.LimitReader(body, maxBytes-written+1))); err != nil {
+
+		bufferedBody.Close()
+		return
+	}
+
+	bufferedBody.size = written
+
+	if written > maxBytes {
+		bufferedBody.Close()
+		err = BodyTooLargeError{}
+		return
+	}
+
+	return
+}
+
+func (bufferedBody *BufferedBody) Size() (size int64) {
+	size = bufferedBody.size
+	return
+}
+
+// Bytes returns the body when it is held in memory
+func (bufferedBody *BufferedBody) Bytes() (data []byte, inMemory bool) {
+
+	if bufferedBody.file != nil {
+		return
+	}
+
+	data, inMemory = bufferedBody.data, true
+
+	return
+}
+
+// NewReader returns a fresh reader over the whole body,
+// independent of the readers handed out before
+func (bufferedBody *BufferedBody) NewReader() (body io.ReadCloser) {
+
+	if bufferedBody.file != nil {
+		body = ioutil.NopCloser(io.NewSectionReader(bufferedBody.file, 0, bufferedBody.size))
+		return
+	}
+
+	body = ioutil.NopCloser(bytes.NewReader(bufferedBody.data))
+
+	return
+}
+
+func (bufferedBody *BufferedBody) Close() (err error) {
+
+	if bufferedBody.file == nil {
+		return
+	}
+
+	bufferedBody.file.Close()
+	err = os.Remove(bufferedBody.file.Name())
+
+	return
+}
+
+// bufferBody replaces the body of the request by a
+// replayable one. The returned request carries the
+// buffered body in its context, which has to be closed
+// once the request is done
+func (httpCacheCtxt *HttpCacheCtxt) bufferBody(req *http.Request) (bufReq *http.Request,
+	bufferedBody *BufferedBody, err error) {
+
+	var (
+		proxyCfg = &httpCacheCtxt.Config.Proxy
+	)
+
+	bufReq = req
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+
+	if req.ContentLength > proxyCfg.BodyMaxBytes {
+		err = BodyTooLargeError{}
+		return
+	}
+
+	if bufferedBody, err = NewBufferedBody(req.Body, proxyCfg.BodyMemoryBytes,
+		proxyCfg.BodyMaxBytes, proxyCfg.BodyTempDir); err != nil {
+
+		return
+	}
+
+	req.Body.Close()
+
+	bufReq = req.WithContext(context.WithValue(req.Context(), bodyCtxtKey, bufferedBody))
+
+	bufReq.Body = bufferedBody.NewReader()
+	bufReq.ContentLength = bufferedBody.Size()
+	bufReq.GetBody = func() (io.ReadCloser, error) {
+		return bufferedBody.NewReader(), nil
+	}
+
+	return
+}
+
+func getBufferedBody(req *http.Request) (bufferedBody *BufferedBody) {
+	bufferedBody, _ = req.Context().Value(bodyCtxtKey).(*BufferedBody)
+	return
+}
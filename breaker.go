@@ -0,0 +1,251 @@
+package httpcache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+
+	DefaultCircuitOpenDuration     = 30
+	DefaultCircuitHalfOpenRequests = 1
+	DefaultCircuitSuccessThreshold = 1
+)
+
+type (
+	// CircuitBreakerConfig applies to every upstream. The
+	// breaker of an upstream opens after FailureThreshold
+	// failures in a row, 0 keeps the breakers off. After
+	// OpenDuration seconds it lets HalfOpenRequests trial
+	// requests through and closes again after
+	// SuccessThreshold of them succeed. With ServeStale the
+	// cached response is served, however old, while open
+	CircuitBreakerConfig struct {
+		FailureThreshold int   `json:"failure_threshold"`
+		OpenDuration     int64 `json:"open_duration"`
+		HalfOpenRequests int   `json:"half_open_requests"`
+		SuccessThreshold int   `json:"success_threshold"`
+		ServeStale       bool  `json:"serve_stale"`
+	}
+
+	CircuitBreaker struct {
+		upstream *Upstream
+		cfg      *CircuitBreakerConfig
+
+		State     string
+		OpenedAt  time.Time
+		failures  int
+		successes int
+		trials    int
+
+		lock *sync.Mutex
+	}
+)
+
+func NewCircuitBreaker(upstream *Upstream, cfg *CircuitBreakerConfig) (breaker *CircuitBreaker) {
+
+	breaker = &CircuitBreaker{
+		upstream: upstream,
+		cfg:      cfg,
+
+		State: CircuitClosed,
+
+		lock: &sync.Mutex{},
+	}
+
+	return
+}
+
+func (breaker *CircuitBreaker) isEnabled() (isEnabled bool) {
+	isEnabled = breaker.cfg.FailureThreshold > 0
+	return
+}
+
+// IsOpen tells if requests are refused without trying the
+// upstream. An open breaker whose open duration is over
+// moves to half open here
+func (breaker *CircuitBreaker) IsOpen() (isOpen bool) {
+
+	if !breaker.isEnabled() {
+		return
+	}
+
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	breaker.refresh()
+
+	switch breaker.State {
+	case CircuitOpen:
+		isOpen = true
+	case CircuitHalfOpen:
+		isOpen = breaker.trials >= breaker.cfg.HalfOpenRequests
+	}
+
+	return
+}
+
+// Allow reserves the right to send a request to the
+// upstream. Every allowed request has to be followed by
+// either RecordResult or Cancel
+func (breaker *CircuitBreaker) Allow() (err error) {
+
+	if !breaker.isEnabled() {
+		return
+	}
+
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	breaker.refresh()
+
+	switch breaker.State {
+
+	case CircuitOpen:
+		err = CircuitOpenError{Upstream: breaker.upstream.Name}
+
+	case CircuitHalfOpen:
+
+		if breaker.trials >= breaker.cfg.HalfOpenRequests {
+			err = CircuitOpenError{Upstream: breaker.upstream.Name}
+			return
+		}
+
+		breaker.trials++
+	}
+
+	return
+}
+
+// Cancel gives back a reservation which has not been used
+func (breaker *CircuitBreaker) Cancel() {
+
+	if !breaker.isEnabled() {
+		return
+	}
+
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	if breaker.State == CircuitHalfOpen && breaker.trials > 0 {
+		breaker.trials--
+	}
+
+	return
+}
+
+func (breaker *CircuitBreaker) RecordResult(isFailure bool) {
+
+	if !breaker.isEnabled() {
+		return
+	}
+
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	switch breaker.State {
+
+	case CircuitClosed:
+
+		if !isFailure {
+			breaker.failures = 0
+			return
+		}
+
+		if breaker.failures++; breaker.failures >= breaker.cfg.FailureThreshold {
+			breaker.transition(CircuitOpen)
+		}
+
+	case CircuitHalfOpen:
+
+		if breaker.trials > 0 {
+			breaker.trials--
+		}
+
+		if isFailure {
+			breaker.transition(CircuitOpen)
+			return
+		}
+
+		if breaker.successes++; breaker.successes >= breaker.cfg.SuccessThreshold {
+			breaker.transition(CircuitClosed)
+		}
+	}
+
+	return
+}
+
+func (breaker *CircuitBreaker) GetState() (state string) {
+
+	breaker.lock.Lock()
+	defer breaker.lock.Unlock()
+
+	breaker.refresh()
+	state = breaker.State
+
+	return
+}
+
+// refresh moves an open breaker to half open once its open
+// duration is over. Has to be called with the lock held
+func (breaker *CircuitBreaker) refresh() {
+
+	if breaker.State != CircuitOpen {
+		return
+	}
+
+	if time.Since(breaker.OpenedAt) < time.Duration(breaker.cfg.OpenDuration)*time.Second {
+		return
+	}
+
+	breaker.transition(CircuitHalfOpen)
+
+	return
+}
+
+// transition has to be called with the lock held
+func (breaker *CircuitBreaker) transition(state string) {
+
+	var (
+		stats *Stats
+		prev  string
+	)
+
+	prev = breaker.State
+
+	breaker.State = state
+	breaker.failures = 0
+	breaker.successes = 0
+	breaker.trials = 0
+
+	if state == CircuitOpen {
+		breaker.OpenedAt = time.Now()
+	}
+
+	stats = breaker.upstream.stats
+
+	stats.Upstream.CircuitTransitions.WithLabelValues(breaker.upstream.Name, state).Inc()
+
+	for _, circuitState := range []string{CircuitClosed, CircuitOpen, CircuitHalfOpen} {
+
+		if circuitState == state {
+			stats.Upstream.CircuitState.WithLabelValues(breaker.upstream.Name, circuitState).Set(1)
+		} else {
+			stats.Upstream.CircuitState.WithLabelValues(breaker.upstream.Name, circuitState).Set(0)
+		}
+	}
+
+	breaker.upstream.logger.WithFields(logrus.Fields{
+		"upstream":   breaker.upstream.Name,
+		"from":       prev,
+		"to":         state,
+		"event_type": "circuit_transition",
+	}).Warn("Circuit breaker state changed")
+
+	return
+}
@@ -0,0 +1,127 @@
+package httpcache
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+
+	var (
+		cfg = &CircuitBreakerConfig{
+			FailureThreshold: 2,
+			OpenDuration:     30,
+			HalfOpenRequests: 1,
+			SuccessThreshold: 2,
+		}
+
+		// Steps are allow, deny (Allow refused), fail and ok
+		// (results of allowed requests), cancel and expire
+		// (the open duration goes by), each followed by the
+		// state it leaves the breaker in
+		testCases = []struct {
+			name  string
+			steps [][2]string
+		}{
+			{
+				name: "failures in a row open",
+				steps: [][2]string{
+					{"allow", CircuitClosed}, {"fail", CircuitClosed},
+					{"allow", CircuitClosed}, {"fail", CircuitOpen},
+					{"deny", CircuitOpen},
+				},
+			},
+			{
+				name: "success resets the failures",
+				steps: [][2]string{
+					{"allow", CircuitClosed}, {"fail", CircuitClosed},
+					{"allow", CircuitClosed}, {"ok", CircuitClosed},
+					{"allow", CircuitClosed}, {"fail", CircuitClosed},
+				},
+			},
+			{
+				name: "half open closes after the successes",
+				steps: [][2]string{
+					{"fail", CircuitClosed}, {"fail", CircuitOpen},
+					{"expire", CircuitHalfOpen},
+					{"allow", CircuitHalfOpen}, {"deny", CircuitHalfOpen}, {"ok", CircuitHalfOpen},
+					{"allow", CircuitHalfOpen}, {"ok", CircuitClosed},
+				},
+			},
+			{
+				name: "half open failure opens again",
+				steps: [][2]string{
+					{"fail", CircuitClosed}, {"fail", CircuitOpen},
+					{"expire", CircuitHalfOpen},
+					{"allow", CircuitHalfOpen}, {"fail", CircuitOpen},
+					{"deny", CircuitOpen},
+				},
+			},
+			{
+				name: "cancel gives the trial back",
+				steps: [][2]string{
+					{"fail", CircuitClosed}, {"fail", CircuitOpen},
+					{"expire", CircuitHalfOpen},
+					{"allow", CircuitHalfOpen}, {"cancel", CircuitHalfOpen},
+					{"allow", CircuitHalfOpen}, {"deny", CircuitHalfOpen},
+				},
+			},
+		}
+	)
+
+	for _, testCase := range testCases {
+
+		upstream := &Upstream{Name: "breaker", stats: getTestStats(t), logger: logrus.New()}
+		upstream.logger.SetOutput(ioutil.Discard)
+
+		breaker := NewCircuitBreaker(upstream, cfg)
+
+		for idx, step := range testCase.steps {
+
+			var err error
+
+			switch step[0] {
+			case "allow":
+				err = breaker.Allow()
+			case "deny":
+				if err = breaker.Allow(); err == nil {
+					t.Fatalf("%s: step %d allowed", testCase.name, idx)
+				}
+
+				err = nil
+			case "fail":
+				breaker.RecordResult(true)
+			case "ok":
+				breaker.RecordResult(false)
+			case "cancel":
+				breaker.Cancel()
+			case "expire":
+				breaker.OpenedAt = breaker.OpenedAt.Add(-time.Duration(cfg.OpenDuration) * time.Second)
+			}
+
+			if err != nil {
+				t.Fatalf("%s: step %d refused with %v", testCase.name, idx, err)
+			}
+
+			if state := breaker.GetState(); state != step[1] {
+				t.Fatalf("%s: step %d left the breaker %s instead of %s", testCase.name, idx, state, step[1])
+			}
+		}
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+
+	breaker := NewCircuitBreaker(&Upstream{Name: "off"}, &CircuitBreakerConfig{})
+
+	for idx := 0; idx < 10; idx++ {
+		breaker.RecordResult(true)
+	}
+
+	if breaker.IsOpen() || breaker.Allow() != nil || breaker.GetState() != CircuitClosed {
+		t.Fatal("Breaker without a failure threshold opened")
+	}
+}
@@ -0,0 +1,100 @@
+package httpcache
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	LoadBudgetWindow = 10
+)
+
+type (
+	// LoadBudget caps the extra requests, such as retries, sent
+	// on top of the original ones. Over a sliding window of
+	// LoadBudgetWindow seconds the extra requests may be at most
+	// Ratio of the original ones, plus MinPerSecond every second
+	// so that low traffic can still make progress
+	LoadBudget struct {
+		Ratio        float64
+		MinPerSecond float64
+
+		requests [LoadBudgetWindow]int64
+		extras   [LoadBudgetWindow]int64
+		seconds  [LoadBudgetWindow]int64
+
+		lock *sync.Mutex
+	}
+)
+
+func NewLoadBudget(ratio float64, minPerSecond float64) (budget *LoadBudget) {
+
+	budget = &LoadBudget{
+		Ratio:        ratio,
+		MinPerSecond: minPerSecond,
+
+		lock: &sync.Mutex{},
+	}
+
+	return
+}
+
+// RecordRequest counts an original request
+func (budget *LoadBudget) RecordRequest() {
+
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+
+	budget.requests[budget.bucket(time.Now().Unix())]++
+
+	return
+}
+
+// Withdraw takes one extra request out of the budget,
+// telling if there was room for it
+func (budget *LoadBudget) Withdraw() (isAllowed bool) {
+
+	var (
+		now      int64
+		requests int64
+		extras   int64
+	)
+
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+
+	now = time.Now().Unix()
+	budget.bucket(now)
+
+	for idx := range budget.seconds {
+		if now-budget.seconds[idx] < LoadBudgetWindow {
+			requests += budget.requests[idx]
+			extras += budget.extras[idx]
+		}
+	}
+
+	if float64(extras+1) > budget.Ratio*float64(requests)+budget.MinPerSecond*LoadBudgetWindow {
+		return
+	}
+
+	budget.extras[budget.bucket(now)]++
+	isAllowed = true
+
+	return
+}
+
+// bucket returns the index of the bucket of the given second,
+// resetting it when it was last used for an older second. Has
+// to be called with the lock held
+func (budget *LoadBudget) bucket(second int64) (idx int) {
+
+	idx = int(second % LoadBudgetWindow)
+
+	if budget.seconds[idx] != second {
+		budget.seconds[idx] = second
+		budget.requests[idx] = 0
+		budget.extras[idx] = 0
+	}
+
+	return
+}
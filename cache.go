@@ -3,16 +3,16 @@ package httpcache
 import (
 	"errors"
 	"log"
+	"sort"
 	"sync"
-	"time"
 )
 
 type (
 	Cache struct {
 		httpCacheCtxt *HttpCacheCtxt
 
-		CacheObj map[ReqKeyT]*CacheObj
-		objLock  *sync.RWMutex
+		Tenants    map[string]*Tenant
+		tenantLock *sync.RWMutex
 
 		//CacheObj sync.Map
 	}
@@ -23,132 +23,232 @@ func NewCache(httpCacheCtxt *HttpCacheCtxt) (cache *Cache, err error) {
 	cache = &Cache{
 		httpCacheCtxt: httpCacheCtxt,
 
-		CacheObj: make(map[ReqKeyT]*CacheObj, 1024),
-		objLock:  &sync.RWMutex{},
+		Tenants:    make(map[string]*Tenant),
+		tenantLock: &sync.RWMutex{},
 	}
 
 	return
 }
 
-func (cache *Cache) getCacheObj(reqKey ReqKeyT) (cacheObj *CacheObj, err error) {
+func (cache *Cache) getTenant(tenantName string) (tenant *Tenant, err error) {
 
 	var (
 		isPresent bool
 	)
 
-	cache.objLock.RLock()
-	defer cache.objLock.RUnlock()
+	cache.tenantLock.RLock()
+	defer cache.tenantLock.RUnlock()
 
-	if cacheObj, isPresent = cache.CacheObj[reqKey]; !isPresent {
-		err = errors.New("No CloudPort Found for key " + string(reqKey))
+	if tenant, isPresent = cache.Tenants[tenantName]; !isPresent {
+		err = errors.New("No Tenant Found with name " + tenantName)
 		return
 	}
 
 	return
 }
 
-func (cache *Cache) GetData(reqKey ReqKeyT, apiName string) (respBody []byte, err error) {
+func (cache *Cache) getOrCreateTenant(tenantName string) (tenant *Tenant, err error) {
 
 	var (
-		cacheApi *CacheApi
+		quotaBytes int64
+		isPresent  bool
 	)
 
-	if cacheApi, err = cache.get(reqKey, apiName); err != nil {
-		err = errors.New("No Cache Found for key " + string(reqKey))
+	if tenant, err = cache.getTenant(tenantName); err == nil {
 		return
 	}
 
-	respBody = cacheApi.Data
+	cache.tenantLock.Lock()
+	defer cache.tenantLock.Unlock()
+
+	if tenant, isPresent = cache.Tenants[tenantName]; isPresent {
+		err = nil
+		return
+	}
+
+	if quotaBytes, isPresent = cache.httpCacheCtxt.Config.Tenants.Quotas[tenantName]; !isPresent {
+		quotaBytes = cache.httpCacheCtxt.Config.Tenants.DefaultQuotaBytes
+	}
+
+	if tenant, err = NewTenant(cache, tenantName, quotaBytes); err != nil {
+		return
+	}
+
+	cache.Tenants[tenantName] = tenant
 
 	return
 }
 
-func (cache *Cache) get(reqKey ReqKeyT, apiName string) (cacheApi *CacheApi, err error) {
+// admitTenant is the tenant the requests of the given name
+// belong to. Tenants with a quota are always admitted, other
+// names only while there are fewer than MaxTenants, so that
+// clients can't grow the tenants and their metrics at will
+func (cache *Cache) admitTenant(tenantName string) (admittedName string) {
 
 	var (
-		cacheObj *CacheObj
+		cfg       = &cache.httpCacheCtxt.Config.Tenants
+		isPresent bool
 	)
 
-	if cacheObj, err = cache.getCacheObj(reqKey); err != nil {
-		err = errors.New("No CloudPort Found for key " + string(reqKey))
+	admittedName = tenantName
+
+	if _, isPresent = cfg.Quotas[tenantName]; isPresent || tenantName == cfg.Default {
 		return
 	}
 
-	if cacheApi, err = cacheObj.GetCacheApi(apiName); err != nil {
+	if _, err := cache.getTenant(tenantName); err == nil {
+		return
+	}
+
+	cache.tenantLock.Lock()
+	defer cache.tenantLock.Unlock()
+
+	if _, isPresent = cache.Tenants[tenantName]; isPresent {
+		return
+	}
+
+	if len(cache.Tenants) >= cfg.MaxTenants {
+		admittedName = cfg.Default
 		return
 	}
 
+	cache.Tenants[tenantName], _ = NewTenant(cache, tenantName, cfg.DefaultQuotaBytes)
+
 	return
 }
 
-func (cache *Cache) Add(reqKey ReqKeyT, apiName string, respBody []byte) (err error) {
+func (cache *Cache) GetData(tenantName string, reqKey ReqKeyT, apiName string) (respBody []byte, err error) {
 
 	var (
-		cacheObj *CacheObj
 		cacheApi *CacheApi
+	)
+
+	if cacheApi, err = cache.get(tenantName, reqKey, apiName); err != nil {
+		err = errors.New("No Cache Found for key " + string(reqKey))
+		return
+	}
+
+	respBody = cacheApi.Data
 
-		currTime int64
+	return
+}
+
+func (cache *Cache) get(tenantName string, reqKey ReqKeyT, apiName string) (cacheApi *CacheApi, err error) {
+
+	var (
+		tenant *Tenant
 	)
 
-	currTime = time.Now().Unix()
+	if tenant, err = cache.getTenant(tenantName); err != nil {
+		return
+	}
 
-	if cacheObj, err = cache.getCacheObj(reqKey); err != nil {
+	if cacheApi, err = tenant.get(reqKey, apiName); err != nil {
+		return
+	}
 
-		// Initialize the cache object per request element
-		cacheObj, _ = NewCacheObj()
+	return
+}
+
+func (cache *Cache) Add(tenantName string, reqKey ReqKeyT, apiName string, resp *Response) (err error) {
+
+	var (
+		tenant *Tenant
+	)
 
-		cache.objLock.Lock()
-		cache.CacheObj[reqKey] = cacheObj
-		cache.objLock.Unlock()
+	if tenant, err = cache.getOrCreateTenant(tenantName); err != nil {
+		return
 	}
 
-	if cacheApi, err = cacheObj.GetOrCreateCacheApi(apiName); err != nil {
+	if err = tenant.Add(reqKey, apiName, resp); err != nil {
 		return
 	}
 
-	cacheObj.CachedAt = currTime
+	return
+}
+
+func (cache *Cache) Invalidate(tenantName string, reqKey ReqKeyT) (err error) {
 
-	cacheApi.UpdatedAt = currTime
-	cacheApi.Data = respBody
+	var (
+		tenant *Tenant
+	)
+
+	log.Println("Invalidating cache for", tenantName, reqKey)
+
+	if tenant, err = cache.getTenant(tenantName); err != nil {
+		return
+	}
+
+	if err = tenant.Invalidate(reqKey); err != nil {
+		return
+	}
 
 	return
 }
 
-func (cache *Cache) Invalidate(reqKey ReqKeyT) (err error) {
+func (cache *Cache) FlushTenant(tenantName string) (err error) {
 
 	var (
-		cacheObj *CacheObj
+		tenant *Tenant
 	)
 
-	log.Println("Invalidating cache for", reqKey)
+	log.Println("Flushing cache for tenant", tenantName)
 
-	if cacheObj, err = cache.getCacheObj(reqKey); err != nil {
+	if tenant, err = cache.getTenant(tenantName); err != nil {
 		return
 	}
 
-	cacheObj.CachedAt = time.Now().Unix()
+	if err = tenant.Flush(); err != nil {
+		return
+	}
 
 	return
 }
 
-func (cache *Cache) IsValid(reqKey ReqKeyT, apiName string) (isValid bool) {
+func (cache *Cache) TenantUsage() (usages []*TenantUsage) {
+
+	cache.tenantLock.RLock()
+	defer cache.tenantLock.RUnlock()
+
+	for _, tenant := range cache.Tenants {
+		usages = append(usages, tenant.Usage())
+	}
+
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].Name < usages[j].Name
+	})
+
+	return
+}
+
+func (cache *Cache) Lookup(tenantName string, reqKey ReqKeyT, apiName string) (cacheApi *CacheApi, err error) {
+
+	if cacheApi, err = cache.get(tenantName, reqKey, apiName); err != nil {
+		return
+	}
+
+	return
+}
+
+// Peek looks up an entry without marking it as used
+func (cache *Cache) Peek(tenantName string, reqKey ReqKeyT, apiName string) (cacheApi *CacheApi, err error) {
 
 	var (
+		tenant   *Tenant
 		cacheObj *CacheObj
-		cacheApi *CacheApi
-		err      error
 	)
 
-	if cacheObj, err = cache.getCacheObj(reqKey); err != nil {
+	if tenant, err = cache.getTenant(tenantName); err != nil {
 		return
 	}
 
-	if cacheApi, err = cacheObj.GetCacheApi(apiName); err != nil {
-		isValid = false
+	if cacheObj, err = tenant.getCacheObj(reqKey); err != nil {
 		return
 	}
 
-	isValid = cacheApi.IsValid()
+	if cacheApi, err = cacheObj.GetCacheApi(apiName); err != nil {
+		return
+	}
 
 	return
 }
@@ -1,22 +1,29 @@
 package httpcache
 
 import (
+	"container/list"
 	"errors"
+	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type (
 	CacheObj struct {
 		IsValid bool
 
-		// CachedAt is used to determine
+		// InvalidatedAt is used to determine
 		// when the cache invalidation request
-		// was received in the service.
-		// UpdatedAt is used to determine
-		// the time when the response received
-		// from the backend is formed and stored
-		// in the cache
-		CachedAt int64
+		// was received in the service, entries
+		// stored before it are stale.
+		// UpdatedAt of the entries is used to
+		// determine the time when the response
+		// received from the backend is formed
+		// and stored in the cache. Both are in
+		// nanoseconds, InvalidatedAt is read and
+		// written atomically
+		InvalidatedAt int64
 
 		CacheApi map[string]*CacheApi
 		caLock   *sync.RWMutex
@@ -25,8 +32,15 @@ type (
 	CacheApi struct {
 		Base *CacheObj
 
-		UpdatedAt int64
-		Data      []byte
+		ReqKey  ReqKeyT
+		ApiName string
+
+		UpdatedAt  int64
+		StatusCode int
+		Header     http.Header
+		Data       []byte
+
+		lruElem *list.Element
 	}
 )
 
@@ -40,16 +54,15 @@ func NewCacheObj() (cacheObj *CacheObj, err error) {
 	return
 }
 
-func (cacheObj *CacheObj) GetOrCreateCacheApi(apiName string) (cacheApi *CacheApi, err error) {
-
-	if cacheApi, err = cacheObj.GetCacheApi(apiName); err != nil {
+// SetCacheApi stores the entry under its api name,
+// returning the entry it replaces if any
+func (cacheObj *CacheObj) SetCacheApi(cacheApi *CacheApi) (prevCacheApi *CacheApi) {
 
-		cacheApi = &CacheApi{}
+	cacheObj.caLock.Lock()
+	defer cacheObj.caLock.Unlock()
 
-		cacheObj.caLock.Lock()
-		cacheObj.CacheApi[apiName] = cacheApi
-		cacheObj.caLock.Unlock()
-	}
+	prevCacheApi = cacheObj.CacheApi[cacheApi.ApiName]
+	cacheObj.CacheApi[cacheApi.ApiName] = cacheApi
 
 	return
 }
@@ -60,6 +73,9 @@ func (cacheObj *CacheObj) GetCacheApi(apiName string) (cacheApi *CacheApi, err e
 		isPresent bool
 	)
 
+	cacheObj.caLock.RLock()
+	defer cacheObj.caLock.RUnlock()
+
 	if cacheApi, isPresent = cacheObj.CacheApi[apiName]; !isPresent {
 		err = errors.New("No Cache Found for key " + string(apiName))
 		return
@@ -68,12 +84,81 @@ func (cacheObj *CacheObj) GetCacheApi(apiName string) (cacheApi *CacheApi, err e
 	return
 }
 
-func (cacheApi *CacheApi) IsValid() (isValid bool) {
+func (cacheObj *CacheObj) DeleteCacheApi(apiName string) (remaining int) {
+
+	cacheObj.caLock.Lock()
+	defer cacheObj.caLock.Unlock()
+
+	delete(cacheObj.CacheApi, apiName)
+	remaining = len(cacheObj.CacheApi)
+
+	return
+}
+
+// StaleSince returns the time at which the entry went stale,
+// either because it was invalidated or because its TTL ran
+// out. It is 0 while the entry is still fresh
+func (cacheApi *CacheApi) StaleSince(ttl time.Duration, now int64) (staleSince int64) {
+
+	var (
+		invalidatedAt int64
+		expiresAt     int64
+	)
+
+	if invalidatedAt = atomic.LoadInt64(&cacheApi.Base.InvalidatedAt); invalidatedAt > cacheApi.UpdatedAt {
+		staleSince = invalidatedAt
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	if expiresAt = cacheApi.UpdatedAt + int64(ttl); expiresAt > now {
+		return
+	}
+
+	if staleSince == 0 || expiresAt < staleSince {
+		staleSince = expiresAt
+	}
+
+	return
+}
+
+func (cacheApi *CacheApi) IsValid(ttl time.Duration) (isValid bool) {
 
-	if cacheApi.Base.CachedAt == cacheApi.UpdatedAt {
+	if cacheApi.StaleSince(ttl, time.Now().UnixNano()) == 0 {
 		isValid = true
 		return
 	}
 
 	return
 }
+
+// IsUsableStale tells if a stale entry can still be served
+// as it went stale less than window ago
+func (cacheApi *CacheApi) IsUsableStale(ttl time.Duration, window time.Duration) (isUsable bool) {
+
+	var (
+		now        int64
+		staleSince int64
+	)
+
+	if window <= 0 {
+		return
+	}
+
+	now = time.Now().UnixNano()
+
+	if staleSince = cacheApi.StaleSince(ttl, now); staleSince == 0 {
+		return
+	}
+
+	isUsable = now-staleSince < int64(window)
+
+	return
+}
+
+func (cacheApi *CacheApi) Age() (age time.Duration) {
+	age = time.Duration(time.Now().UnixNano() - cacheApi.UpdatedAt)
+	return
+}
@@ -0,0 +1,61 @@
+package httpcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheEncodingsStayFresh(t *testing.T) {
+
+	var (
+		httpCacheCtxt *HttpCacheCtxt
+		cacheApi      *CacheApi
+		err           error
+		cfg           = &Config{}
+	)
+
+	cfg.Server.RemoteHost = "http://127.0.0.1:1"
+
+	httpCacheCtxt = newTestHttpCacheCtxt(t, cfg)
+
+	gzipReq := newTestCacheReq(httpCacheCtxt, "k")
+	gzipReq.Encoding = "gzip"
+
+	identityReq := newTestCacheReq(httpCacheCtxt, "k")
+
+	// Storing one encoding leaves the other one fresh
+	for _, cacheReq := range []*CacheReq{gzipReq, identityReq, gzipReq} {
+		if err = httpCacheCtxt.Cache.Add(DefaultTenantName, cacheReq.ReqKey, cacheReq.EntryName(),
+			&Response{StatusCode: 200, Body: []byte(cacheReq.Encoding)}); err != nil {
+
+			t.Fatal(err)
+		}
+	}
+
+	for _, cacheReq := range []*CacheReq{gzipReq, identityReq} {
+
+		if cacheApi, err = httpCacheCtxt.Cache.Peek(DefaultTenantName, cacheReq.ReqKey, cacheReq.EntryName()); err != nil {
+			t.Fatal(err)
+		}
+
+		if !cacheApi.IsValid(time.Hour) {
+			t.Fatalf("Entry %q is stale after storing its sibling", cacheReq.EntryName())
+		}
+	}
+
+	// Invalidation covers all the encodings
+	if err = httpCacheCtxt.Cache.Invalidate(DefaultTenantName, "k"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cacheReq := range []*CacheReq{gzipReq, identityReq} {
+
+		if cacheApi, err = httpCacheCtxt.Cache.Peek(DefaultTenantName, cacheReq.ReqKey, cacheReq.EntryName()); err != nil {
+			t.Fatal(err)
+		}
+
+		if cacheApi.IsValid(time.Hour) {
+			t.Fatalf("Entry %q is fresh after the invalidation", cacheReq.EntryName())
+		}
+	}
+}
@@ -1,14 +1,122 @@
 package httpcache
 
+import (
+	"net/http"
+	"strconv"
+)
+
 const (
 	ProxyPresentErrorMessage = "Proxy is present"
+	BodyTooLargeErrorMessage = "Request body is too large"
+	NoUpstreamErrorMessage   = "No upstream available"
+	ProxyBusyErrorMessage    = "Proxy busy, request rejected"
 )
 
 type (
 	ProxyPresentError struct{}
+	BodyTooLargeError struct{}
+	NoUpstreamError   struct{}
+
+	UpstreamStatusError struct {
+		StatusCode int
+	}
+
+	CircuitOpenError struct {
+		Upstream string
+	}
+
+	// ProxyBusyError is set with the tenant whose
+	// own share of the proxy queue is full
+	ProxyBusyError struct {
+		Tenant string
+	}
+
+	// ConcurrencyLimitError tells the client to come
+	// back after RetryAfter seconds
+	ConcurrencyLimitError struct {
+		RetryAfter int
+	}
+
+	// UpstreamTimeoutError tells which of the connect,
+	// header or total timeouts ran out
+	UpstreamTimeoutError struct {
+		Phase string
+	}
+
+	// ResponseValidationError keeps a response out of
+	// the cache, it is never seen by the client
+	ResponseValidationError struct {
+		Reason string
+	}
 )
 
 func (customErr ProxyPresentError) Error() (res string) {
 	res = ProxyPresentErrorMessage
 	return
 }
+
+func (customErr BodyTooLargeError) Error() (res string) {
+	res = BodyTooLargeErrorMessage
+	return
+}
+
+func (customErr NoUpstreamError) Error() (res string) {
+	res = NoUpstreamErrorMessage
+	return
+}
+
+func (customErr UpstreamStatusError) Error() (res string) {
+	res = "Upstream responded with status " + strconv.Itoa(customErr.StatusCode)
+	return
+}
+
+func (customErr CircuitOpenError) Error() (res string) {
+	res = "Circuit open for upstream " + customErr.Upstream
+	return
+}
+
+func (customErr ProxyBusyError) Error() (res string) {
+
+	if res = ProxyBusyErrorMessage; customErr.Tenant != "" {
+		res += " for tenant " + customErr.Tenant
+	}
+
+	return
+}
+
+func (customErr ConcurrencyLimitError) Error() (res string) {
+	res = "Concurrency limit reached, retry after " + strconv.Itoa(customErr.RetryAfter) + "s"
+	return
+}
+
+func (customErr UpstreamTimeoutError) Error() (res string) {
+	res = "Upstream " + customErr.Phase + " timeout"
+	return
+}
+
+func (customErr ResponseValidationError) Error() (res string) {
+	res = "Response failed validation, " + customErr.Reason
+	return
+}
+
+// getErrorStatus is the status code the client gets
+// for a request which failed with err
+func getErrorStatus(err error) (statusCode int) {
+
+	switch err.(type) {
+
+	case BodyTooLargeError:
+		statusCode = http.StatusRequestEntityTooLarge
+
+	case NoUpstreamError, CircuitOpenError, ProxyBusyError, ConcurrencyLimitError:
+		statusCode = http.StatusServiceUnavailable
+
+	case UpstreamTimeoutError:
+		statusCode = http.StatusGatewayTimeout
+
+	default:
+		statusCode = http.StatusInternalServerError
+	}
+
+	return
+}
@@ -0,0 +1,384 @@
+package httpcache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	DiscoveryTypeSRV  = "srv"
+	DiscoveryTypeA    = "a"
+	DiscoveryTypeFile = "file"
+
+	DefaultDiscoveryMinTTL   = 5
+	DefaultDiscoveryMaxTTL   = 300
+	DefaultDiscoveryInterval = 5
+)
+
+type (
+	// DiscoveryConfig finds the upstreams of the pool instead
+	// of listing them. With srv and a, Name is looked up in DNS
+	// and looked up again once the records expire, within MinTTL
+	// and MaxTTL seconds. Addresses are both A and AAAA records,
+	// type a needs the Port the upstreams listen on. Resolver
+	// is the DNS server, the first one of /etc/resolv.conf by
+	// default. With file, File is a JSON list of upstreams, like
+	// the upstreams section, checked for changes every Interval
+	// seconds. Protocol and TLS apply to the upstreams found
+	DiscoveryConfig struct {
+		Type     string `json:"type"`
+		Name     string `json:"name"`
+		Port     int    `json:"port"`
+		Scheme   string `json:"scheme"`
+		Resolver string `json:"resolver"`
+		MinTTL   int64  `json:"min_ttl"`
+		MaxTTL   int64  `json:"max_ttl"`
+
+		File     string `json:"file"`
+		Interval int64  `json:"interval"`
+
+		Protocol string             `json:"protocol"`
+		TLS      *UpstreamTLSConfig `json:"tls"`
+	}
+
+	// UpstreamDiscovery keeps the upstreams of
+	// the pool in line with what it finds
+	UpstreamDiscovery struct {
+		pool *UpstreamPool
+		cfg  *DiscoveryConfig
+
+		server  string
+		modTime time.Time
+
+		// upstreamCfgs are the upstreams last
+		// applied to the pool
+		upstreamCfgs []UpstreamConfig
+	}
+)
+
+func NewUpstreamDiscovery(pool *UpstreamPool, cfg *DiscoveryConfig) (discovery *UpstreamDiscovery, err error) {
+
+	discovery = &UpstreamDiscovery{
+		pool: pool,
+		cfg:  cfg,
+	}
+
+	switch cfg.Type {
+
+	case DiscoveryTypeSRV, DiscoveryTypeA:
+
+		if cfg.Name == "" {
+			err = errors.New("Discovery of type " + cfg.Type + " needs a name")
+			return
+		}
+
+		if cfg.Type == DiscoveryTypeA && cfg.Port <= 0 {
+			err = errors.New("Discovery of type a needs a port")
+			return
+		}
+
+		discovery.server = getDNSServer(cfg.Resolver)
+
+	case DiscoveryTypeFile:
+
+		if cfg.File == "" {
+			err = errors.New("Discovery of type file needs a file")
+			return
+		}
+
+	default:
+		err = errors.New("Unknown discovery type " + cfg.Type)
+		return
+	}
+
+	switch cfg.Scheme {
+	case "":
+		cfg.Scheme = UpstreamSchemeHttp
+	case UpstreamSchemeHttp, UpstreamSchemeHttps:
+	default:
+		err = errors.New("Unsupported discovery scheme " + cfg.Scheme)
+		return
+	}
+
+	if cfg.MinTTL <= 0 {
+		cfg.MinTTL = DefaultDiscoveryMinTTL
+	}
+
+	if cfg.MaxTTL <= 0 {
+		cfg.MaxTTL = DefaultDiscoveryMaxTTL
+	}
+
+	if cfg.MaxTTL < cfg.MinTTL {
+		cfg.MaxTTL = cfg.MinTTL
+	}
+
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultDiscoveryInterval
+	}
+
+	return
+}
+
+// Process refreshes the upstreams until the pool is stopped
+func (discovery *UpstreamDiscovery) Process(stopCh chan struct{}) {
+
+	var (
+		wait time.Duration
+	)
+
+	for {
+		wait = discovery.Refresh()
+
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Refresh updates the pool with the upstreams found, keeping
+// the current ones when the discovery fails or finds none.
+// It returns the time until the next refresh
+func (discovery *UpstreamDiscovery) Refresh() (wait time.Duration) {
+
+	var (
+		upstreamCfgs []UpstreamConfig
+		modTime      time.Time
+		isChanged    bool
+		err          error
+	)
+
+	if wait = time.Duration(discovery.cfg.Interval) * time.Second; discovery.cfg.Type == DiscoveryTypeFile {
+		upstreamCfgs, modTime, isChanged, err = discovery.readFile()
+	} else {
+		upstreamCfgs, wait, err = discovery.resolve()
+		isChanged = true
+	}
+
+	// The pool is left alone while the
+	// same upstreams keep being found
+	if err == nil && isChanged && !reflect.DeepEqual(upstreamCfgs, discovery.upstreamCfgs) {
+		err = discovery.pool.UpdateUpstreams(upstreamCfgs)
+	}
+
+	// The file is read again until it was
+	// applied, even if it doesn't change
+	if err == nil && isChanged {
+		discovery.upstreamCfgs = upstreamCfgs
+		discovery.modTime = modTime
+	}
+
+	if err != nil {
+
+		discovery.pool.httpCacheCtxt.Stats.Upstream.DiscoveryErrors.Inc()
+
+		discovery.pool.httpCacheCtxt.logger.WithFields(logrus.Fields{
+			"type":       discovery.cfg.Type,
+			"error":      err.Error(),
+			"event_type": "upstream_discovery_failed",
+		}).Warn("Failed to discover upstreams")
+
+		wait = time.Duration(discovery.cfg.MinTTL) * time.Second
+	}
+
+	return
+}
+
+// resolve looks the upstreams up in DNS, the next lookup
+// being due when the first of the records expires
+func (discovery *UpstreamDiscovery) resolve() (upstreamCfgs []UpstreamConfig, wait time.Duration, err error) {
+
+	var (
+		ctx       context.Context
+		cancel    context.CancelFunc
+		records   []DNSRecord
+		addresses []DNSRecord
+		ttl       uint32
+		priority  uint16
+	)
+
+	ctx, cancel = context.WithTimeout(context.Background(), DNSTimeout)
+	defer cancel()
+
+	if discovery.cfg.Type == DiscoveryTypeA {
+
+		if records, err = queryDNSAddresses(ctx, discovery.server, discovery.cfg.Name); err != nil {
+			return
+		}
+
+		for idx := range records {
+			records[idx].Port = uint16(discovery.cfg.Port)
+			records[idx].Target = discovery.cfg.Name
+		}
+
+		addresses = records
+
+	} else {
+
+		if records, err = queryDNS(ctx, discovery.server, discovery.cfg.Name, dnsmessage.TypeSRV); err != nil {
+			return
+		}
+
+		// Only the targets of the lowest priority are used,
+		// the others are backups in SRV terms
+		for idx, record := range records {
+			if idx == 0 || record.Priority < priority {
+				priority = record.Priority
+			}
+		}
+
+		for _, record := range records {
+
+			var (
+				targetRecords []DNSRecord
+			)
+
+			if record.Priority != priority {
+				continue
+			}
+
+			if targetRecords, err = queryDNSAddresses(ctx, discovery.server, record.Target); err != nil {
+				return
+			}
+
+			for _, targetRecord := range targetRecords {
+
+				targetRecord.Port = record.Port
+				targetRecord.Weight = record.Weight
+				targetRecord.Target = record.Target
+
+				if record.TTL < targetRecord.TTL {
+					targetRecord.TTL = record.TTL
+				}
+
+				addresses = append(addresses, targetRecord)
+			}
+		}
+	}
+
+	if len(addresses) == 0 {
+		err = errors.New("No upstream found for " + discovery.cfg.Name)
+		return
+	}
+
+	ttl = addresses[0].TTL
+
+	for _, address := range addresses {
+
+		if address.TTL < ttl {
+			ttl = address.TTL
+		}
+
+		upstreamCfgs = append(upstreamCfgs, discovery.getUpstreamConfig(address))
+	}
+
+	// Servers rotate the records, the order
+	// doesn't change the upstreams found
+	sort.Slice(upstreamCfgs, func(i, j int) bool {
+		return upstreamCfgs[i].Name < upstreamCfgs[j].Name
+	})
+
+	wait = time.Duration(ttl) * time.Second
+
+	if minTTL := time.Duration(discovery.cfg.MinTTL) * time.Second; wait < minTTL {
+		wait = minTTL
+	}
+
+	if maxTTL := time.Duration(discovery.cfg.MaxTTL) * time.Second; wait > maxTTL {
+		wait = maxTTL
+	}
+
+	return
+}
+
+func (discovery *UpstreamDiscovery) getUpstreamConfig(address DNSRecord) (upstreamCfg UpstreamConfig) {
+
+	var (
+		hostPort string
+	)
+
+	hostPort = net.JoinHostPort(address.IP.String(), strconv.Itoa(int(address.Port)))
+
+	upstreamCfg = UpstreamConfig{
+		Name:     hostPort,
+		URL:      discovery.cfg.Scheme + "://" + hostPort,
+		Weight:   int(address.Weight),
+		Protocol: discovery.cfg.Protocol,
+	}
+
+	// The certificate of the upstream is for its
+	// DNS name rather than for its address
+	if discovery.cfg.Scheme == UpstreamSchemeHttps {
+
+		upstreamCfg.TLS = &UpstreamTLSConfig{}
+
+		if discovery.cfg.TLS != nil {
+			*upstreamCfg.TLS = *discovery.cfg.TLS
+		}
+
+		if upstreamCfg.TLS.ServerName == "" {
+			upstreamCfg.TLS.ServerName = address.Target
+		}
+	}
+
+	return
+}
+
+// readFile reads the upstreams of the file when it changed
+// since it was last applied
+func (discovery *UpstreamDiscovery) readFile() (upstreamCfgs []UpstreamConfig, modTime time.Time, isChanged bool, err error) {
+
+	var (
+		info os.FileInfo
+		data []byte
+	)
+
+	if info, err = os.Stat(discovery.cfg.File); err != nil {
+		return
+	}
+
+	if modTime = info.ModTime(); modTime.Equal(discovery.modTime) {
+		return
+	}
+
+	if data, err = ioutil.ReadFile(discovery.cfg.File); err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(data, &upstreamCfgs); err != nil {
+		return
+	}
+
+	if len(upstreamCfgs) == 0 {
+		err = errors.New("No upstream found in " + discovery.cfg.File)
+		return
+	}
+
+	for idx := range upstreamCfgs {
+
+		if upstreamCfgs[idx].Protocol == "" {
+			upstreamCfgs[idx].Protocol = discovery.cfg.Protocol
+		}
+
+		if upstreamCfgs[idx].TLS == nil && discovery.cfg.TLS != nil {
+			tlsCfg := *discovery.cfg.TLS
+			upstreamCfgs[idx].TLS = &tlsCfg
+		}
+	}
+
+	isChanged = true
+
+	return
+}
@@ -0,0 +1,237 @@
+package httpcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestUpstreamPool(t *testing.T, discoveryCfg *DiscoveryConfig) (pool *UpstreamPool) {
+
+	var (
+		httpCacheCtxt *HttpCacheCtxt
+		err           error
+	)
+
+	httpCacheCtxt = &HttpCacheCtxt{
+		Config: &Config{Discovery: discoveryCfg},
+		Stats:  getTestStats(t),
+
+		logger: logrus.New(),
+	}
+
+	httpCacheCtxt.logger.SetOutput(ioutil.Discard)
+
+	if pool, err = NewUpstreamPool(httpCacheCtxt); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func getTestUpstreams(pool *UpstreamPool) (upstreams map[string]*Upstream) {
+
+	upstreams = make(map[string]*Upstream)
+
+	for _, upstream := range pool.Upstreams() {
+		upstreams[upstream.Name] = upstream
+	}
+
+	return
+}
+
+func writeTestFile(t *testing.T, path string, data string, modTime time.Time) {
+
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpstreamDiscoverySRV(t *testing.T) {
+
+	var (
+		server    *testDNSServer
+		pool      *UpstreamPool
+		upstreams map[string]*Upstream
+		updated   map[string]*Upstream
+		wait      time.Duration
+	)
+
+	server = newTestDNSServer(t, false, false)
+
+	// The backup of priority 2 is left out, b is IPv6 only
+	server.SetSRV("_api._tcp.test",
+		DNSRecord{Priority: 1, Weight: 5, Port: 8080, Target: "a.test"},
+		DNSRecord{Priority: 1, Weight: 0, Port: 8081, Target: "b.test"},
+		DNSRecord{Priority: 2, Weight: 1, Port: 8082, Target: "c.test"})
+
+	server.SetAddresses("a.test", "10.0.0.1")
+	server.SetAddresses("b.test", "2001:db8::2")
+	server.SetAddresses("c.test", "10.0.0.3")
+
+	pool = newTestUpstreamPool(t, &DiscoveryConfig{
+		Type:     DiscoveryTypeSRV,
+		Name:     "_api._tcp.test",
+		Resolver: server.Addr,
+		MinTTL:   1,
+	})
+
+	upstreams = getTestUpstreams(pool)
+
+	if len(upstreams) != 2 || upstreams["10.0.0.1:8080"] == nil || upstreams["[2001:db8::2]:8081"] == nil {
+		t.Fatalf("Discovered %v", upstreams)
+	}
+
+	if upstreams["10.0.0.1:8080"].Weight != 5 || upstreams["[2001:db8::2]:8081"].Weight != 1 {
+		t.Fatal("Weights of the SRV records not applied")
+	}
+
+	if wait = pool.Discovery.Refresh(); wait != time.Duration(server.ttl)*time.Second {
+		t.Fatalf("Next refresh in %v instead of the TTL", wait)
+	}
+
+	// The same answer leaves the pool alone
+	first := pool.Upstreams()
+	pool.Discovery.Refresh()
+
+	if &first[0] != &pool.Upstreams()[0] {
+		t.Fatal("Pool updated although the answer didn't change")
+	}
+
+	// A new weight replaces the upstream, under the same
+	// name and with its metrics kept
+	server.SetSRV("_api._tcp.test",
+		DNSRecord{Priority: 1, Weight: 7, Port: 8080, Target: "a.test"},
+		DNSRecord{Priority: 1, Weight: 0, Port: 8081, Target: "b.test"})
+
+	pool.Discovery.Refresh()
+
+	if updated = getTestUpstreams(pool); updated["10.0.0.1:8080"] == upstreams["10.0.0.1:8080"] ||
+		updated["10.0.0.1:8080"].Weight != 7 {
+
+		t.Fatal("Upstream with a new weight not replaced")
+	}
+
+	if updated["[2001:db8::2]:8081"] != upstreams["[2001:db8::2]:8081"] {
+		t.Fatal("Unchanged upstream replaced")
+	}
+
+	// The replaced upstream starts closed, without the
+	// state it was left in
+	upstreams["10.0.0.1:8080"].stats.Upstream.CircuitState.WithLabelValues("10.0.0.1:8080", CircuitOpen).Set(1)
+
+	server.SetSRV("_api._tcp.test",
+		DNSRecord{Priority: 1, Weight: 5, Port: 8080, Target: "a.test"},
+		DNSRecord{Priority: 1, Weight: 0, Port: 8081, Target: "b.test"})
+
+	pool.Discovery.Refresh()
+
+	if pool.httpCacheCtxt.Stats.Upstream.CircuitState.DeleteLabelValues("10.0.0.1:8080", CircuitOpen) {
+		t.Fatal("Circuit state of the replaced upstream kept")
+	}
+
+	if !pool.httpCacheCtxt.Stats.Upstream.CircuitState.DeleteLabelValues("10.0.0.1:8080", CircuitClosed) {
+		t.Fatal("Replaced upstream not closed")
+	}
+
+	if !pool.httpCacheCtxt.Stats.Upstream.Healthy.DeleteLabelValues("10.0.0.1:8080") {
+		t.Fatal("Metrics of the replaced upstream deleted")
+	}
+}
+
+func TestUpstreamDiscoveryTTLBounds(t *testing.T) {
+
+	var (
+		discovery *UpstreamDiscovery
+		err       error
+	)
+
+	if discovery, err = NewUpstreamDiscovery(nil, &DiscoveryConfig{
+		Type:   DiscoveryTypeA,
+		Name:   "api.test",
+		Port:   8080,
+		MinTTL: 600,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if discovery.cfg.MaxTTL != 600 {
+		t.Fatalf("max_ttl %d below min_ttl 600", discovery.cfg.MaxTTL)
+	}
+
+	if discovery, err = NewUpstreamDiscovery(nil, &DiscoveryConfig{
+		Type: DiscoveryTypeA,
+		Name: "api.test",
+		Port: 8080,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if discovery.cfg.MinTTL != DefaultDiscoveryMinTTL || discovery.cfg.MaxTTL != DefaultDiscoveryMaxTTL {
+		t.Fatalf("TTLs default to %d and %d", discovery.cfg.MinTTL, discovery.cfg.MaxTTL)
+	}
+}
+
+func TestUpstreamDiscoveryFile(t *testing.T) {
+
+	var (
+		path      string
+		modTime   time.Time
+		pool      *UpstreamPool
+		upstreams map[string]*Upstream
+		updated   map[string]*Upstream
+	)
+
+	path = filepath.Join(t.TempDir(), "upstreams.json")
+	modTime = time.Now().Add(-time.Hour)
+
+	writeTestFile(t, path, `[{"name": "x", "url": "http://127.0.0.1:1"}, {"name": "y", "url": "http://127.0.0.1:2"}]`, modTime)
+
+	pool = newTestUpstreamPool(t, &DiscoveryConfig{Type: DiscoveryTypeFile, File: path})
+
+	if upstreams = getTestUpstreams(pool); len(upstreams) != 2 || upstreams["x"] == nil || upstreams["y"] == nil {
+		t.Fatalf("Read %v", upstreams)
+	}
+
+	// A new protocol replaces the upstream
+	modTime = modTime.Add(time.Minute)
+	writeTestFile(t, path, `[{"name": "x", "url": "http://127.0.0.1:1", "protocol": "h2c"}, {"name": "y", "url": "http://127.0.0.1:2"}]`, modTime)
+
+	pool.Discovery.Refresh()
+
+	if updated = getTestUpstreams(pool); updated["x"] == upstreams["x"] || updated["x"].Protocol != UpstreamProtocolH2c {
+		t.Fatal("Upstream with a new protocol not replaced")
+	}
+
+	if updated["y"] != upstreams["y"] {
+		t.Fatal("Unchanged upstream replaced")
+	}
+
+	// A file which can't be applied is
+	// read again, even if it doesn't change
+	upstreams = updated
+	modTime = modTime.Add(time.Minute)
+	writeTestFile(t, path, `[{"name": "x", "url": "http://127.0.0.1:1"}, {"name": "x", "url": "http://127.0.0.1:3"}]`, modTime)
+
+	pool.Discovery.Refresh()
+
+	if updated = getTestUpstreams(pool); updated["x"] != upstreams["x"] || updated["y"] != upstreams["y"] {
+		t.Fatal("Pool changed by a file with duplicate upstreams")
+	}
+
+	writeTestFile(t, path, `[{"name": "x", "url": "http://127.0.0.1:1"}, {"name": "z", "url": "http://127.0.0.1:3"}]`, modTime)
+
+	pool.Discovery.Refresh()
+
+	if updated = getTestUpstreams(pool); len(updated) != 2 || updated["z"] == nil {
+		t.Fatalf("File not read again after failing, got %v", updated)
+	}
+}
@@ -0,0 +1,325 @@
+package httpcache
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	DNSPort    = "53"
+	DNSTimeout = 5 * time.Second
+
+	DefaultResolvConf = "/etc/resolv.conf"
+	DefaultDNSServer  = "127.0.0.1:53"
+)
+
+type (
+	// DNSRecord is an A, AAAA or SRV record of an answer, the
+	// standard resolver doesn't tell their TTLs
+	DNSRecord struct {
+		TTL uint32
+
+		IP net.IP
+
+		Priority uint16
+		Weight   uint16
+		Port     uint16
+		Target   string
+	}
+)
+
+// getDNSServer is the server the discovery queries, the
+// configured one or else the first of resolv.conf
+func getDNSServer(server string) (address string) {
+
+	var (
+		file    *os.File
+		scanner *bufio.Scanner
+		err     error
+	)
+
+	if server != "" {
+		if _, _, err = net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, DNSPort)
+		}
+
+		address = server
+		return
+	}
+
+	address = DefaultDNSServer
+
+	if file, err = os.Open(DefaultResolvConf); err != nil {
+		return
+	}
+
+	defer file.Close()
+
+	scanner = bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) >= 2 && fields[0] == "nameserver" {
+			address = net.JoinHostPort(fields[1], DNSPort)
+			return
+		}
+	}
+
+	return
+}
+
+// queryDNS asks the server for the records of the given type,
+// over UDP and again over TCP when the answer was truncated
+func queryDNS(ctx context.Context, server string, name string, qtype dnsmessage.Type) (records []DNSRecord, err error) {
+
+	var (
+		id          uint16
+		query       []byte
+		answer      []byte
+		isTruncated bool
+	)
+
+	id = uint16(rand.Intn(1 << 16))
+
+	if query, err = buildDNSQuery(id, name, qtype); err != nil {
+		return
+	}
+
+	if answer, err = exchangeDNS(ctx, "udp", server, query); err != nil {
+		return
+	}
+
+	if records, isTruncated, err = parseDNSAnswer(answer, id, qtype); err != nil || !isTruncated {
+		return
+	}
+
+	if answer, err = exchangeDNS(ctx, "tcp", server, query); err != nil {
+		return
+	}
+
+	records, _, err = parseDNSAnswer(answer, id, qtype)
+
+	return
+}
+
+// queryDNSAddresses asks the server for both the IPv4
+// and the IPv6 addresses of the name
+func queryDNSAddresses(ctx context.Context, server string, name string) (records []DNSRecord, err error) {
+
+	var (
+		records6 []DNSRecord
+	)
+
+	if records, err = queryDNS(ctx, server, name, dnsmessage.TypeA); err != nil {
+		return
+	}
+
+	if records6, err = queryDNS(ctx, server, name, dnsmessage.TypeAAAA); err != nil {
+		return
+	}
+
+	records = append(records, records6...)
+
+	return
+}
+
+func buildDNSQuery(id uint16, name string, qtype dnsmessage.Type) (query []byte, err error) {
+
+	var (
+		qname dnsmessage.Name
+	)
+
+	if qname, err = dnsmessage.NewName(strings.TrimSuffix(name, ".") + "."); err != nil {
+		return
+	}
+
+	query, err = (&dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}).Pack()
+
+	return
+}
+
+func exchangeDNS(ctx context.Context, network string, server string, query []byte) (answer []byte, err error) {
+
+	var (
+		dialer   *net.Dialer
+		conn     net.Conn
+		deadline time.Time
+		isSet    bool
+		n        int
+	)
+
+	dialer = &net.Dialer{}
+
+	if conn, err = dialer.DialContext(ctx, network, server); err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	if deadline, isSet = ctx.Deadline(); !isSet {
+		deadline = time.Now().Add(DNSTimeout)
+	}
+
+	conn.SetDeadline(deadline)
+
+	// Messages over TCP are prefixed by their length
+	if network == "tcp" {
+
+		if _, err = conn.Write(append([]byte{byte(len(query) >> 8), byte(len(query))}, query...)); err != nil {
+			return
+		}
+
+		answer = make([]byte, 2)
+
+		if _, err = io.ReadFull(conn, answer); err != nil {
+			return
+		}
+
+		answer = make([]byte, binary.BigEndian.Uint16(answer))
+		_, err = io.ReadFull(conn, answer)
+
+		return
+	}
+
+	if _, err = conn.Write(query); err != nil {
+		return
+	}
+
+	answer = make([]byte, 65535)
+
+	// Datagrams of other queries, such as late answers
+	// to a former one, are skipped until the deadline
+	for {
+		if n, err = conn.Read(answer); err != nil {
+			return
+		}
+
+		if n >= 2 && answer[0] == query[0] && answer[1] == query[1] {
+			break
+		}
+	}
+
+	answer = answer[:n]
+
+	return
+}
+
+// parseDNSAnswer reads the records of the given type from
+// the answer section, others such as CNAMEs are skipped
+func parseDNSAnswer(msg []byte, id uint16, qtype dnsmessage.Type) (records []DNSRecord, isTruncated bool, err error) {
+
+	var (
+		parser  dnsmessage.Parser
+		header  dnsmessage.Header
+		rHeader dnsmessage.ResourceHeader
+	)
+
+	if header, err = parser.Start(msg); err != nil {
+		return
+	}
+
+	if header.ID != id {
+		err = errors.New("Mismatched DNS answer id")
+		return
+	}
+
+	if !header.Response {
+		err = errors.New("DNS answer is a query")
+		return
+	}
+
+	if isTruncated = header.Truncated; isTruncated {
+		return
+	}
+
+	if header.RCode != dnsmessage.RCodeSuccess {
+		err = errors.New("DNS query failed with " + header.RCode.String())
+		return
+	}
+
+	if err = parser.SkipAllQuestions(); err != nil {
+		return
+	}
+
+	for {
+		if rHeader, err = parser.AnswerHeader(); err == dnsmessage.ErrSectionDone {
+			err = nil
+			return
+		} else if err != nil {
+			return
+		}
+
+		if rHeader.Type != qtype || rHeader.Class != dnsmessage.ClassINET {
+
+			if err = parser.SkipAnswer(); err != nil {
+				return
+			}
+
+			continue
+		}
+
+		record := DNSRecord{TTL: rHeader.TTL}
+
+		switch rHeader.Type {
+
+		case dnsmessage.TypeA:
+
+			var resource dnsmessage.AResource
+
+			if resource, err = parser.AResource(); err != nil {
+				return
+			}
+
+			record.IP = net.IP(append([]byte{}, resource.A[:]...))
+
+		case dnsmessage.TypeAAAA:
+
+			var resource dnsmessage.AAAAResource
+
+			if resource, err = parser.AAAAResource(); err != nil {
+				return
+			}
+
+			record.IP = net.IP(append([]byte{}, resource.AAAA[:]...))
+
+		case dnsmessage.TypeSRV:
+
+			var resource dnsmessage.SRVResource
+
+			if resource, err = parser.SRVResource(); err != nil {
+				return
+			}
+
+			record.Priority = resource.Priority
+			record.Weight = resource.Weight
+			record.Port = resource.Port
+			record.Target = strings.TrimSuffix(resource.Target.String(), ".")
+
+		default:
+
+			if err = parser.SkipAnswer(); err != nil {
+				return
+			}
+
+			continue
+		}
+
+		records = append(records, record)
+	}
+}
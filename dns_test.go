@@ -0,0 +1,323 @@
+package httpcache
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type (
+	// testDNSServer answers A, AAAA and SRV queries over
+	// UDP and TCP on the same port
+	testDNSServer struct {
+		Addr string
+
+		// isTruncated answers over UDP with the truncated flag
+		// only, isStray sends the answer of another query first
+		isTruncated bool
+		isStray     bool
+
+		addresses  map[string][]net.IP
+		srvs       map[string][]DNSRecord
+		ttl        uint32
+		tcpQueries int
+
+		udpConn     net.PacketConn
+		tcpListener net.Listener
+		lock        *sync.Mutex
+	}
+)
+
+func newTestDNSServer(t *testing.T, isTruncated bool, isStray bool) (server *testDNSServer) {
+
+	var (
+		err error
+	)
+
+	server = &testDNSServer{
+		isTruncated: isTruncated,
+		isStray:     isStray,
+
+		addresses: make(map[string][]net.IP),
+		srvs:      make(map[string][]DNSRecord),
+		ttl:       30,
+		lock:      &sync.Mutex{},
+	}
+
+	// The TCP port is taken after the UDP one,
+	// another socket may hold it already
+	for attempt := 0; server.tcpListener == nil; attempt++ {
+
+		if server.udpConn, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+
+		if server.tcpListener, err = net.Listen("tcp", server.udpConn.LocalAddr().String()); err != nil {
+
+			server.udpConn.Close()
+
+			if attempt == 10 {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	server.Addr = server.udpConn.LocalAddr().String()
+
+	go server.serveUDP()
+	go server.serveTCP()
+
+	t.Cleanup(func() {
+		server.udpConn.Close()
+		server.tcpListener.Close()
+	})
+
+	return
+}
+
+func (server *testDNSServer) SetAddresses(name string, ips ...string) {
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.addresses[name] = nil
+
+	for _, ip := range ips {
+		server.addresses[name] = append(server.addresses[name], net.ParseIP(ip))
+	}
+}
+
+func (server *testDNSServer) SetSRV(name string, records ...DNSRecord) {
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.srvs[name] = records
+}
+
+func (server *testDNSServer) TCPQueries() (count int) {
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	count = server.tcpQueries
+
+	return
+}
+
+func (server *testDNSServer) serveUDP() {
+
+	var (
+		buf  = make([]byte, 512)
+		addr net.Addr
+		n    int
+		err  error
+	)
+
+	for {
+		if n, addr, err = server.udpConn.ReadFrom(buf); err != nil {
+			return
+		}
+
+		query := append([]byte{}, buf[:n]...)
+
+		if server.isStray {
+			stray := server.answer(query, false)
+			stray[0]++
+			server.udpConn.WriteTo(stray, addr)
+		}
+
+		server.udpConn.WriteTo(server.answer(query, server.isTruncated), addr)
+	}
+}
+
+func (server *testDNSServer) serveTCP() {
+
+	for {
+		conn, err := server.tcpListener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func(conn net.Conn) {
+
+			defer conn.Close()
+
+			length := make([]byte, 2)
+
+			if _, err := io.ReadFull(conn, length); err != nil {
+				return
+			}
+
+			query := make([]byte, binary.BigEndian.Uint16(length))
+
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+
+			server.lock.Lock()
+			server.tcpQueries++
+			server.lock.Unlock()
+
+			answer := server.answer(query, false)
+			conn.Write(append([]byte{byte(len(answer) >> 8), byte(len(answer))}, answer...))
+		}(conn)
+	}
+}
+
+// answer echoes the question, followed by the records of
+// the name
+func (server *testDNSServer) answer(query []byte, isTruncated bool) (answer []byte) {
+
+	var (
+		msg      dnsmessage.Message
+		question dnsmessage.Question
+		name     string
+		err      error
+	)
+
+	if err = msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return
+	}
+
+	question = msg.Questions[0]
+	name = strings.TrimSuffix(question.Name.String(), ".")
+
+	msg.Header.Response = true
+	msg.Header.RecursionAvailable = true
+
+	if msg.Header.Truncated = isTruncated; isTruncated {
+		answer, _ = msg.Pack()
+		return
+	}
+
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	addRecord := func(body dnsmessage.ResourceBody) {
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  question.Name,
+				Type:  question.Type,
+				Class: dnsmessage.ClassINET,
+				TTL:   server.ttl,
+			},
+			Body: body,
+		})
+	}
+
+	switch question.Type {
+
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+
+		for _, ip := range server.addresses[name] {
+			if ip4 := ip.To4(); ip4 != nil && question.Type == dnsmessage.TypeA {
+				addRecord(&dnsmessage.AResource{A: [4]byte(ip4)})
+			} else if ip4 == nil && question.Type == dnsmessage.TypeAAAA {
+				addRecord(&dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())})
+			}
+		}
+
+	case dnsmessage.TypeSRV:
+
+		for _, record := range server.srvs[name] {
+			addRecord(&dnsmessage.SRVResource{
+				Priority: record.Priority,
+				Weight:   record.Weight,
+				Port:     record.Port,
+				Target:   dnsmessage.MustNewName(record.Target + "."),
+			})
+		}
+	}
+
+	answer, _ = msg.Pack()
+
+	return
+}
+
+func getRecordIPs(records []DNSRecord) (ips []string) {
+
+	for _, record := range records {
+		ips = append(ips, record.IP.String())
+	}
+
+	sort.Strings(ips)
+
+	return
+}
+
+func TestQueryDNSAddresses(t *testing.T) {
+
+	var (
+		server  *testDNSServer
+		records []DNSRecord
+		ips     []string
+		err     error
+	)
+
+	server = newTestDNSServer(t, false, false)
+	server.SetAddresses("api.test", "10.0.0.1", "2001:db8::1", "10.0.0.2")
+
+	if records, err = queryDNSAddresses(context.Background(), server.Addr, "api.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ips = getRecordIPs(records); strings.Join(ips, ",") != "10.0.0.1,10.0.0.2,2001:db8::1" {
+		t.Fatalf("Resolved to %v", ips)
+	}
+
+	if records[0].TTL != server.ttl {
+		t.Fatalf("TTL %d instead of %d", records[0].TTL, server.ttl)
+	}
+}
+
+func TestQueryDNSTruncatedRetriesOverTCP(t *testing.T) {
+
+	var (
+		server  *testDNSServer
+		records []DNSRecord
+		err     error
+	)
+
+	server = newTestDNSServer(t, true, false)
+	server.SetSRV("_api._tcp.test", DNSRecord{Priority: 1, Weight: 5, Port: 8080, Target: "a.test"})
+
+	if records, err = queryDNS(context.Background(), server.Addr, "_api._tcp.test", dnsmessage.TypeSRV); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 1 || records[0].Target != "a.test" || records[0].Port != 8080 || records[0].Weight != 5 {
+		t.Fatalf("Got %+v", records)
+	}
+
+	if server.TCPQueries() != 1 {
+		t.Fatalf("%d queries over TCP instead of 1", server.TCPQueries())
+	}
+}
+
+func TestQueryDNSSkipsMismatchedAnswers(t *testing.T) {
+
+	var (
+		server  *testDNSServer
+		records []DNSRecord
+		err     error
+	)
+
+	server = newTestDNSServer(t, false, true)
+	server.SetAddresses("api.test", "10.0.0.1")
+
+	if records, err = queryDNS(context.Background(), server.Addr, "api.test", dnsmessage.TypeA); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 1 || records[0].IP.String() != "10.0.0.1" {
+		t.Fatalf("Got %+v", records)
+	}
+}
@@ -0,0 +1,242 @@
+package httpcache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	OutcomeHit   = "hit"
+	OutcomeStale = "stale"
+	OutcomeMiss  = "miss"
+	OutcomeLocal = "local"
+	OutcomeProxy = "proxy"
+)
+
+type (
+	ExplainReq struct {
+		Method  string            `json:"method"`
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+		Body    string            `json:"body"`
+	}
+
+	ExplainResp struct {
+		Method string `json:"method"`
+		URL    string `json:"url"`
+
+		Tenant   string            `json:"tenant"`
+		Key      string            `json:"key"`
+		Vars     map[string]string `json:"vars,omitempty"`
+		Priority string            `json:"priority"`
+
+		Route   string         `json:"route"`
+		Pattern string         `json:"pattern,omitempty"`
+		Policy  *ExplainPolicy `json:"policy"`
+
+		Skipped bool          `json:"skipped"`
+		Entry   *ExplainEntry `json:"entry"`
+
+		Outcome string `json:"outcome"`
+		Error   string `json:"error,omitempty"`
+	}
+
+	ExplainPolicy struct {
+		Handler              string   `json:"handler"`
+		Methods              []string `json:"methods"`
+		CacheableStatuses    []int    `json:"cacheable_statuses"`
+		TTL                  float64  `json:"ttl"`
+		StaleWhileRevalidate float64  `json:"stale_while_revalidate"`
+		StaleIfError         float64  `json:"stale_if_error"`
+		MaxBodyBytes         int64    `json:"max_body_bytes"`
+	}
+
+	ExplainEntry struct {
+		Exists      bool    `json:"exists"`
+		Age         float64 `json:"age,omitempty"`
+		SizeBytes   int     `json:"size_bytes,omitempty"`
+		Valid       bool    `json:"valid"`
+		Invalidated bool    `json:"invalidated"`
+		UsableStale bool    `json:"usable_stale"`
+	}
+)
+
+// getOutcome decides how a request is served given the entry
+// found in the cache for it, if any. processRequest and the
+// explain endpoint both go through it so that they can never
+// disagree
+func (httpCacheCtxt *HttpCacheCtxt) getOutcome(cacheReq *CacheReq, cacheApi *CacheApi) (outcome string) {
+
+	var (
+		policy *RoutePolicy
+	)
+
+	policy = cacheReq.Policy
+
+	switch {
+
+	case cacheApi != nil && cacheApi.IsValid(policy.TTL):
+		outcome = OutcomeHit
+
+	case cacheApi != nil && cacheApi.IsUsableStale(policy.TTL, policy.StaleWhileRevalidate):
+		outcome = OutcomeStale
+
+	case policy.Handler == RouteHandlerLocal:
+		outcome = OutcomeLocal
+
+	case !cacheReq.IsCacheable:
+		outcome = OutcomeProxy
+
+	default:
+		outcome = OutcomeMiss
+	}
+
+	return
+}
+
+func (httpCacheCtxt *HttpCacheCtxt) explain(explainReq *ExplainReq) (explainResp *ExplainResp, err error) {
+
+	var (
+		req      *http.Request
+		cacheReq *CacheReq
+		cacheApi *CacheApi
+		policy   *RoutePolicy
+	)
+
+	if explainReq.Method == "" {
+		explainReq.Method = http.MethodGet
+	}
+
+	if req, err = http.NewRequest(strings.ToUpper(explainReq.Method), explainReq.URL,
+		strings.NewReader(explainReq.Body)); err != nil {
+
+		return
+	}
+
+	for header, value := range explainReq.Headers {
+		req.Header.Set(header, value)
+	}
+
+	explainResp = &ExplainResp{
+		Method: req.Method,
+		URL:    explainReq.URL,
+	}
+
+	if cacheReq, err = httpCacheCtxt.newCacheReq(req); err != nil {
+
+		// The request would be rejected before reaching
+		// the cache, the error is the outcome
+		explainResp.Error = err.Error()
+		err = nil
+
+		return
+	}
+
+	policy = cacheReq.Policy
+
+	explainResp.Tenant = cacheReq.TenantName
+	explainResp.Key = string(cacheReq.ReqKey)
+	explainResp.Vars = cacheReq.Vars
+	explainResp.Priority = cacheReq.Priority
+	explainResp.Route = policy.Name
+	explainResp.Skipped = !cacheReq.IsCacheable
+
+	if cacheReq.Route != nil {
+		explainResp.Pattern = cacheReq.Route.Pattern
+	}
+
+	explainResp.Policy = &ExplainPolicy{
+		Handler:              policy.Handler,
+		TTL:                  policy.TTL.Seconds(),
+		StaleWhileRevalidate: policy.StaleWhileRevalidate.Seconds(),
+		StaleIfError:         policy.StaleIfError.Seconds(),
+		MaxBodyBytes:         policy.MaxBodyBytes,
+	}
+
+	for method := range policy.Methods {
+		explainResp.Policy.Methods = append(explainResp.Policy.Methods, method)
+	}
+
+	for status := range policy.CacheableStatuses {
+		explainResp.Policy.CacheableStatuses = append(explainResp.Policy.CacheableStatuses, status)
+	}
+
+	sort.Strings(explainResp.Policy.Methods)
+	sort.Ints(explainResp.Policy.CacheableStatuses)
+
+	explainResp.Entry = &ExplainEntry{}
+
+	if cacheReq.IsCacheable {
+		cacheApi, _ = httpCacheCtxt.Cache.Peek(cacheReq.TenantName, cacheReq.ReqKey, cacheReq.EntryName())
+	}
+
+	if cacheApi != nil {
+
+		explainResp.Entry.Exists = true
+		explainResp.Entry.Age = cacheApi.Age().Seconds()
+		explainResp.Entry.SizeBytes = len(cacheApi.Data)
+		explainResp.Entry.Valid = cacheApi.IsValid(policy.TTL)
+		explainResp.Entry.Invalidated = atomic.LoadInt64(&cacheApi.Base.InvalidatedAt) > cacheApi.UpdatedAt
+		explainResp.Entry.UsableStale = cacheApi.IsUsableStale(policy.TTL, policy.StaleWhileRevalidate)
+	}
+
+	explainResp.Outcome = httpCacheCtxt.getOutcome(cacheReq, cacheApi)
+
+	return
+}
+
+func (httpCacheCtxt *HttpCacheCtxt) explainHandler(w http.ResponseWriter, req *http.Request) {
+
+	var (
+		reqBody     []byte
+		respBody    []byte
+		explainReq  *ExplainReq
+		explainResp *ExplainResp
+		err         error
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	explainReq = &ExplainReq{}
+
+	if reqBody, err = ioutil.ReadAll(req.Body); err != nil {
+
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(CommonErrMsg)
+
+		return
+	}
+
+	if err = json.Unmarshal(reqBody, explainReq); err != nil || explainReq.URL == "" {
+
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(CommonErrMsg)
+
+		return
+	}
+
+	if explainResp, err = httpCacheCtxt.explain(explainReq); err != nil {
+
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(CommonErrMsg)
+
+		return
+	}
+
+	if respBody, err = json.Marshal(explainResp); err != nil {
+
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(CommonErrMsg)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBody)
+
+	return
+}
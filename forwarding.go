@@ -0,0 +1,186 @@
+package httpcache
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	ForwardingHeaders = []string{
+		"Forwarded",
+		"X-Forwarded-For",
+		"X-Forwarded-Host",
+		"X-Forwarded-Proto",
+	}
+)
+
+type (
+	// ForwardingConfig drives the forwarding headers sent
+	// upstream. The forwarding headers of a client within
+	// TrustedProxies, as well as of a client on the unix
+	// socket, are extended. The ones of any other client
+	// are replaced. Forwarded adds the RFC 7239 header
+	// next to the X-Forwarded ones
+	ForwardingConfig struct {
+		TrustedProxies []string `json:"trusted_proxies"`
+		Forwarded      bool     `json:"forwarded"`
+	}
+)
+
+func parseTrustedProxies(proxies []string) (networks []*net.IPNet, err error) {
+
+	var (
+		network *net.IPNet
+	)
+
+	for _, proxy := range proxies {
+
+		if !strings.Contains(proxy, "/") {
+
+			ip := net.ParseIP(proxy)
+
+			if ip == nil {
+				err = errors.New("Invalid trusted proxy " + proxy)
+				return
+			}
+
+			if ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		if _, network, err = net.ParseCIDR(proxy); err != nil {
+			return
+		}
+
+		networks = append(networks, network)
+	}
+
+	return
+}
+
+// getRemoteIP is the address of the peer of the
+// request, nil for a peer on the unix socket
+func getRemoteIP(req *http.Request) (ip net.IP) {
+
+	var (
+		host string
+		err  error
+	)
+
+	if host, _, err = net.SplitHostPort(req.RemoteAddr); err != nil {
+		host = req.RemoteAddr
+	}
+
+	ip = net.ParseIP(host)
+
+	return
+}
+
+func (proxyCtxt *ProxyCtxt) isTrustedProxy(ip net.IP) (isTrusted bool) {
+
+	// Only local processes reach the unix socket
+	if ip == nil {
+		isTrusted = true
+		return
+	}
+
+	for _, network := range proxyCtxt.TrustedProxies {
+		if network.Contains(ip) {
+			isTrusted = true
+			return
+		}
+	}
+
+	return
+}
+
+// setForwardingHeaders records the hop from the client to the
+// proxy, extending the headers of trusted peers and replacing
+// the ones of the others, which could be forged
+func (proxyCtxt *ProxyCtxt) setForwardingHeaders(header http.Header, req *http.Request) {
+
+	var (
+		remoteIP  net.IP
+		isTrusted bool
+		proto     string
+		host      string
+		chain     []string
+		forwarded []string
+		element   []string
+	)
+
+	remoteIP = getRemoteIP(req)
+	isTrusted = proxyCtxt.isTrustedProxy(remoteIP)
+
+	for _, name := range ForwardingHeaders {
+		header.Del(name)
+	}
+
+	if proto = "http"; req.TLS != nil {
+		proto = "https"
+	}
+
+	host = req.Host
+
+	if isTrusted {
+
+		chain = req.Header.Values("X-Forwarded-For")
+		forwarded = req.Header.Values("Forwarded")
+
+		if value := req.Header.Get("X-Forwarded-Proto"); value != "" {
+			proto = value
+		}
+
+		if value := req.Header.Get("X-Forwarded-Host"); value != "" {
+			host = value
+		}
+	}
+
+	if remoteIP != nil {
+		chain = append(chain, remoteIP.String())
+	}
+
+	if len(chain) > 0 {
+		header.Set("X-Forwarded-For", strings.Join(chain, ", "))
+	}
+
+	header.Set("X-Forwarded-Proto", proto)
+
+	if host != "" {
+		header.Set("X-Forwarded-Host", host)
+	}
+
+	if !proxyCtxt.httpCacheCtxt.Config.Forwarding.Forwarded {
+		return
+	}
+
+	if element = []string{"for=unknown"}; remoteIP != nil {
+
+		if remoteIP.To4() != nil {
+			element[0] = "for=" + remoteIP.String()
+		} else {
+			element[0] = "for=\"[" + remoteIP.String() + "]\""
+		}
+	}
+
+	if req.Host != "" {
+		element = append(element, "host=\""+req.Host+"\"")
+	}
+
+	if req.TLS != nil {
+		element = append(element, "proto=https")
+	} else {
+		element = append(element, "proto=http")
+	}
+
+	forwarded = append(forwarded, strings.Join(element, ";"))
+
+	header.Set("Forwarded", strings.Join(forwarded, ", "))
+
+	return
+}
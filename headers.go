@@ -0,0 +1,292 @@
+package httpcache
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	HeaderActionSet    = "set"
+	HeaderActionAdd    = "add"
+	HeaderActionRemove = "remove"
+	HeaderActionRename = "rename"
+)
+
+type (
+	// HeaderRuleConfig rewrites one header of the requests
+	// sent upstream. Values of set and add are templates in
+	// which ${source:name} is replaced with a part of the
+	// client request, from header, query, cookie, path or
+	// request (method, host, path or remote_ip), or with an
+	// environment variable from env
+	HeaderRuleConfig struct {
+		Action string `json:"action"`
+		Name   string `json:"name"`
+		Value  string `json:"value"`
+		To     string `json:"to"`
+	}
+
+	// HeaderPolicyConfig lists the client headers forwarded
+	// upstream, all of them when Allow is empty, and the rules
+	// applied to them in order
+	HeaderPolicyConfig struct {
+		Allow []string           `json:"allow"`
+		Rules []HeaderRuleConfig `json:"rules"`
+	}
+
+	HeaderPolicy struct {
+		Allow map[string]bool
+		Rules []*HeaderRule
+	}
+
+	HeaderRule struct {
+		Action string
+		Name   string
+		To     string
+		Value  *HeaderTemplate
+	}
+
+	HeaderTemplate struct {
+		parts []templatePart
+	}
+
+	// templatePart is either a literal or,
+	// with a source, a value of the request
+	templatePart struct {
+		literal string
+		keyPart
+	}
+)
+
+func NewHeaderPolicy(cfg *HeaderPolicyConfig) (policy *HeaderPolicy, err error) {
+
+	var (
+		rule *HeaderRule
+	)
+
+	policy = &HeaderPolicy{
+		Allow: make(map[string]bool),
+	}
+
+	for _, name := range cfg.Allow {
+		policy.Allow[http.CanonicalHeaderKey(name)] = true
+	}
+
+	for idx := range cfg.Rules {
+
+		if rule, err = NewHeaderRule(&cfg.Rules[idx]); err != nil {
+			return
+		}
+
+		policy.Rules = append(policy.Rules, rule)
+	}
+
+	return
+}
+
+func NewHeaderRule(cfg *HeaderRuleConfig) (rule *HeaderRule, err error) {
+
+	rule = &HeaderRule{
+		Action: cfg.Action,
+		Name:   http.CanonicalHeaderKey(cfg.Name),
+		To:     http.CanonicalHeaderKey(cfg.To),
+	}
+
+	if rule.Name == "" {
+		err = errors.New("Header rule " + cfg.Action + " has no name")
+		return
+	}
+
+	switch rule.Action {
+
+	case HeaderActionSet, HeaderActionAdd:
+
+		if rule.Value, err = NewHeaderTemplate(cfg.Value); err != nil {
+			return
+		}
+
+	case HeaderActionRemove:
+
+	case HeaderActionRename:
+
+		if rule.To == "" {
+			err = errors.New("Header rule rename of " + rule.Name + " has no target")
+			return
+		}
+
+	default:
+		err = errors.New("Unknown header action " + cfg.Action + " for " + rule.Name)
+		return
+	}
+
+	return
+}
+
+func NewHeaderTemplate(value string) (template *HeaderTemplate, err error) {
+
+	var (
+		start, end int
+		source     string
+		name       string
+		isPresent  bool
+	)
+
+	template = &HeaderTemplate{}
+
+	for {
+		if start = strings.Index(value, "${"); start < 0 {
+			break
+		}
+
+		if end = strings.Index(value[start:], "}"); end < 0 {
+			err = errors.New("Unterminated placeholder in header template " + value)
+			return
+		}
+
+		end += start
+
+		if source, name, isPresent = strings.Cut(value[start+2:end], ":"); !isPresent || name == "" {
+			err = errors.New("Invalid placeholder " + value[start:end+1])
+			return
+		}
+
+		switch source {
+		case "header", "query", "cookie", "path", "env", "request":
+		default:
+			err = errors.New("Unknown placeholder source " + source)
+			return
+		}
+
+		if start > 0 {
+			template.parts = append(template.parts, templatePart{literal: value[:start]})
+		}
+
+		template.parts = append(template.parts, templatePart{
+			keyPart: keyPart{source: source, name: name},
+		})
+
+		value = value[end+1:]
+	}
+
+	if value != "" {
+		template.parts = append(template.parts, templatePart{literal: value})
+	}
+
+	return
+}
+
+func (template *HeaderTemplate) Render(req *http.Request, vars map[string]string) (value string) {
+
+	var (
+		builder strings.Builder
+	)
+
+	for _, part := range template.parts {
+
+		if part.source == "" {
+			builder.WriteString(part.literal)
+			continue
+		}
+
+		switch part.source {
+		case "env":
+			builder.WriteString(os.Getenv(part.name))
+		case "request":
+			builder.WriteString(getRequestAttr(req, part.name))
+		default:
+			builder.WriteString(getRequestValue(req, vars, part.keyPart))
+		}
+	}
+
+	value = builder.String()
+
+	return
+}
+
+func getRequestAttr(req *http.Request, name string) (value string) {
+
+	switch name {
+	case "method":
+		value = req.Method
+	case "host":
+		value = req.Host
+	case "path":
+		value = req.URL.Path
+	case "remote_ip":
+		if value, _, _ = net.SplitHostPort(req.RemoteAddr); value == "" {
+			value = req.RemoteAddr
+		}
+	}
+
+	return
+}
+
+// Apply runs the rules on the header sent upstream
+func (policy *HeaderPolicy) Apply(header http.Header, req *http.Request, vars map[string]string) {
+
+	for _, rule := range policy.Rules {
+
+		switch rule.Action {
+
+		case HeaderActionSet:
+			header.Set(rule.Name, rule.Value.Render(req, vars))
+
+		case HeaderActionAdd:
+			header.Add(rule.Name, rule.Value.Render(req, vars))
+
+		case HeaderActionRemove:
+			header.Del(rule.Name)
+
+		case HeaderActionRename:
+
+			if values := header.Values(rule.Name); len(values) > 0 {
+				header.Del(rule.Name)
+				header[rule.To] = append(header[rule.To], values...)
+			}
+		}
+	}
+
+	return
+}
+
+// buildRequestHeader is the header of the request sent
+// upstream, the allowed end to end client headers with the
+// forwarding headers, rewritten by the global rules and then
+// by the rules of the route. A route allowlist replaces the
+// global one
+func (proxyCtxt *ProxyCtxt) buildRequestHeader(req *http.Request, cacheReq *CacheReq) (header http.Header) {
+
+	var (
+		allow       map[string]bool
+		routePolicy *HeaderPolicy
+	)
+
+	routePolicy = cacheReq.Policy.RequestHeaders
+
+	if allow = proxyCtxt.RequestHeaders.Allow; routePolicy != nil && len(routePolicy.Allow) > 0 {
+		allow = routePolicy.Allow
+	}
+
+	header = req.Header.Clone()
+
+	removeConnectionHeaders(header)
+
+	for name := range header {
+		if len(allow) > 0 && !allow[name] {
+			header.Del(name)
+		}
+	}
+
+	proxyCtxt.setForwardingHeaders(header, req)
+
+	proxyCtxt.RequestHeaders.Apply(header, req, cacheReq.Vars)
+
+	if routePolicy != nil {
+		routePolicy.Apply(header, req, cacheReq.Vars)
+	}
+
+	return
+}
@@ -0,0 +1,436 @@
+package httpcache
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultHealthCheckInterval     = 10
+	DefaultHealthCheckTimeout      = 2
+	DefaultHealthyThreshold        = 2
+	DefaultUnhealthyThreshold      = 3
+	DefaultOutlierFailures         = 5
+	DefaultOutlierBaseEjection     = 30
+	DefaultOutlierMaxEjection      = 300
+	DefaultOutlierMaxPercent       = 50
+	DefaultOutlierLatencyEWMAAlpha = 0.2
+)
+
+var (
+	DefaultOutlierFailureStatuses = []int{
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	}
+)
+
+type (
+	// HealthCheckConfig drives the active checks, the path is
+	// requested on every upstream each interval. Checks are off
+	// without a path. Durations are in seconds
+	HealthCheckConfig struct {
+		Path               string `json:"path"`
+		Interval           int64  `json:"interval"`
+		Timeout            int64  `json:"timeout"`
+		HealthyThreshold   int    `json:"healthy_threshold"`
+		UnhealthyThreshold int    `json:"unhealthy_threshold"`
+	}
+
+	// OutlierDetectionConfig drives the passive ejection of
+	// upstreams based on the proxied requests. An upstream is
+	// ejected after ConsecutiveFailures failures in a row, or
+	// when its average latency goes over LatencyThreshold
+	// milliseconds. Failures are transport errors and responses
+	// with one of FailureStatuses. Each ejection lasts twice as
+	// long as the previous one, up to MaxEjection seconds. At
+	// most MaxEjectionPercent of the pool is ejected at a time
+	// and never its last available upstream
+	OutlierDetectionConfig struct {
+		ConsecutiveFailures int   `json:"consecutive_failures"`
+		LatencyThreshold    int64 `json:"latency_threshold_ms"`
+		BaseEjection        int64 `json:"base_ejection"`
+		MaxEjection         int64 `json:"max_ejection"`
+		MaxEjectionPercent  int   `json:"max_ejection_percent"`
+		FailureStatuses     []int `json:"failure_statuses"`
+	}
+
+	UpstreamHealth struct {
+		upstream *Upstream
+		pool     *UpstreamPool
+		cfg      *OutlierDetectionConfig
+
+		Healthy bool
+
+		checkPasses   int
+		checkFailures int
+		LastCheck     time.Time
+		LastError     string
+
+		consecutiveFailures int
+		latency             time.Duration
+
+		Ejections    int
+		LastEjection time.Time
+		EjectedUntil time.Time
+
+		lock *sync.Mutex
+	}
+
+	UpstreamHealthStatus struct {
+		Name      string `json:"name"`
+		URL       string `json:"url"`
+		Healthy   bool   `json:"healthy"`
+		Ejected   bool   `json:"ejected"`
+		Available bool   `json:"available"`
+
+		ConsecutiveFailures int     `json:"consecutive_failures"`
+		LatencyMs           float64 `json:"latency_ms"`
+		Outstanding         int64   `json:"outstanding"`
+
+		Ejections    int        `json:"ejections"`
+		EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+		LastCheck    *time.Time `json:"last_check,omitempty"`
+		LastError    string     `json:"last_error,omitempty"`
+	}
+)
+
+func NewUpstreamHealth(upstream *Upstream, cfg *OutlierDetectionConfig) (health *UpstreamHealth) {
+
+	health = &UpstreamHealth{
+		upstream: upstream,
+		cfg:      cfg,
+
+		Healthy: true,
+
+		lock: &sync.Mutex{},
+	}
+
+	return
+}
+
+func (health *UpstreamHealth) IsAvailable() (isAvailable bool) {
+
+	health.lock.Lock()
+	defer health.lock.Unlock()
+
+	isAvailable = health.Healthy && !time.Now().Before(health.EjectedUntil)
+
+	return
+}
+
+func (health *UpstreamHealth) IsEjected() (isEjected bool) {
+
+	health.lock.Lock()
+	defer health.lock.Unlock()
+
+	isEjected = time.Now().Before(health.EjectedUntil)
+
+	return
+}
+
+// IsFailureStatus tells if a response with the given
+// status counts as a failure of the upstream
+func (health *UpstreamHealth) IsFailureStatus(statusCode int) (isFailure bool) {
+
+	for _, failureStatus := range health.cfg.FailureStatuses {
+		if statusCode == failureStatus {
+			isFailure = true
+			return
+		}
+	}
+
+	return
+}
+
+// RecordResult feeds the outcome of a proxied request into
+// the passive outlier detection
+func (health *UpstreamHealth) RecordResult(latency time.Duration, isFailure bool) {
+
+	var (
+		reason string
+	)
+
+	health.lock.Lock()
+
+	if health.latency == 0 {
+		health.latency = latency
+	} else {
+		health.latency = time.Duration(DefaultOutlierLatencyEWMAAlpha*float64(latency) +
+			(1-DefaultOutlierLatencyEWMAAlpha)*float64(health.latency))
+	}
+
+	if isFailure {
+		health.consecutiveFailures++
+	} else {
+		health.consecutiveFailures = 0
+	}
+
+	if health.cfg.ConsecutiveFailures > 0 &&
+		health.consecutiveFailures >= health.cfg.ConsecutiveFailures {
+
+		reason = "consecutive_failures"
+
+	} else if health.cfg.LatencyThreshold > 0 &&
+		health.latency > time.Duration(health.cfg.LatencyThreshold)*time.Millisecond {
+
+		reason = "latency"
+	}
+
+	health.lock.Unlock()
+
+	if reason == "" {
+		return
+	}
+
+	// The lock is released first as the pool looks at the
+	// other upstreams, ejections being decided one at a time
+	if health.pool != nil {
+
+		health.pool.ejectLock.Lock()
+		defer health.pool.ejectLock.Unlock()
+
+		if !health.pool.mayEject(health.upstream) {
+			return
+		}
+	}
+
+	health.lock.Lock()
+	defer health.lock.Unlock()
+
+	health.eject(reason)
+
+	return
+}
+
+// eject stops routing to the upstream for a backoff period.
+// Has to be called with the lock held
+func (health *UpstreamHealth) eject(reason string) {
+
+	var (
+		now      time.Time
+		duration time.Duration
+		maxDur   time.Duration
+	)
+
+	now = time.Now()
+
+	if now.Before(health.EjectedUntil) {
+		return
+	}
+
+	maxDur = time.Duration(health.cfg.MaxEjection) * time.Second
+
+	// Ejections are forgotten once the upstream has
+	// behaved for the longest ejection period
+	if now.Sub(health.LastEjection) > maxDur {
+		health.Ejections = 0
+	}
+
+	duration = time.Duration(health.cfg.BaseEjection) * time.Second
+	duration = time.Duration(math.Min(float64(duration)*math.Pow(2, float64(health.Ejections)), float64(maxDur)))
+
+	health.Ejections++
+	health.LastEjection = now
+	health.EjectedUntil = now.Add(duration)
+
+	// The upstream starts over once it is back
+	health.consecutiveFailures = 0
+	health.latency = 0
+
+	health.upstream.stats.Upstream.Ejections.WithLabelValues(health.upstream.Name).Inc()
+
+	health.upstream.logger.WithFields(logrus.Fields{
+		"upstream":   health.upstream.Name,
+		"reason":     reason,
+		"duration":   duration.String(),
+		"event_type": "upstream_ejected",
+	}).Warn("Upstream ejected")
+
+	return
+}
+
+func (health *UpstreamHealth) recordCheck(checkErr error, cfg *HealthCheckConfig) {
+
+	var (
+		wasHealthy bool
+	)
+
+	health.lock.Lock()
+	defer health.lock.Unlock()
+
+	wasHealthy = health.Healthy
+	health.LastCheck = time.Now()
+
+	if checkErr == nil {
+
+		health.LastError = ""
+		health.checkFailures = 0
+
+		if health.checkPasses++; health.checkPasses >= cfg.HealthyThreshold {
+			health.Healthy = true
+		}
+
+	} else {
+
+		health.LastError = checkErr.Error()
+		health.checkPasses = 0
+
+		if health.checkFailures++; health.checkFailures >= cfg.UnhealthyThreshold {
+			health.Healthy = false
+		}
+	}
+
+	if health.Healthy {
+		health.upstream.stats.Upstream.Healthy.WithLabelValues(health.upstream.Name).Set(1)
+	} else {
+		health.upstream.stats.Upstream.Healthy.WithLabelValues(health.upstream.Name).Set(0)
+	}
+
+	if wasHealthy != health.Healthy {
+		health.upstream.logger.WithFields(logrus.Fields{
+			"upstream":   health.upstream.Name,
+			"healthy":    health.Healthy,
+			"error":      health.LastError,
+			"event_type": "upstream_health_changed",
+		}).Warn("Upstream health changed")
+	}
+
+	return
+}
+
+func (health *UpstreamHealth) Status() (status *UpstreamHealthStatus) {
+
+	var (
+		now time.Time
+	)
+
+	health.lock.Lock()
+	defer health.lock.Unlock()
+
+	now = time.Now()
+
+	status = &UpstreamHealthStatus{
+		Name:    health.upstream.Name,
+		URL:     health.upstream.URL.String(),
+		Healthy: health.Healthy,
+		Ejected: now.Before(health.EjectedUntil),
+
+		ConsecutiveFailures: health.consecutiveFailures,
+		LatencyMs:           float64(health.latency) / float64(time.Millisecond),
+		Outstanding:         health.upstream.Outstanding(),
+
+		Ejections: health.Ejections,
+		LastError: health.LastError,
+	}
+
+	status.Available = status.Healthy && !status.Ejected
+
+	if status.Ejected {
+		ejectedUntil := health.EjectedUntil
+		status.EjectedUntil = &ejectedUntil
+	}
+
+	if !health.LastCheck.IsZero() {
+		lastCheck := health.LastCheck
+		status.LastCheck = &lastCheck
+	}
+
+	return
+}
+
+// runHealthChecks requests the health check path of the
+// upstream every interval until the upstream is stopped
+func (upstream *Upstream) runHealthChecks(cfg *HealthCheckConfig) {
+
+	var (
+		ticker *time.Ticker
+	)
+
+	ticker = time.NewTicker(time.Duration(cfg.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		upstream.Health.recordCheck(upstream.checkHealth(cfg), cfg)
+
+		select {
+		case <-upstream.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (upstream *Upstream) checkHealth(cfg *HealthCheckConfig) (err error) {
+
+	var (
+		ctx      context.Context
+		cancel   context.CancelFunc
+		checkURL *url.URL
+		req      *http.Request
+		resp     *http.Response
+	)
+
+	if checkURL, err = url.Parse(cfg.Path); err != nil {
+		return
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Duration(cfg.Timeout)*time.Second)
+	defer cancel()
+
+	if req, err = http.NewRequestWithContext(ctx, http.MethodGet,
+		upstream.RequestURL(checkURL).String(), nil); err != nil {
+
+		return
+	}
+
+	if resp, err = upstream.Client.Do(req); err != nil {
+		return
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		err = UpstreamStatusError{StatusCode: resp.StatusCode}
+		return
+	}
+
+	return
+}
+
+func (pool *UpstreamPool) healthHandler(w http.ResponseWriter, req *http.Request) {
+
+	var (
+		statuses []*UpstreamHealthStatus
+		respBody []byte
+		err      error
+	)
+
+	statuses = []*UpstreamHealthStatus{}
+
+	for _, upstream := range pool.Upstreams() {
+		statuses = append(statuses, upstream.Health.Status())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if respBody, err = json.Marshal(statuses); err != nil {
+
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(CommonErrMsg)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBody)
+
+	return
+}
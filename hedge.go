@@ -0,0 +1,330 @@
+package httpcache
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultHedgePercentile  = 0.95
+	DefaultHedgeMinDelay    = 10
+	DefaultHedgeBudgetRatio = 0.05
+
+	HedgeLatencySamples = 200
+	HedgeMinSamples     = 20
+)
+
+var (
+	ReadOnlyMethods = map[string]bool{
+		http.MethodGet:     true,
+		http.MethodHead:    true,
+		http.MethodOptions: true,
+	}
+)
+
+type (
+	// HedgingConfig drives the hedged requests of the routes
+	// marked hedge. A request still waiting for its response
+	// after the Percentile latency of its route, and at least
+	// MinDelay milliseconds, is sent to another upstream as
+	// well and the first response wins. Hedged requests are
+	// limited to BudgetRatio of the requests
+	HedgingConfig struct {
+		Percentile  float64 `json:"percentile"`
+		MinDelay    int64   `json:"min_delay_ms"`
+		BudgetRatio float64 `json:"budget_ratio"`
+	}
+
+	// LatencyWindow keeps the latest
+	// response times of a route
+	LatencyWindow struct {
+		samples []time.Duration
+		next    int
+
+		lock *sync.Mutex
+	}
+
+	hedgeAttempt struct {
+		upstream *Upstream
+		isHedge  bool
+		cancel   context.CancelFunc
+
+		resp *http.Response
+		err  error
+	}
+)
+
+func NewLatencyWindow(size int) (window *LatencyWindow) {
+
+	window = &LatencyWindow{
+		samples: make([]time.Duration, 0, size),
+
+		lock: &sync.Mutex{},
+	}
+
+	return
+}
+
+func (window *LatencyWindow) Record(latency time.Duration) {
+
+	window.lock.Lock()
+	defer window.lock.Unlock()
+
+	if len(window.samples) < cap(window.samples) {
+		window.samples = append(window.samples, latency)
+		return
+	}
+
+	window.samples[window.next] = latency
+	window.next = (window.next + 1) % len(window.samples)
+
+	return
+}
+
+// Percentile is the latency under which the given share of
+// the samples fall, unknown until HedgeMinSamples are in
+func (window *LatencyWindow) Percentile(percentile float64) (latency time.Duration, isKnown bool) {
+
+	var (
+		sorted []time.Duration
+	)
+
+	window.lock.Lock()
+
+	if len(window.samples) < HedgeMinSamples {
+		window.lock.Unlock()
+		return
+	}
+
+	sorted = append(sorted, window.samples...)
+	window.lock.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	latency = sorted[int(math.Ceil(percentile*float64(len(sorted))))-1]
+	isKnown = true
+
+	return
+}
+
+// isHedgeable tells if the request may be sent to a
+// second upstream while the first one is slow
+func (proxyCtxt *ProxyCtxt) isHedgeable(job *proxyJob) (isHedgeable bool) {
+
+	var (
+		req = job.req
+	)
+
+	if !job.cacheReq.Policy.Hedge {
+		return
+	}
+
+	if !ReadOnlyMethods[req.Method] && !job.cacheReq.Policy.RetrySafe {
+		return
+	}
+
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return
+	}
+
+	isHedgeable = true
+
+	return
+}
+
+func (proxyCtxt *ProxyCtxt) getHedgeDelay(policy *RoutePolicy) (delay time.Duration, isKnown bool) {
+
+	var (
+		cfg = &proxyCtxt.httpCacheCtxt.Config.Hedging
+	)
+
+	if delay, isKnown = policy.Latencies.Percentile(cfg.Percentile); !isKnown {
+		return
+	}
+
+	if minDelay := time.Duration(cfg.MinDelay) * time.Millisecond; delay < minDelay {
+		delay = minDelay
+	}
+
+	return
+}
+
+// hedgeRequest sends the request to the upstream and, when it
+// hasn't answered within the hedge delay of the route, to
+// another upstream too. The first response wins and the other
+// request is cancelled. An error or a 5xx only wins when both
+// failed
+func (proxyWorker *ProxyWorker) hedgeRequest(ctx context.Context, job *proxyJob, header http.Header,
+	upstream *Upstream, timeouts *TimeoutConfig) (resp *http.Response, err error) {
+
+	var (
+		proxyCtxt     = proxyWorker.proxyCtxt
+		delay         time.Duration
+		isKnown       bool
+		timer         *time.Timer
+		timerCh       <-chan time.Time
+		resultCh      chan *hedgeAttempt
+		attempts      []*hedgeAttempt
+		winner        *hedgeAttempt
+		fallback      *hedgeAttempt
+		hedgeUpstream *Upstream
+		pending       int
+	)
+
+	resultCh = make(chan *hedgeAttempt, 2)
+
+	attempts = append(attempts, proxyWorker.startAttempt(ctx, job, header, upstream, timeouts, false, resultCh))
+	pending = 1
+
+	if delay, isKnown = proxyCtxt.getHedgeDelay(job.cacheReq.Policy); isKnown {
+		timer = time.NewTimer(delay)
+		timerCh = timer.C
+
+		defer timer.Stop()
+	}
+
+	for winner == nil {
+
+		select {
+
+		case <-timerCh:
+
+			if hedgeUpstream = proxyCtxt.pickHedgeUpstream(job, upstream); hedgeUpstream == nil {
+				continue
+			}
+
+			attempts = append(attempts, proxyWorker.startAttempt(ctx, job, header, hedgeUpstream,
+				timeouts, true, resultCh))
+			pending++
+
+			proxyCtxt.httpCacheCtxt.Stats.Counter.Hedges.Inc()
+
+			proxyCtxt.httpCacheCtxt.logger.WithFields(logrus.Fields{
+				"upstream":   hedgeUpstream.Name,
+				"route":      job.cacheReq.Policy.Name,
+				"delay_ms":   delay.Milliseconds(),
+				"event_type": "upstream_hedge",
+			}).Info("Hedging upstream request")
+
+		case attempt := <-resultCh:
+
+			if pending--; attempt.err == nil && attempt.resp.StatusCode < http.StatusInternalServerError {
+				winner = attempt
+				continue
+			}
+
+			// A failure only wins once the other attempt failed
+			// too, a response being kept over an error
+			if fallback == nil || (fallback.err != nil && attempt.err == nil) {
+				fallback, attempt = attempt, fallback
+			}
+
+			if attempt != nil && attempt.resp != nil {
+				attempt.resp.Body.Close()
+			}
+
+			if pending == 0 {
+				winner = fallback
+			}
+		}
+	}
+
+	if fallback != nil && fallback != winner && fallback.resp != nil {
+		fallback.resp.Body.Close()
+	}
+
+	for _, attempt := range attempts {
+		if attempt != winner {
+			attempt.cancel()
+		}
+	}
+
+	// The responses of the cancelled requests
+	// which made it anyway are thrown away
+	if pending > 0 {
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				if attempt := <-resultCh; attempt.resp != nil {
+					attempt.resp.Body.Close()
+				}
+			}
+		}(pending)
+	}
+
+	if resp, err = winner.resp, winner.err; err != nil {
+		winner.cancel()
+		return
+	}
+
+	if winner.isHedge {
+		proxyCtxt.httpCacheCtxt.Stats.Counter.HedgeWins.Inc()
+	}
+
+	resp.Body = &upstreamBody{
+		ReadCloser: resp.Body,
+
+		closeOnce: &sync.Once{},
+		onClose:   winner.cancel,
+	}
+
+	return
+}
+
+// startAttempt sends the request in the background, its
+// latency feeding the hedge delay of the route
+func (proxyWorker *ProxyWorker) startAttempt(ctx context.Context, job *proxyJob, header http.Header,
+	upstream *Upstream, timeouts *TimeoutConfig, isHedge bool, resultCh chan *hedgeAttempt) (attempt *hedgeAttempt) {
+
+	attempt = &hedgeAttempt{
+		upstream: upstream,
+		isHedge:  isHedge,
+	}
+
+	ctx, attempt.cancel = context.WithCancel(ctx)
+
+	go func() {
+
+		var (
+			startTime = time.Now()
+		)
+
+		if attempt.resp, attempt.err = proxyWorker.proxyRequest(ctx, job.req, header,
+			upstream, timeouts); attempt.err == nil {
+
+			job.cacheReq.Policy.Latencies.Record(time.Since(startTime))
+		}
+
+		resultCh <- attempt
+	}()
+
+	return
+}
+
+// pickHedgeUpstream is another upstream for the request,
+// nil when there is none or the hedge budget is spent
+func (proxyCtxt *ProxyCtxt) pickHedgeUpstream(job *proxyJob, upstream *Upstream) (hedgeUpstream *Upstream) {
+
+	var (
+		err error
+	)
+
+	if hedgeUpstream, err = proxyCtxt.Pool.PickExcept(job.cacheReq.ReqKey, upstream); err != nil {
+		hedgeUpstream = nil
+		return
+	}
+
+	if !proxyCtxt.HedgeBudget.Withdraw() {
+		hedgeUpstream.Breaker.Cancel()
+		hedgeUpstream = nil
+
+		proxyCtxt.httpCacheCtxt.Stats.Counter.HedgesExhausted.Inc()
+	}
+
+	return
+}
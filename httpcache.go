@@ -1,14 +1,20 @@
 package httpcache
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -52,13 +58,94 @@ type (
 
 		Proxy struct {
 			NoOfWorkers int `json:"no_of_workers"`
+
+			// Requests wait for a worker in a queue of QueueSize
+			// requests, of which a tenant may hold TenantQueueSize
+			QueueSize       int `json:"queue_size"`
+			TenantQueueSize int `json:"tenant_queue_size"`
+
+			// Request bodies up to BodyMemoryBytes are buffered
+			// in memory and larger ones in BodyTempDir. Bodies
+			// over BodyMaxBytes are rejected
+			BodyMemoryBytes int64  `json:"body_memory_bytes"`
+			BodyMaxBytes    int64  `json:"body_max_bytes"`
+			BodyTempDir     string `json:"body_temp_dir"`
+
+			// Response bodies over MaxCacheableBytes are streamed
+			// to the client without being cached, routes may set
+			// their own max_body_bytes instead
+			MaxCacheableBytes int64 `json:"max_cacheable_bytes"`
+
+			// At most MaxTunnels upgraded connections, such
+			// as WebSockets, are relayed at a time
+			MaxTunnels int64 `json:"max_tunnels"`
 		} `json:"proxy"`
 
+		Upstreams []UpstreamConfig `json:"upstreams"`
+		Discovery *DiscoveryConfig `json:"discovery"`
+		Mirror    MirrorConfig     `json:"mirror"`
+
+		LoadBalancer struct {
+			Strategy     string `json:"strategy"`
+			HashReplicas int    `json:"hash_replicas"`
+		} `json:"load_balancer"`
+
+		HealthCheck      HealthCheckConfig      `json:"health_check"`
+		OutlierDetection OutlierDetectionConfig `json:"outlier_detection"`
+		CircuitBreaker   CircuitBreakerConfig   `json:"circuit_breaker"`
+		Retry            RetryConfig            `json:"retry"`
+		Hedging          HedgingConfig          `json:"hedging"`
+		Timeouts         TimeoutConfig          `json:"timeouts"`
+
+		ConcurrencyLimit ConcurrencyLimitConfig `json:"concurrency_limit"`
+		Priority         PriorityConfig         `json:"priority"`
+
 		Logger struct {
 			LogFile string `json:"log_file"`
 		} `json:"logger"`
 
+		Tenants struct {
+			Header            string           `json:"header"`
+			KeySeparator      string           `json:"key_separator"`
+			Default           string           `json:"default"`
+			DefaultQuotaBytes int64            `json:"default_quota_bytes"`
+			Quotas            map[string]int64 `json:"quotas"`
+
+			// Tenants past MaxTenants which have no quota
+			// configured fall back to the default tenant
+			MaxTenants int `json:"max_tenants"`
+		} `json:"tenants"`
+
 		SkipCacheApis []string `json:"skip_cache_apis"`
+
+		RequestHeaders HeaderPolicyConfig `json:"request_headers"`
+		Forwarding     ForwardingConfig   `json:"forwarding"`
+
+		// ResponseHeaders lists the upstream headers relayed
+		// to the client, all of them when empty
+		ResponseHeaders []string `json:"response_headers"`
+
+		Routes []RouteConfig `json:"routes"`
+	}
+
+	// CacheReq is what the request resolves to, it is
+	// built once per request
+	CacheReq struct {
+		Policy *RoutePolicy
+		Route  *Route
+		Vars   map[string]string
+
+		TenantName string
+		ReqKey     ReqKeyT
+		ApiName    string
+		Priority   string
+
+		// Encoding is the normalized Accept-Encoding of the
+		// request, responses are cached per encoding as the
+		// upstream may compress them
+		Encoding string
+
+		IsCacheable bool
 	}
 
 	HttpCacheCtxt struct {
@@ -74,18 +161,25 @@ type (
 		Server           *http.Server
 		MonitoringServer *http.Server
 
-		SkipCacheMap       map[string]bool
+		SkipRoutes *RouteMatcher
+		Routes     *RouteMatcher
+
+		DefaultPolicy *RoutePolicy
+		SkipPolicy    *RoutePolicy
+		LocalPolicy   *RoutePolicy
+
+		revalidating *sync.Map
+
 		LocalCacheBuildMap map[string]FuncHandler
+		ResponseValidators map[string]ResponseValidator
 		Middlewares        []func(http.Handler) http.Handler
 	}
 )
 
 var (
 	CommonErrMsg = []byte("{\"status\":\"failure\"}")
+	SuccessMsg   = []byte("{\"status\":\"success\"}")
 	AuthErrorMsg = []byte("{\"status\":\"unauthorized\"}")
-
-	ApiLevels = []string{"/", "/api/v1/",
-		"/api/v2/", "/api/v3/", "/api/v4/"}
 )
 
 func NewHttpCacheConfig() (cfg *Config, err error) {
@@ -120,6 +214,180 @@ func NewHttpCacheConfig() (cfg *Config, err error) {
 		cfg.Logger.LogFile = DefaultLogFile
 	}
 
+	if cfg.Proxy.QueueSize <= 0 {
+		cfg.Proxy.QueueSize = DefaultQueueSize
+	}
+
+	// Without tenants every request belongs to the default
+	// one, which then gets the whole queue
+	if cfg.Proxy.TenantQueueSize <= 0 {
+		if cfg.Tenants.Header != "" || cfg.Tenants.KeySeparator != "" {
+			cfg.Proxy.TenantQueueSize = cfg.Proxy.QueueSize / DefaultTenantQueueShare
+		} else {
+			cfg.Proxy.TenantQueueSize = cfg.Proxy.QueueSize
+		}
+	}
+
+	if cfg.Proxy.TenantQueueSize <= 0 || cfg.Proxy.TenantQueueSize > cfg.Proxy.QueueSize {
+		cfg.Proxy.TenantQueueSize = cfg.Proxy.QueueSize
+	}
+
+	if cfg.Priority.StarvationLimit <= 0 {
+		cfg.Priority.StarvationLimit = DefaultStarvationLimit
+	}
+
+	if cfg.Proxy.MaxCacheableBytes == 0 {
+		cfg.Proxy.MaxCacheableBytes = DefaultMaxCacheableBytes
+	}
+
+	if cfg.Proxy.MaxTunnels <= 0 {
+		cfg.Proxy.MaxTunnels = DefaultMaxTunnels
+	}
+
+	if cfg.Proxy.BodyMaxBytes == 0 {
+		cfg.Proxy.BodyMaxBytes = DefaultBodyMaxBytes
+	}
+
+	if cfg.Proxy.BodyMemoryBytes == 0 {
+		cfg.Proxy.BodyMemoryBytes = DefaultBodyMemoryBytes
+	}
+
+	if cfg.Proxy.BodyMemoryBytes > cfg.Proxy.BodyMaxBytes {
+		cfg.Proxy.BodyMemoryBytes = cfg.Proxy.BodyMaxBytes
+	}
+
+	if cfg.HealthCheck.Interval <= 0 {
+		cfg.HealthCheck.Interval = DefaultHealthCheckInterval
+	}
+
+	if cfg.HealthCheck.Timeout <= 0 {
+		cfg.HealthCheck.Timeout = DefaultHealthCheckTimeout
+	}
+
+	if cfg.HealthCheck.HealthyThreshold <= 0 {
+		cfg.HealthCheck.HealthyThreshold = DefaultHealthyThreshold
+	}
+
+	if cfg.HealthCheck.UnhealthyThreshold <= 0 {
+		cfg.HealthCheck.UnhealthyThreshold = DefaultUnhealthyThreshold
+	}
+
+	if cfg.OutlierDetection.ConsecutiveFailures == 0 {
+		cfg.OutlierDetection.ConsecutiveFailures = DefaultOutlierFailures
+	}
+
+	if cfg.OutlierDetection.BaseEjection <= 0 {
+		cfg.OutlierDetection.BaseEjection = DefaultOutlierBaseEjection
+	}
+
+	if cfg.OutlierDetection.MaxEjection <= 0 {
+		cfg.OutlierDetection.MaxEjection = DefaultOutlierMaxEjection
+	}
+
+	if cfg.OutlierDetection.MaxEjectionPercent <= 0 || cfg.OutlierDetection.MaxEjectionPercent > 100 {
+		cfg.OutlierDetection.MaxEjectionPercent = DefaultOutlierMaxPercent
+	}
+
+	if cfg.OutlierDetection.FailureStatuses == nil {
+		cfg.OutlierDetection.FailureStatuses = DefaultOutlierFailureStatuses
+	}
+
+	if cfg.CircuitBreaker.OpenDuration <= 0 {
+		cfg.CircuitBreaker.OpenDuration = DefaultCircuitOpenDuration
+	}
+
+	if cfg.CircuitBreaker.HalfOpenRequests <= 0 {
+		cfg.CircuitBreaker.HalfOpenRequests = DefaultCircuitHalfOpenRequests
+	}
+
+	if cfg.CircuitBreaker.SuccessThreshold <= 0 {
+		cfg.CircuitBreaker.SuccessThreshold = DefaultCircuitSuccessThreshold
+	}
+
+	if cfg.Timeouts.Connect <= 0 {
+		cfg.Timeouts.Connect = DefaultConnectTimeout
+	}
+
+	if cfg.Timeouts.Total <= 0 {
+		cfg.Timeouts.Total = DefaultTotalTimeout
+	}
+
+	if cfg.ConcurrencyLimit.InitialLimit <= 0 {
+		cfg.ConcurrencyLimit.InitialLimit = DefaultInitialLimit
+	}
+
+	if cfg.ConcurrencyLimit.MinLimit <= 0 {
+		cfg.ConcurrencyLimit.MinLimit = DefaultMinLimit
+	}
+
+	if cfg.ConcurrencyLimit.MaxLimit <= 0 {
+		cfg.ConcurrencyLimit.MaxLimit = DefaultMaxLimit
+	}
+
+	if cfg.ConcurrencyLimit.Backoff <= 0 || cfg.ConcurrencyLimit.Backoff >= 1 {
+		cfg.ConcurrencyLimit.Backoff = DefaultLimitBackoff
+	}
+
+	if cfg.ConcurrencyLimit.Latency <= 0 {
+		cfg.ConcurrencyLimit.Latency = DefaultLimitLatency
+	}
+
+	if cfg.ConcurrencyLimit.RetryAfter <= 0 {
+		cfg.ConcurrencyLimit.RetryAfter = DefaultLimitRetryAfter
+	}
+
+	if cfg.Mirror.TimeoutMs <= 0 {
+		cfg.Mirror.TimeoutMs = DefaultMirrorTimeout
+	}
+
+	if cfg.Mirror.MaxInFlight <= 0 {
+		cfg.Mirror.MaxInFlight = DefaultMirrorMaxInFlight
+	}
+
+	if cfg.Mirror.MaxDiffBytes <= 0 {
+		cfg.Mirror.MaxDiffBytes = DefaultMirrorDiffBytes
+	}
+
+	if cfg.Hedging.Percentile <= 0 || cfg.Hedging.Percentile > 1 {
+		cfg.Hedging.Percentile = DefaultHedgePercentile
+	}
+
+	if cfg.Hedging.MinDelay <= 0 {
+		cfg.Hedging.MinDelay = DefaultHedgeMinDelay
+	}
+
+	if cfg.Hedging.BudgetRatio == 0 {
+		cfg.Hedging.BudgetRatio = DefaultHedgeBudgetRatio
+	}
+
+	if cfg.Retry.BaseBackoff <= 0 {
+		cfg.Retry.BaseBackoff = DefaultRetryBaseBackoff
+	}
+
+	if cfg.Retry.MaxBackoff <= 0 {
+		cfg.Retry.MaxBackoff = DefaultRetryMaxBackoff
+	}
+
+	if cfg.Retry.BudgetRatio == 0 {
+		cfg.Retry.BudgetRatio = DefaultRetryBudgetRatio
+	}
+
+	if cfg.Retry.MinPerSecond == 0 {
+		cfg.Retry.MinPerSecond = DefaultRetryMinPerSecond
+	}
+
+	if cfg.Retry.RetryStatuses == nil {
+		cfg.Retry.RetryStatuses = DefaultRetryStatuses
+	}
+
+	if cfg.Tenants.Default == "" {
+		cfg.Tenants.Default = DefaultTenantName
+	}
+
+	if cfg.Tenants.MaxTenants <= 0 {
+		cfg.Tenants.MaxTenants = DefaultMaxTenants
+	}
+
 	log.Println(cfg)
 
 	return
@@ -129,8 +397,10 @@ func NewHttpCacheCtxt() (httpCacheCtxt *HttpCacheCtxt, err error) {
 
 	httpCacheCtxt = &HttpCacheCtxt{
 
-		SkipCacheMap:       make(map[string]bool),
 		LocalCacheBuildMap: make(map[string]FuncHandler),
+		ResponseValidators: make(map[string]ResponseValidator),
+
+		revalidating: &sync.Map{},
 	}
 
 	if httpCacheCtxt.Config, err = NewHttpCacheConfig(); err != nil {
@@ -141,15 +411,15 @@ func NewHttpCacheCtxt() (httpCacheCtxt *HttpCacheCtxt, err error) {
 		return
 	}
 
-	if httpCacheCtxt.ProxyCtxt, err = NewProxyCtxt(httpCacheCtxt); err != nil {
+	if httpCacheCtxt.Stats, err = NewStats(); err != nil {
 		return
 	}
 
-	if httpCacheCtxt.Stats, err = NewStats(); err != nil {
+	if httpCacheCtxt.ProxyCtxt, err = NewProxyCtxt(httpCacheCtxt); err != nil {
 		return
 	}
 
-	if httpCacheCtxt.MonitoringServer, err = NewMonitorServer(); err != nil {
+	if httpCacheCtxt.MonitoringServer, err = NewMonitorServer(httpCacheCtxt); err != nil {
 		return
 	}
 
@@ -161,7 +431,11 @@ func NewHttpCacheCtxt() (httpCacheCtxt *HttpCacheCtxt, err error) {
 		return
 	}
 
-	if err = httpCacheCtxt.prepareSkipCacheMap(); err != nil {
+	if err = httpCacheCtxt.prepareSkipRoutes(); err != nil {
+		return
+	}
+
+	if err = httpCacheCtxt.prepareRoutes(); err != nil {
 		return
 	}
 
@@ -187,15 +461,10 @@ func NewLogger(httpCacheCtxt *HttpCacheCtxt) (logger *logrus.Logger, err error)
 	return
 }
 
-func (httpCacheCtxt *HttpCacheCtxt) prepareSkipCacheMap() (err error) {
-
-	for _, apiLevel := range ApiLevels {
-
-		for _, api := range httpCacheCtxt.Config.SkipCacheApis {
-			httpCacheCtxt.SkipCacheMap[fmt.Sprintf("%s%s",
-				apiLevel, api)] = true
-		}
+func (httpCacheCtxt *HttpCacheCtxt) prepareSkipRoutes() (err error) {
 
+	if httpCacheCtxt.SkipRoutes, err = NewRouteMatcher(httpCacheCtxt.Config.SkipCacheApis); err != nil {
+		return
 	}
 
 	return
@@ -210,6 +479,16 @@ func (httpCacheCtxt *HttpCacheCtxt) RegisterLocalCacheHandler(api string,
 	return
 }
 
+// RegisterResponseValidator makes the validator available
+// to the validators of the routes under the given name
+func (httpCacheCtxt *HttpCacheCtxt) RegisterResponseValidator(name string,
+	validator ResponseValidator) (err error) {
+
+	httpCacheCtxt.ResponseValidators[name] = validator
+
+	return
+}
+
 func (httpCacheCtxt *HttpCacheCtxt) RegisterMiddleware(middleware func(http.Handler) http.Handler) (err error) {
 
 	httpCacheCtxt.Middlewares = append(httpCacheCtxt.Middlewares, middleware)
@@ -217,94 +496,216 @@ func (httpCacheCtxt *HttpCacheCtxt) RegisterMiddleware(middleware func(http.Hand
 	return
 }
 
-func (httpCacheCtxt *HttpCacheCtxt) processRequest(w http.ResponseWriter,
-	req *http.Request) (respBody []byte, err error) {
-
-	var (
-		isPresent    bool
-		isCacheValid bool
-		handler      FuncHandler
-		resp         *http.Response
+func (httpCacheCtxt *HttpCacheCtxt) newCacheReq(req *http.Request) (cacheReq *CacheReq, err error) {
 
-		reqKey  ReqKeyT
-		apiName string
-	)
+	cacheReq = &CacheReq{
+		ApiName: req.URL.Path,
+	}
 
-	reqKey = ReqKeyT(req.FormValue("uuid"))
+	cacheReq.Policy, cacheReq.Route, cacheReq.Vars = httpCacheCtxt.resolvePolicy(req)
+	cacheReq.IsCacheable = cacheReq.Policy.IsCacheable(req)
+	cacheReq.ReqKey = cacheReq.Policy.Key(req, cacheReq.Vars)
 
-	if reqKey == "" {
+	if cacheReq.ReqKey == "" && cacheReq.IsCacheable {
 		err = errors.New("No CP found in the request body")
 		return
 	}
 
-	apiName = req.URL.Path
+	cacheReq.TenantName = httpCacheCtxt.getTenantName(req, cacheReq.ReqKey)
+	cacheReq.Priority = httpCacheCtxt.getPriority(req, cacheReq.Policy)
+	cacheReq.Encoding = getAcceptedEncodings(req)
 
-	httpCacheCtxt.logger.WithFields(logrus.Fields{
-		"req_key":    reqKey,
-		"api_name":   apiName,
-		"event_type": "cache_requests",
-	}).Info("Cache Request received")
+	return
+}
 
-	// Check if the request is part of the SkipCacheMap
-	_, isPresent = httpCacheCtxt.SkipCacheMap[apiName]
+// EntryName is the name of the cache entry of the request
+// within its key, the api name and the accepted encodings
+func (cacheReq *CacheReq) EntryName() (entryName string) {
 
-	// Check if the cache is valid
-	if isPresent != true {
+	if entryName = cacheReq.ApiName; cacheReq.Encoding != "" {
+		entryName += "\x00" + cacheReq.Encoding
+	}
 
-		isCacheValid = httpCacheCtxt.Cache.IsValid(reqKey, apiName)
+	return
+}
 
-	} else {
+func (httpCacheCtxt *HttpCacheCtxt) processRequest(w http.ResponseWriter,
+	req *http.Request) (resp *Response, err error) {
 
-		httpCacheCtxt.logger.WithFields(logrus.Fields{
-			"req_key":    reqKey,
-			"api_name":   apiName,
-			"event_type": "cache_skipped",
-		}).Info("Cache Request Skipped")
+	var (
+		isPresent bool
+		handler   FuncHandler
+		respBody  []byte
+		cacheReq  *CacheReq
+		cacheApi  *CacheApi
+		policy    *RoutePolicy
+	)
 
-		httpCacheCtxt.Stats.Counter.Skipped.Inc()
-		isCacheValid = false
+	if cacheReq, err = httpCacheCtxt.newCacheReq(req); err != nil {
+		return
+	}
+
+	policy = cacheReq.Policy
+
+	httpCacheCtxt.logger.WithFields(logrus.Fields{
+		"tenant":     cacheReq.TenantName,
+		"req_key":    cacheReq.ReqKey,
+		"api_name":   cacheReq.ApiName,
+		"route":      policy.Name,
+		"event_type": "cache_requests",
+	}).Info("Cache Request received")
+
+	if cacheReq.IsCacheable {
+		cacheApi, _ = httpCacheCtxt.Cache.Lookup(cacheReq.TenantName, cacheReq.ReqKey, cacheReq.EntryName())
 	}
 
-	if isCacheValid {
+	switch httpCacheCtxt.getOutcome(cacheReq, cacheApi) {
+
+	case OutcomeHit:
 
 		httpCacheCtxt.logger.WithFields(logrus.Fields{
-			"req_key":    reqKey,
-			"api_name":   apiName,
+			"req_key":    cacheReq.ReqKey,
+			"api_name":   cacheReq.ApiName,
 			"event_type": "cache_response",
 		}).Info("Cache Request Valid")
 
 		httpCacheCtxt.Stats.Counter.CachedResponse.Inc()
-		respBody, err = httpCacheCtxt.Cache.GetData(reqKey, apiName)
+		httpCacheCtxt.Stats.Tenant.Hits.WithLabelValues(cacheReq.TenantName).Inc()
+
+		resp = newCachedResponse(cacheApi)
 		return
-	}
 
-	// Check if the cache is to built by the local process
-	// instead of proxying
-	if handler, isPresent = httpCacheCtxt.LocalCacheBuildMap[apiName]; isPresent {
+	case OutcomeStale:
+
+		httpCacheCtxt.logger.WithFields(logrus.Fields{
+			"req_key":    cacheReq.ReqKey,
+			"api_name":   cacheReq.ApiName,
+			"event_type": "cache_stale_response",
+		}).Info("Cache Request Stale, revalidating")
+
+		httpCacheCtxt.Stats.Counter.StaleResponse.Inc()
+		httpCacheCtxt.Stats.Tenant.Hits.WithLabelValues(cacheReq.TenantName).Inc()
+
+		httpCacheCtxt.revalidate(req, cacheReq)
+
+		resp = newCachedResponse(cacheApi)
+		return
+
+	case OutcomeLocal:
+
+		if cacheReq.IsCacheable {
+			httpCacheCtxt.Stats.Tenant.Misses.WithLabelValues(cacheReq.TenantName).Inc()
+		}
+
+		// Check if the cache is to built by the local process
+		// instead of proxying
+		if handler, isPresent = httpCacheCtxt.LocalCacheBuildMap[policy.Name]; !isPresent {
+			if handler, isPresent = httpCacheCtxt.LocalCacheBuildMap[cacheReq.ApiName]; !isPresent {
+				err = errors.New("No local handler registered for " + cacheReq.ApiName)
+				return
+			}
+		}
 
 		httpCacheCtxt.logger.WithFields(logrus.Fields{
-			"req_key":    reqKey,
-			"api_name":   apiName,
+			"req_key":    cacheReq.ReqKey,
+			"api_name":   cacheReq.ApiName,
 			"event_type": "cache_local_handled",
 		}).Info("Cache Request Local Handling")
 
 		httpCacheCtxt.Stats.Counter.LocalHandled.Inc()
 
-		if respBody, err = handler(w, req); err == nil {
+		if respBody, err = handler(w, req); err != nil {
 			return
 		}
+
+		resp = newLocalResponse(respBody)
 		return
+
+	case OutcomeProxy:
+
+		httpCacheCtxt.logger.WithFields(logrus.Fields{
+			"req_key":    cacheReq.ReqKey,
+			"api_name":   cacheReq.ApiName,
+			"route":      policy.Name,
+			"event_type": "cache_skipped",
+		}).Info("Cache Request Skipped")
+
+		httpCacheCtxt.Stats.Counter.Skipped.Inc()
+
+	case OutcomeMiss:
+
+		httpCacheCtxt.Stats.Tenant.Misses.WithLabelValues(cacheReq.TenantName).Inc()
 	}
 
+	if resp, err = httpCacheCtxt.fetch(w, req, cacheReq); err != nil {
+
+		// Once streaming, the client has the headers of
+		// the upstream response already
+		if resp != nil && resp.Streamed {
+			return
+		}
+
+		if cacheApi != nil && httpCacheCtxt.canServeStale(cacheApi, policy, err) {
+
+			httpCacheCtxt.logger.WithFields(logrus.Fields{
+				"req_key":    cacheReq.ReqKey,
+				"api_name":   cacheReq.ApiName,
+				"error":      err.Error(),
+				"event_type": "cache_stale_response",
+			}).Info("Cache Request Failed upstream, serving stale")
+
+			httpCacheCtxt.Stats.Counter.StaleResponse.Inc()
+
+			resp, err = newCachedResponse(cacheApi), nil
+			return
+		}
+
+		return
+	}
+
+	return
+}
+
+// canServeStale tells if the entry can be served instead of
+// the error the upstream request failed with
+func (httpCacheCtxt *HttpCacheCtxt) canServeStale(cacheApi *CacheApi, policy *RoutePolicy,
+	err error) (canServe bool) {
+
+	if _, isOpen := err.(CircuitOpenError); isOpen && httpCacheCtxt.Config.CircuitBreaker.ServeStale {
+		canServe = true
+		return
+	}
+
+	canServe = cacheApi.IsUsableStale(policy.TTL, policy.StaleIfError)
+
+	return
+}
+
+// fetch proxies the request upstream, streaming the body of
+// the response to w while copying it into the cache when the
+// policy of the request allows it. Without w, as for the
+// background refresh, the body is only read for the cache
+func (httpCacheCtxt *HttpCacheCtxt) fetch(w http.ResponseWriter, req *http.Request,
+	cacheReq *CacheReq) (proxyResp *Response, err error) {
+
+	var (
+		resp       *http.Response
+		cacheBuf   *CacheBuffer
+		cachedResp Response
+		policy     *RoutePolicy
+	)
+
+	policy = cacheReq.Policy
+
 	httpCacheCtxt.logger.WithFields(logrus.Fields{
-		"req_key":    reqKey,
-		"api_name":   apiName,
+		"req_key":    cacheReq.ReqKey,
+		"api_name":   cacheReq.ApiName,
 		"event_type": "cache_proxied",
 	}).Info("Cache Request Proxied")
 
 	httpCacheCtxt.Stats.Counter.Proxied.Inc()
 
-	if resp, err = httpCacheCtxt.ProxyCtxt.Send(req); err != nil {
+	if resp, err = httpCacheCtxt.ProxyCtxt.Send(req, cacheReq); err != nil {
 		if resp != nil {
 			resp.Body.Close()
 		}
@@ -314,14 +715,29 @@ func (httpCacheCtxt *HttpCacheCtxt) processRequest(w http.ResponseWriter,
 
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return
+	// Every status is relayed to the client, only the
+	// ones allowed by the policy are cached
+	proxyResp = &Response{
+		StatusCode: resp.StatusCode,
+		Header:     httpCacheCtxt.filterResponseHeader(resp.Header),
 	}
 
-	if respBody, err = ioutil.ReadAll(resp.Body); err != nil {
-		if resp != nil {
-			resp.Body.Close()
+	if cacheReq.IsCacheable && policy.IsCacheableStatus(resp.StatusCode) {
+		cacheBuf = NewCacheBuffer(httpCacheCtxt.getMaxCacheableBytes(policy))
+	}
+
+	if w != nil {
+		proxyResp.Streamed = true
+		writeStreamHeader(w, proxyResp, resp.ContentLength)
+	}
+
+	if err = streamBody(w, resp.Body, cacheBuf); err != nil {
+
+		// The total timeout covers the reading of the body
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = UpstreamTimeoutError{Phase: TimeoutPhaseTotal}
 		}
+
 		return
 	}
 
@@ -333,15 +749,152 @@ func (httpCacheCtxt *HttpCacheCtxt) processRequest(w http.ResponseWriter,
 	// locally as well, custom logic has to be
 	// written for it
 
+	if cacheBuf == nil {
+		return
+	}
+
+	if cacheBuf.IsOverflown {
+
+		httpCacheCtxt.logger.WithFields(logrus.Fields{
+			"req_key":    cacheReq.ReqKey,
+			"api_name":   cacheReq.ApiName,
+			"max_bytes":  cacheBuf.MaxBytes,
+			"event_type": "cache_too_large",
+		}).Info("Cache Response too large, not added")
+
+		return
+	}
+
+	proxyResp.Body = cacheBuf.Bytes()
+
+	if !httpCacheCtxt.isAdmitted(req, cacheReq, proxyResp) {
+		return
+	}
+
 	httpCacheCtxt.logger.WithFields(logrus.Fields{
-		"req_key":    reqKey,
-		"api_name":   apiName,
+		"req_key":    cacheReq.ReqKey,
+		"api_name":   cacheReq.ApiName,
 		"event_type": "cache_added",
 	}).Info("Cache Response added")
 
 	httpCacheCtxt.Stats.Counter.CacheAdded.Inc()
 
-	httpCacheCtxt.Cache.Add(reqKey, apiName, respBody)
+	// Cookies set for this client are not for the others,
+	// and the date is the one of the response serving it
+	cachedResp = *proxyResp
+	cachedResp.Streamed = false
+	cachedResp.Header = proxyResp.Header.Clone()
+	cachedResp.Header.Del("Set-Cookie")
+	cachedResp.Header.Del("Date")
+
+	httpCacheCtxt.Cache.Add(cacheReq.TenantName, cacheReq.ReqKey, cacheReq.EntryName(), &cachedResp)
+
+	return
+}
+
+// revalidate refreshes a stale entry in the background. Only
+// one refresh per entry is in flight at any time
+func (httpCacheCtxt *HttpCacheCtxt) revalidate(req *http.Request, cacheReq *CacheReq) {
+
+	var (
+		entryKey     string
+		bgReq        *http.Request
+		bgCacheReq   *CacheReq
+		bufferedBody *BufferedBody
+		bodyData     []byte
+		inMemory     bool
+		loaded       bool
+	)
+
+	// The buffered body of the request is gone once the
+	// request is done, only bodies held in memory can be
+	// replayed by the background refresh
+	if bufferedBody = getBufferedBody(req); bufferedBody != nil {
+		if bodyData, inMemory = bufferedBody.Bytes(); !inMemory {
+			return
+		}
+	}
+
+	entryKey = cacheReq.TenantName + "\x00" + string(cacheReq.ReqKey) + "\x00" + cacheReq.EntryName()
+
+	if _, loaded = httpCacheCtxt.revalidating.LoadOrStore(entryKey, true); loaded {
+		return
+	}
+
+	httpCacheCtxt.Stats.Counter.Revalidations.Inc()
+
+	// The refresh waits behind the requests of clients
+	bgCacheReq = &CacheReq{}
+	*bgCacheReq = *cacheReq
+	bgCacheReq.Priority = PriorityBackground
+
+	bgReq = req.Clone(context.Background())
+	bgReq.Body = http.NoBody
+	bgReq.GetBody = nil
+
+	if bodyData != nil {
+		bgReq.Body = ioutil.NopCloser(bytes.NewReader(bodyData))
+		bgReq.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(bodyData)), nil
+		}
+	}
+
+	go func() {
+
+		defer httpCacheCtxt.revalidating.Delete(entryKey)
+
+		if _, err := httpCacheCtxt.fetch(nil, bgReq, bgCacheReq); err != nil {
+			log.Println("Failed to revalidate", entryKey, err)
+		}
+	}()
+
+	return
+}
+
+// getInvalidationKey finds the entries to invalidate. With url
+// the key is extracted by the route of the url, as for a method
+// request to it carrying the headers and cookies of req. Else
+// key, or uuid for older clients, is the cache key itself
+func (httpCacheCtxt *HttpCacheCtxt) getInvalidationKey(req *http.Request) (tenantName string,
+	reqKey ReqKeyT, err error) {
+
+	var (
+		keyReq   *http.Request
+		cacheReq *CacheReq
+		method   string
+	)
+
+	if req.FormValue("url") == "" {
+
+		if reqKey = ReqKeyT(req.FormValue("key")); reqKey == "" {
+			reqKey = ReqKeyT(req.FormValue("uuid"))
+		}
+
+		tenantName = httpCacheCtxt.getTenantName(req, reqKey)
+
+		return
+	}
+
+	if method = strings.ToUpper(req.FormValue("method")); method == "" {
+		method = http.MethodGet
+	}
+
+	if keyReq, err = http.NewRequest(method, req.FormValue("url"), nil); err != nil {
+		return
+	}
+
+	keyReq.Header = req.Header.Clone()
+
+	if cacheReq, err = httpCacheCtxt.newCacheReq(keyReq); err != nil {
+		return
+	}
+
+	if reqKey = cacheReq.ReqKey; reqKey == "" {
+		err = errors.New("No cache key for " + method + " " + req.FormValue("url"))
+		return
+	}
+
+	tenantName = cacheReq.TenantName
 
 	return
 }
@@ -349,15 +902,25 @@ func (httpCacheCtxt *HttpCacheCtxt) processRequest(w http.ResponseWriter,
 func (httpCacheCtxt *HttpCacheCtxt) invalidateCacheHandler(w http.ResponseWriter, req *http.Request) {
 
 	var (
-		reqKey ReqKeyT
-		err    error
+		reqKey     ReqKeyT
+		tenantName string
+		err        error
 	)
 
-	reqKey = ReqKeyT(req.FormValue("uuid"))
+	if tenantName, reqKey, err = httpCacheCtxt.getInvalidationKey(req); err != nil {
+
+		log.Println(err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(CommonErrMsg)
+
+		return
+	}
 
 	httpCacheCtxt.Stats.Counter.Invalidations.Inc()
 
-	if err = httpCacheCtxt.Cache.Invalidate(reqKey); err != nil {
+	if err = httpCacheCtxt.Cache.Invalidate(tenantName, reqKey); err != nil {
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -371,16 +934,95 @@ func (httpCacheCtxt *HttpCacheCtxt) invalidateCacheHandler(w http.ResponseWriter
 	return
 }
 
-func (httpCacheCtxt *HttpCacheCtxt) rootHandler(w http.ResponseWriter, req *http.Request) {
+func (httpCacheCtxt *HttpCacheCtxt) flushTenantHandler(w http.ResponseWriter, req *http.Request) {
+
+	var (
+		tenantName string
+		err        error
+	)
+
+	tenantName = mux.Vars(req)["tenant"]
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err = httpCacheCtxt.Cache.FlushTenant(tenantName); err != nil {
+
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(CommonErrMsg)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(SuccessMsg)
+
+	return
+}
+
+func (httpCacheCtxt *HttpCacheCtxt) tenantsHandler(w http.ResponseWriter, req *http.Request) {
 
 	var (
 		respBody []byte
 		err      error
 	)
 
+	w.Header().Set("Content-Type", "application/json")
+
+	if respBody, err = json.Marshal(httpCacheCtxt.Cache.TenantUsage()); err != nil {
+
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(CommonErrMsg)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBody)
+
+	return
+}
+
+func (httpCacheCtxt *HttpCacheCtxt) rootHandler(w http.ResponseWriter, req *http.Request) {
+
+	var (
+		resp         *Response
+		bufferedBody *BufferedBody
+		err          error
+	)
+
 	httpCacheCtxt.Stats.Counter.Requests.Inc()
 
-	if respBody, err = httpCacheCtxt.processRequest(w, req); err != nil {
+	// Upgraded connections go straight to the upstream
+	if isUpgradeRequest(req) {
+		httpCacheCtxt.tunnelHandler(w, req)
+		return
+	}
+
+	// The body is buffered before anything reads the form
+	// values of the request, so that the same body can be
+	// proxied upstream afterwards
+	if req, bufferedBody, err = httpCacheCtxt.bufferBody(req); err != nil {
+
+		log.Println(err)
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if _, isTooLarge := err.(BodyTooLargeError); isTooLarge {
+			w.WriteHeader(getErrorStatus(err))
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+
+		w.Write(CommonErrMsg)
+
+		return
+	}
+
+	if bufferedBody != nil {
+		defer bufferedBody.Close()
+	}
+
+	if resp, err = httpCacheCtxt.processRequest(w, req); err != nil {
 
 		if ProxyPresentErrorMessage == err.Error() {
 			return
@@ -388,16 +1030,35 @@ func (httpCacheCtxt *HttpCacheCtxt) rootHandler(w http.ResponseWriter, req *http
 
 		log.Println(err)
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write(CommonErrMsg)
+		// A body cut short can only be told apart from a
+		// complete one by dropping the connection
+		if resp != nil && resp.Streamed {
+			panic(http.ErrAbortHandler)
+		}
+
+		writeError(w, err)
 
 		return
 	}
 
+	if !resp.Streamed {
+		writeResponse(w, resp)
+	}
+
+	return
+}
+
+// writeError answers with the status the error maps to,
+// telling the shed clients when to come back
+func writeError(w http.ResponseWriter, err error) {
+
+	if limitErr, isLimited := err.(ConcurrencyLimitError); isLimited {
+		w.Header().Set("Retry-After", strconv.Itoa(limitErr.RetryAfter))
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(respBody)
+	w.WriteHeader(getErrorStatus(err))
+	w.Write(CommonErrMsg)
 
 	return
 }
@@ -410,6 +1071,9 @@ func (httpCacheCtxt *HttpCacheCtxt) registerRoutes() (server *http.Server, err e
 
 	router = mux.NewRouter()
 	router.HandleFunc("/httpCache/invalidate", httpCacheCtxt.invalidateCacheHandler)
+	router.HandleFunc("/httpCache/explain", httpCacheCtxt.explainHandler).Methods(http.MethodPost)
+	router.HandleFunc("/httpCache/tenants", httpCacheCtxt.tenantsHandler).Methods(http.MethodGet)
+	router.HandleFunc("/httpCache/tenants/{tenant}/flush", httpCacheCtxt.flushTenantHandler).Methods(http.MethodPost)
 
 	router.PathPrefix("/").HandlerFunc(httpCacheCtxt.rootHandler)
 
@@ -0,0 +1,94 @@
+package httpcache
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	testStats     *Stats
+	testStatsOnce = &sync.Once{}
+)
+
+// getTestStats returns the stats shared by
+// the tests as they are registered globally
+func getTestStats(t *testing.T) (stats *Stats) {
+
+	var (
+		err error
+	)
+
+	testStatsOnce.Do(func() {
+		if testStats, err = NewStats(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	stats = testStats
+
+	return
+}
+
+// newTestHttpCacheCtxt builds a context around the config
+// with the proxy workers running
+func newTestHttpCacheCtxt(t *testing.T, cfg *Config) (httpCacheCtxt *HttpCacheCtxt) {
+
+	var (
+		err error
+	)
+
+	if cfg.Proxy.QueueSize <= 0 {
+		cfg.Proxy.QueueSize = DefaultQueueSize
+	}
+
+	if cfg.Proxy.TenantQueueSize <= 0 {
+		cfg.Proxy.TenantQueueSize = cfg.Proxy.QueueSize
+	}
+
+	if cfg.Priority.StarvationLimit <= 0 {
+		cfg.Priority.StarvationLimit = DefaultStarvationLimit
+	}
+
+	if cfg.Tenants.Default == "" {
+		cfg.Tenants.Default = DefaultTenantName
+	}
+
+	httpCacheCtxt = &HttpCacheCtxt{
+		Config: cfg,
+		Stats:  getTestStats(t),
+
+		logger: logrus.New(),
+
+		revalidating: &sync.Map{},
+
+		LocalCacheBuildMap: make(map[string]FuncHandler),
+		ResponseValidators: make(map[string]ResponseValidator),
+	}
+
+	httpCacheCtxt.logger.SetOutput(ioutil.Discard)
+
+	if err = httpCacheCtxt.prepareSkipRoutes(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = httpCacheCtxt.prepareRoutes(); err != nil {
+		t.Fatal(err)
+	}
+
+	if httpCacheCtxt.Cache, err = NewCache(httpCacheCtxt); err != nil {
+		t.Fatal(err)
+	}
+
+	if httpCacheCtxt.ProxyCtxt, err = NewProxyCtxt(httpCacheCtxt); err != nil {
+		t.Fatal(err)
+	}
+
+	go httpCacheCtxt.ProxyCtxt.Process()
+
+	t.Cleanup(func() { close(httpCacheCtxt.ProxyCtxt.quitCh) })
+
+	return
+}
@@ -0,0 +1,254 @@
+package httpcache
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	LimitAlgorithmAimd     = "aimd"
+	LimitAlgorithmGradient = "gradient"
+
+	DefaultInitialLimit    = 20
+	DefaultMinLimit        = 1
+	DefaultMaxLimit        = 1000
+	DefaultLimitBackoff    = 0.9
+	DefaultLimitLatency    = 1000
+	DefaultLimitRetryAfter = 1
+
+	GradientLongWindow   = 600
+	GradientShortWindow  = 10
+	GradientTolerance    = 1.5
+	GradientMinGradient  = 0.5
+	GradientSmoothing    = 0.2
+	GradientMinQueueSize = 4
+)
+
+type (
+	// ConcurrencyLimitConfig turns on the adaptive limit of
+	// the requests in flight to the upstreams. With aimd the
+	// limit grows by one while the upstreams keep up and is
+	// cut by Backoff on errors or on latencies over Latency
+	// milliseconds. With gradient the limit follows the ratio
+	// of the long term latency to the recent one. Requests
+	// over the limit are shed with a 503 and a Retry-After of
+	// RetryAfter seconds
+	ConcurrencyLimitConfig struct {
+		Algorithm    string  `json:"algorithm"`
+		InitialLimit int     `json:"initial_limit"`
+		MinLimit     int     `json:"min_limit"`
+		MaxLimit     int     `json:"max_limit"`
+		Backoff      float64 `json:"backoff"`
+		Latency      int64   `json:"latency_ms"`
+		RetryAfter   int     `json:"retry_after"`
+	}
+
+	// LimitAlgorithm computes the next limit from the
+	// outcome of a request
+	LimitAlgorithm interface {
+		Update(limit float64, rtt time.Duration, inFlight int, didDrop bool) (newLimit float64)
+	}
+
+	AimdLimit struct {
+		Backoff float64
+		Latency time.Duration
+	}
+
+	// GradientLimit compares the average latency of the last
+	// GradientShortWindow requests to the one of the last
+	// GradientLongWindow requests. While they match the limit
+	// grows by a queue allowance, when the recent latency goes
+	// up the limit shrinks in proportion
+	GradientLimit struct {
+		longRtt  float64
+		shortRtt float64
+	}
+
+	ConcurrencyLimiter struct {
+		cfg       *ConcurrencyLimitConfig
+		algorithm LimitAlgorithm
+		stats     *Stats
+
+		limit    float64
+		inFlight int
+
+		lock *sync.Mutex
+	}
+)
+
+func NewConcurrencyLimiter(cfg *ConcurrencyLimitConfig, stats *Stats) (limiter *ConcurrencyLimiter, err error) {
+
+	limiter = &ConcurrencyLimiter{
+		cfg:   cfg,
+		stats: stats,
+
+		limit: float64(cfg.InitialLimit),
+
+		lock: &sync.Mutex{},
+	}
+
+	switch cfg.Algorithm {
+
+	case "":
+
+	case LimitAlgorithmAimd:
+		limiter.algorithm = &AimdLimit{
+			Backoff: cfg.Backoff,
+			Latency: time.Duration(cfg.Latency) * time.Millisecond,
+		}
+
+	case LimitAlgorithmGradient:
+		limiter.algorithm = &GradientLimit{}
+
+	default:
+		err = errors.New("Unknown concurrency limit algorithm " + cfg.Algorithm)
+		return
+	}
+
+	stats.Proxy.ConcurrencyLimit.Set(limiter.limit)
+
+	return
+}
+
+// Acquire admits a request when the requests in flight are
+// under the limit. Every admitted request has to be followed
+// by Release
+func (limiter *ConcurrencyLimiter) Acquire() (err error) {
+
+	if limiter.algorithm == nil {
+		return
+	}
+
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	if limiter.inFlight >= int(limiter.limit) {
+		limiter.stats.Proxy.Shed.Inc()
+		err = ConcurrencyLimitError{RetryAfter: limiter.cfg.RetryAfter}
+		return
+	}
+
+	limiter.inFlight++
+	limiter.stats.Proxy.InFlight.Inc()
+
+	return
+}
+
+// Cancel gives back an admission without any outcome,
+// as for a request which was not sent after all
+func (limiter *ConcurrencyLimiter) Cancel() {
+
+	if limiter.algorithm == nil {
+		return
+	}
+
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	limiter.inFlight--
+	limiter.stats.Proxy.InFlight.Dec()
+
+	return
+}
+
+// isDropped tells if the outcome of a request shows
+// an upstream which can't keep up
+func isDropped(result *proxyResult) (didDrop bool) {
+
+	if result.err != nil {
+		didDrop = true
+		return
+	}
+
+	switch result.resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		didDrop = true
+	}
+
+	return
+}
+
+// Release feeds the latency of the request and whether the
+// upstream failed or was overloaded into the limit
+func (limiter *ConcurrencyLimiter) Release(rtt time.Duration, didDrop bool) {
+
+	if limiter.algorithm == nil {
+		return
+	}
+
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	limiter.limit = limiter.algorithm.Update(limiter.limit, rtt, limiter.inFlight, didDrop)
+	limiter.limit = math.Max(float64(limiter.cfg.MinLimit), math.Min(float64(limiter.cfg.MaxLimit), limiter.limit))
+
+	limiter.inFlight--
+
+	limiter.stats.Proxy.InFlight.Dec()
+	limiter.stats.Proxy.ConcurrencyLimit.Set(math.Floor(limiter.limit))
+
+	return
+}
+
+func (aimd *AimdLimit) Update(limit float64, rtt time.Duration, inFlight int, didDrop bool) (newLimit float64) {
+
+	switch {
+
+	case didDrop || rtt > aimd.Latency:
+		newLimit = limit * aimd.Backoff
+
+	// The limit only grows while it is being used
+	case float64(inFlight*2) >= limit:
+		newLimit = limit + 1
+
+	default:
+		newLimit = limit
+	}
+
+	return
+}
+
+func (gradient *GradientLimit) Update(limit float64, rtt time.Duration, inFlight int, didDrop bool) (newLimit float64) {
+
+	var (
+		sample    float64
+		ratio     float64
+		queueSize float64
+	)
+
+	if sample = float64(rtt); gradient.longRtt == 0 {
+		gradient.longRtt = sample
+		gradient.shortRtt = sample
+	}
+
+	gradient.shortRtt += (sample - gradient.shortRtt) / GradientShortWindow
+	gradient.longRtt += (sample - gradient.longRtt) / GradientLongWindow
+
+	// The long term average drifts down quickly once the
+	// recent latency recovers, so it doesn't hold the limit
+	if gradient.longRtt/gradient.shortRtt > 2 {
+		gradient.longRtt *= 0.95
+	}
+
+	// Without pressure on the limit there is nothing to learn
+	if !didDrop && float64(inFlight*2) < limit {
+		newLimit = limit
+		return
+	}
+
+	ratio = math.Max(GradientMinGradient, math.Min(1, GradientTolerance*gradient.longRtt/gradient.shortRtt))
+
+	if didDrop {
+		ratio = GradientMinGradient
+	}
+
+	queueSize = math.Max(GradientMinQueueSize, math.Sqrt(limit))
+
+	newLimit = limit*ratio + queueSize
+	newLimit = limit*(1-GradientSmoothing) + newLimit*GradientSmoothing
+
+	return
+}
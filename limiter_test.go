@@ -0,0 +1,182 @@
+package httpcache
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAimdLimitUpdate(t *testing.T) {
+
+	var (
+		aimd = &AimdLimit{Backoff: 0.5, Latency: 100 * time.Millisecond}
+
+		testCases = []struct {
+			name     string
+			limit    float64
+			rtt      time.Duration
+			inFlight int
+			didDrop  bool
+			newLimit float64
+		}{
+			{"grows while used", 10, 10 * time.Millisecond, 5, false, 11},
+			{"idle limit stays", 10, 10 * time.Millisecond, 4, false, 10},
+			{"drop cuts", 10, 10 * time.Millisecond, 10, true, 5},
+			{"slow request cuts", 10, 200 * time.Millisecond, 10, false, 5},
+			{"slow idle request cuts", 10, 200 * time.Millisecond, 0, false, 5},
+		}
+	)
+
+	for _, testCase := range testCases {
+		if newLimit := aimd.Update(testCase.limit, testCase.rtt, testCase.inFlight, testCase.didDrop); newLimit != testCase.newLimit {
+			t.Errorf("%s: limit %v instead of %v", testCase.name, newLimit, testCase.newLimit)
+		}
+	}
+}
+
+func TestGradientLimitUpdate(t *testing.T) {
+
+	var (
+		testCases = []struct {
+			name     string
+			rtts     []time.Duration
+			inFlight int
+			didDrop  bool
+			isGrowth bool
+			isCut    bool
+		}{
+			{name: "steady latency grows", rtts: []time.Duration{10, 10, 10}, inFlight: 20, isGrowth: true},
+			{name: "idle limit stays", rtts: []time.Duration{10, 10, 10}, inFlight: 2},
+			{name: "drop cuts", rtts: []time.Duration{10, 10, 10}, inFlight: 20, didDrop: true, isCut: true},
+			{name: "latency going up cuts", rtts: []time.Duration{10, 10, 1000, 1000, 1000}, inFlight: 20, isCut: true},
+		}
+	)
+
+	for _, testCase := range testCases {
+
+		var (
+			gradient = &GradientLimit{}
+			limit    = 20.0
+			newLimit float64
+		)
+
+		for idx, rtt := range testCase.rtts {
+
+			isLast := idx == len(testCase.rtts)-1
+
+			if newLimit = gradient.Update(limit, rtt*time.Millisecond, testCase.inFlight, isLast && testCase.didDrop); !isLast {
+				continue
+			}
+
+			switch {
+			case testCase.isGrowth && newLimit <= limit:
+				t.Errorf("%s: limit %v didn't grow", testCase.name, newLimit)
+			case testCase.isCut && newLimit >= limit:
+				t.Errorf("%s: limit %v wasn't cut", testCase.name, newLimit)
+			case !testCase.isGrowth && !testCase.isCut && newLimit != limit:
+				t.Errorf("%s: limit %v changed", testCase.name, newLimit)
+			}
+		}
+	}
+}
+
+func TestConcurrencyLimiterBounds(t *testing.T) {
+
+	var (
+		limiter *ConcurrencyLimiter
+		err     error
+	)
+
+	if limiter, err = NewConcurrencyLimiter(&ConcurrencyLimitConfig{
+		Algorithm:    LimitAlgorithmAimd,
+		InitialLimit: 2,
+		MinLimit:     1,
+		MaxLimit:     3,
+		Backoff:      0.1,
+		Latency:      1000,
+	}, getTestStats(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	for idx := 0; idx < 2; idx++ {
+		if err = limiter.Acquire(); err != nil {
+			t.Fatalf("Request %d shed under the limit", idx)
+		}
+	}
+
+	if err = limiter.Acquire(); err == nil || getErrorStatus(err) != http.StatusServiceUnavailable {
+		t.Fatalf("Request over the limit got %v", err)
+	}
+
+	// The limit never drops below the minimum...
+	limiter.Release(time.Millisecond, true)
+
+	if limiter.limit != 1 {
+		t.Fatalf("Limit %v below the minimum", limiter.limit)
+	}
+
+	// ...nor grows over the maximum while in use
+	for idx := 0; idx < 5; idx++ {
+		limiter.inFlight = 3
+		limiter.Release(time.Millisecond, false)
+	}
+
+	if limiter.limit != 3 {
+		t.Fatalf("Limit %v over the maximum", limiter.limit)
+	}
+
+	if _, err = NewConcurrencyLimiter(&ConcurrencyLimitConfig{Algorithm: "vegas"}, getTestStats(t)); err == nil {
+		t.Fatal("Unknown algorithm accepted")
+	}
+}
+
+func TestProxyCtxtTimeoutCutsLimit(t *testing.T) {
+
+	var (
+		upstream      *httptest.Server
+		httpCacheCtxt *HttpCacheCtxt
+		limiter       *ConcurrencyLimiter
+		releaseCh     chan struct{}
+		err           error
+		cfg           = &Config{}
+	)
+
+	releaseCh = make(chan struct{})
+
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-releaseCh
+	}))
+	defer upstream.Close()
+	defer close(releaseCh)
+
+	cfg.Server.RemoteHost = upstream.URL
+	cfg.Proxy.NoOfWorkers = 1
+	cfg.Timeouts.Total = 100
+	cfg.ConcurrencyLimit = ConcurrencyLimitConfig{
+		Algorithm:    LimitAlgorithmAimd,
+		InitialLimit: 10,
+		MinLimit:     1,
+		MaxLimit:     100,
+		Backoff:      0.5,
+		Latency:      10000,
+	}
+
+	httpCacheCtxt = newTestHttpCacheCtxt(t, cfg)
+	limiter = httpCacheCtxt.ProxyCtxt.Limiter
+
+	_, err = httpCacheCtxt.ProxyCtxt.Send(httptest.NewRequest(http.MethodGet, "/test", nil),
+		newTestCacheReq(httpCacheCtxt, "slow"))
+
+	if err != (UpstreamTimeoutError{Phase: TimeoutPhaseTotal}) {
+		t.Fatalf("Request failed with %v instead of a total timeout", err)
+	}
+
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	if math.Abs(limiter.limit-5) > 1e-9 || limiter.inFlight != 0 {
+		t.Fatalf("Limit %v with %d in flight after the timeout", limiter.limit, limiter.inFlight)
+	}
+}
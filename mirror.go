@@ -0,0 +1,328 @@
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultMirrorName        = "shadow"
+	DefaultMirrorTimeout     = 5000
+	DefaultMirrorMaxInFlight = 100
+	DefaultMirrorDiffBytes   = 64 * 1024
+)
+
+type (
+	// MirrorConfig copies Percent of the proxied requests to
+	// a shadow upstream, e.g. a new version of the backend.
+	// The shadow responses never reach the clients. With Diff
+	// they are compared to the responses of the pool, bodies
+	// up to MaxDiffBytes, and the differences logged. Mirrored
+	// requests are bounded by TimeoutMs, at most MaxInFlight
+	// are sent at a time and the others skipped
+	MirrorConfig struct {
+		Upstream     *UpstreamConfig `json:"upstream"`
+		Percent      float64         `json:"percent"`
+		Diff         bool            `json:"diff"`
+		MaxDiffBytes int64           `json:"max_diff_bytes"`
+		TimeoutMs    int64           `json:"timeout_ms"`
+		MaxInFlight  int             `json:"max_in_flight"`
+	}
+
+	Mirror struct {
+		httpCacheCtxt *HttpCacheCtxt
+		cfg           *MirrorConfig
+
+		Upstream *Upstream
+
+		inFlightCh chan struct{}
+	}
+
+	// mirrorResult is the response of the
+	// pool the shadow response is diffed with
+	mirrorResult struct {
+		statusCode int
+		body       *CacheBuffer
+		isComplete bool
+	}
+
+	// mirrorCapture keeps a copy of the body of the response
+	// of the pool while it is read, handing it to the mirrored
+	// request once closed
+	mirrorCapture struct {
+		io.ReadCloser
+
+		result    *mirrorResult
+		resultCh  chan *mirrorResult
+		closeOnce *sync.Once
+	}
+)
+
+// NewMirror sets up the shadow upstream, nil
+// when no mirroring is configured
+func NewMirror(httpCacheCtxt *HttpCacheCtxt) (mirror *Mirror, err error) {
+
+	var (
+		cfg = &httpCacheCtxt.Config.Mirror
+	)
+
+	if cfg.Upstream == nil || cfg.Percent <= 0 {
+		return
+	}
+
+	if cfg.Upstream.Name == "" {
+		cfg.Upstream.Name = DefaultMirrorName
+	}
+
+	mirror = &Mirror{
+		httpCacheCtxt: httpCacheCtxt,
+		cfg:           cfg,
+
+		inFlightCh: make(chan struct{}, cfg.MaxInFlight),
+	}
+
+	if mirror.Upstream, err = NewUpstreamFromConfig(cfg.Upstream); err != nil {
+		return
+	}
+
+	httpCacheCtxt.initUpstream(mirror.Upstream)
+
+	return
+}
+
+// Send mirrors the request when it is sampled, returning the
+// channel the response of the pool is expected on when it is
+// to be diffed. The body of the request is copied before the
+// request is done, only bodies held in memory are mirrored
+func (mirror *Mirror) Send(req *http.Request, header http.Header) (resultCh chan *mirrorResult) {
+
+	var (
+		bufferedBody *BufferedBody
+		bodyData     []byte
+		inMemory     bool
+	)
+
+	if mirror == nil || rand.Float64()*100 >= mirror.cfg.Percent {
+		return
+	}
+
+	if bufferedBody = getBufferedBody(req); bufferedBody != nil {
+		if bodyData, inMemory = bufferedBody.Bytes(); !inMemory {
+			mirror.httpCacheCtxt.Stats.Proxy.MirrorSkipped.Inc()
+			return
+		}
+	} else if req.Body != nil && req.Body != http.NoBody {
+		mirror.httpCacheCtxt.Stats.Proxy.MirrorSkipped.Inc()
+		return
+	}
+
+	if !mirror.Upstream.IsAvailable() || mirror.Upstream.Breaker.Allow() != nil {
+		mirror.httpCacheCtxt.Stats.Proxy.MirrorSkipped.Inc()
+		return
+	}
+
+	select {
+	case mirror.inFlightCh <- struct{}{}:
+	default:
+		mirror.Upstream.Breaker.Cancel()
+		mirror.httpCacheCtxt.Stats.Proxy.MirrorSkipped.Inc()
+		return
+	}
+
+	if mirror.cfg.Diff {
+		resultCh = make(chan *mirrorResult, 1)
+	}
+
+	go mirror.run(req, header.Clone(), bytes.Clone(bodyData), resultCh)
+
+	return
+}
+
+func (mirror *Mirror) run(req *http.Request, header http.Header, bodyData []byte, resultCh chan *mirrorResult) {
+
+	var (
+		ctx      context.Context
+		cancel   context.CancelFunc
+		proxyReq *http.Request
+		resp     *http.Response
+		shadow   *mirrorResult
+		primary  *mirrorResult
+		err      error
+	)
+
+	defer func() { <-mirror.inFlightCh }()
+
+	mirror.httpCacheCtxt.Stats.Proxy.Mirrored.Inc()
+
+	// The mirrored request outlives the client request
+	ctx, cancel = context.WithTimeout(context.Background(), time.Duration(mirror.cfg.TimeoutMs)*time.Millisecond)
+	defer cancel()
+
+	if proxyReq, err = newUpstreamRequest(ctx, req, header, mirror.Upstream, bytes.NewReader(bodyData)); err != nil {
+		mirror.Upstream.Breaker.Cancel()
+		return
+	}
+
+	if resp, err = mirror.Upstream.Do(proxyReq); err != nil {
+
+		mirror.httpCacheCtxt.Stats.Proxy.MirrorErrors.Inc()
+
+		mirror.httpCacheCtxt.logger.WithFields(logrus.Fields{
+			"upstream":   mirror.Upstream.Name,
+			"path":       req.URL.Path,
+			"error":      err.Error(),
+			"event_type": "mirror_failed",
+		}).Debug("Mirrored request failed")
+
+		return
+	}
+
+	defer resp.Body.Close()
+
+	if resultCh == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return
+	}
+
+	shadow = &mirrorResult{
+		statusCode: resp.StatusCode,
+		body:       NewCacheBuffer(mirror.cfg.MaxDiffBytes),
+	}
+
+	if _, err = io.Copy(shadow.body, resp.Body); err != nil {
+		return
+	}
+
+	shadow.isComplete = true
+
+	select {
+	case primary = <-resultCh:
+	case <-ctx.Done():
+		return
+	}
+
+	mirror.diff(req, primary, shadow)
+
+	return
+}
+
+// diff logs how the shadow response differs from the one
+// of the pool. Bodies are only compared when both were read
+// in full and fit in MaxDiffBytes
+func (mirror *Mirror) diff(req *http.Request, primary *mirrorResult, shadow *mirrorResult) {
+
+	var (
+		fields       logrus.Fields
+		isDifferent  bool
+		primaryBytes []byte
+		shadowBytes  []byte
+	)
+
+	fields = logrus.Fields{
+		"upstream":       mirror.Upstream.Name,
+		"path":           req.URL.Path,
+		"status":         primary.statusCode,
+		"shadow_status":  shadow.statusCode,
+		"event_type":     "mirror_diff",
+		"body_compared":  false,
+		"primary_failed": primary.statusCode == 0,
+	}
+
+	if primary.statusCode != shadow.statusCode {
+		isDifferent = true
+	}
+
+	if primary.isComplete && !primary.body.IsOverflown && !shadow.body.IsOverflown {
+
+		primaryBytes, shadowBytes = primary.body.Bytes(), shadow.body.Bytes()
+		fields["body_compared"] = true
+
+		if !bytes.Equal(primaryBytes, shadowBytes) {
+			isDifferent = true
+
+			fields["body_bytes"] = len(primaryBytes)
+			fields["shadow_body_bytes"] = len(shadowBytes)
+			fields["first_diff_at"] = getFirstDiff(primaryBytes, shadowBytes)
+		}
+	}
+
+	if !isDifferent {
+		return
+	}
+
+	mirror.httpCacheCtxt.Stats.Proxy.MirrorDiffs.Inc()
+	mirror.httpCacheCtxt.logger.WithFields(fields).Info("Shadow response differs")
+
+	return
+}
+
+func getFirstDiff(a []byte, b []byte) (offset int) {
+
+	for offset = 0; offset < len(a) && offset < len(b); offset++ {
+		if a[offset] != b[offset] {
+			return
+		}
+	}
+
+	return
+}
+
+// capture hands the response of the pool to the mirrored
+// request, right away on errors, else once its body is closed
+func (mirror *Mirror) capture(resp *http.Response, resultCh chan *mirrorResult) {
+
+	var (
+		capture *mirrorCapture
+	)
+
+	if resp == nil {
+		resultCh <- &mirrorResult{body: NewCacheBuffer(mirror.cfg.MaxDiffBytes)}
+		return
+	}
+
+	capture = &mirrorCapture{
+		ReadCloser: resp.Body,
+
+		result: &mirrorResult{
+			statusCode: resp.StatusCode,
+			body:       NewCacheBuffer(mirror.cfg.MaxDiffBytes),
+		},
+		resultCh:  resultCh,
+		closeOnce: &sync.Once{},
+	}
+
+	resp.Body = capture
+
+	return
+}
+
+func (capture *mirrorCapture) Read(data []byte) (n int, err error) {
+
+	n, err = capture.ReadCloser.Read(data)
+	capture.result.body.Write(data[:n])
+
+	if err == io.EOF {
+		capture.result.isComplete = true
+	}
+
+	return
+}
+
+func (capture *mirrorCapture) Close() (err error) {
+
+	err = capture.ReadCloser.Close()
+
+	capture.closeOnce.Do(func() {
+		capture.resultCh <- capture.result
+	})
+
+	return
+}
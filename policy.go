@@ -0,0 +1,354 @@
+package httpcache
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	RouteHandlerUpstream = "upstream"
+	RouteHandlerLocal    = "local"
+	RouteHandlerSkip     = "skip"
+
+	DefaultKeyExtractor = "form:uuid"
+	DefaultPolicyName   = "default"
+
+	KeyPartSeparator = "|"
+)
+
+type (
+	RouteConfig struct {
+		Name  string `json:"name"`
+		Match string `json:"match"`
+
+		// Handler is one of upstream, local or skip
+		Handler string `json:"handler"`
+
+		// Key lists the parts of the request the cache key is
+		// built from, e.g. "form:uuid" or "header:X-User,path:id".
+		// Supported sources are form, query, header, cookie and path
+		Key string `json:"key"`
+
+		// Methods which are looked up in and added to the cache.
+		// Other methods are sent upstream without caching
+		Methods           []string `json:"methods"`
+		CacheableStatuses []int    `json:"cacheable_statuses"`
+
+		// Durations are in seconds. A TTL of 0 keeps the
+		// response until it is invalidated
+		TTL                  int64 `json:"ttl"`
+		StaleWhileRevalidate int64 `json:"stale_while_revalidate"`
+		StaleIfError         int64 `json:"stale_if_error"`
+
+		MaxBodyBytes int64 `json:"max_body_bytes"`
+
+		// RetrySafe allows retrying the non idempotent
+		// methods of the route, e.g. a POST used as a query
+		RetrySafe bool `json:"retry_safe"`
+
+		// Hedge sends the slow requests of the route
+		// to a second upstream, see HedgingConfig
+		Hedge bool `json:"hedge"`
+
+		// Validate checks the responses before they are
+		// cached, the ones failing are only relayed
+		Validate *ValidationConfig `json:"validate"`
+
+		// Timeouts override the global ones when set
+		Timeouts TimeoutConfig `json:"timeouts"`
+
+		// RequestHeaders rules run after the global ones
+		RequestHeaders *HeaderPolicyConfig `json:"request_headers"`
+
+		// Priority is the class of the requests sent upstream,
+		// high, normal, low or background. Normal by default
+		Priority string `json:"priority"`
+	}
+
+	RoutePolicy struct {
+		Name    string
+		Handler string
+
+		keyParts []keyPart
+
+		Methods           map[string]bool
+		CacheableStatuses map[int]bool
+
+		TTL                  time.Duration
+		StaleWhileRevalidate time.Duration
+		StaleIfError         time.Duration
+
+		MaxBodyBytes int64
+		RetrySafe    bool
+		Timeouts     TimeoutConfig
+		Priority     string
+
+		Hedge     bool
+		Latencies *LatencyWindow
+
+		Validation *ResponseValidation
+
+		RequestHeaders *HeaderPolicy
+	}
+
+	keyPart struct {
+		source string
+		name   string
+	}
+)
+
+func NewRoutePolicy(routeCfg *RouteConfig) (policy *RoutePolicy, err error) {
+
+	var (
+		key string
+	)
+
+	policy = &RoutePolicy{
+		Name:    routeCfg.Name,
+		Handler: routeCfg.Handler,
+
+		Methods:           make(map[string]bool),
+		CacheableStatuses: make(map[int]bool),
+
+		TTL:                  time.Duration(routeCfg.TTL) * time.Second,
+		StaleWhileRevalidate: time.Duration(routeCfg.StaleWhileRevalidate) * time.Second,
+		StaleIfError:         time.Duration(routeCfg.StaleIfError) * time.Second,
+
+		MaxBodyBytes: routeCfg.MaxBodyBytes,
+		RetrySafe:    routeCfg.RetrySafe,
+		Timeouts:     routeCfg.Timeouts,
+		Priority:     routeCfg.Priority,
+
+		Hedge: routeCfg.Hedge,
+	}
+
+	if policy.Hedge {
+		policy.Latencies = NewLatencyWindow(HedgeLatencySamples)
+	}
+
+	if policy.Name == "" {
+		policy.Name = routeCfg.Match
+	}
+
+	switch policy.Handler {
+	case "":
+		policy.Handler = RouteHandlerUpstream
+	case RouteHandlerUpstream, RouteHandlerLocal, RouteHandlerSkip:
+	default:
+		err = errors.New("Unknown handler " + policy.Handler + " for route " + policy.Name)
+		return
+	}
+
+	if err = validatePriority(policy.Priority); err != nil {
+		return
+	}
+
+	if routeCfg.Validate != nil {
+		if policy.Validation, err = NewResponseValidation(routeCfg.Validate); err != nil {
+			return
+		}
+	}
+
+	if routeCfg.RequestHeaders != nil {
+		if policy.RequestHeaders, err = NewHeaderPolicy(routeCfg.RequestHeaders); err != nil {
+			return
+		}
+	}
+
+	if key = routeCfg.Key; key == "" {
+		key = DefaultKeyExtractor
+	}
+
+	for _, part := range strings.Split(key, ",") {
+
+		var (
+			source, name string
+			isPresent    bool
+		)
+
+		if source, name, isPresent = strings.Cut(strings.TrimSpace(part), ":"); !isPresent || name == "" {
+			err = errors.New("Invalid key " + part + " for route " + policy.Name)
+			return
+		}
+
+		switch source {
+		case "form", "query", "header", "cookie", "path":
+		default:
+			err = errors.New("Unknown key source " + source + " for route " + policy.Name)
+			return
+		}
+
+		policy.keyParts = append(policy.keyParts, keyPart{source: source, name: name})
+	}
+
+	for _, method := range routeCfg.Methods {
+		policy.Methods[strings.ToUpper(method)] = true
+	}
+
+	if len(routeCfg.CacheableStatuses) == 0 {
+		policy.CacheableStatuses[http.StatusOK] = true
+	}
+
+	for _, status := range routeCfg.CacheableStatuses {
+		policy.CacheableStatuses[status] = true
+	}
+
+	return
+}
+
+func (httpCacheCtxt *HttpCacheCtxt) prepareRoutes() (err error) {
+
+	var (
+		route  *Route
+		policy *RoutePolicy
+	)
+
+	httpCacheCtxt.Routes = &RouteMatcher{}
+
+	for idx := range httpCacheCtxt.Config.Routes {
+
+		routeCfg := &httpCacheCtxt.Config.Routes[idx]
+
+		if routeCfg.Match == "" {
+			err = errors.New("Route " + routeCfg.Name + " has no match pattern")
+			return
+		}
+
+		if policy, err = NewRoutePolicy(routeCfg); err != nil {
+			return
+		}
+
+		if route, err = NewRoute(policy.Name, routeCfg.Match); err != nil {
+			return
+		}
+
+		route.Policy = policy
+
+		httpCacheCtxt.Routes.Add(route)
+	}
+
+	if httpCacheCtxt.DefaultPolicy, err = NewRoutePolicy(&RouteConfig{
+		Name: DefaultPolicyName,
+	}); err != nil {
+		return
+	}
+
+	if httpCacheCtxt.SkipPolicy, err = NewRoutePolicy(&RouteConfig{
+		Name:    DefaultPolicyName,
+		Handler: RouteHandlerSkip,
+	}); err != nil {
+		return
+	}
+
+	if httpCacheCtxt.LocalPolicy, err = NewRoutePolicy(&RouteConfig{
+		Name:    DefaultPolicyName,
+		Handler: RouteHandlerLocal,
+	}); err != nil {
+		return
+	}
+
+	return
+}
+
+// resolvePolicy finds the policy the request is handled with.
+// Routes from the config are tried in order and requests not
+// matching any of them fall back to the default policy, which
+// proxies upstream unless the api has a local handler registered
+// or is a skip api. The matched route is nil for the default
+// and local policies
+func (httpCacheCtxt *HttpCacheCtxt) resolvePolicy(req *http.Request) (policy *RoutePolicy,
+	route *Route, vars map[string]string) {
+
+	var (
+		isPresent bool
+	)
+
+	if route, vars = httpCacheCtxt.Routes.Match(req.URL.Path); route != nil {
+		policy = route.Policy
+		return
+	}
+
+	policy = httpCacheCtxt.DefaultPolicy
+
+	if _, isPresent = httpCacheCtxt.LocalCacheBuildMap[req.URL.Path]; isPresent {
+		policy = httpCacheCtxt.LocalPolicy
+		return
+	}
+
+	if route, _ = httpCacheCtxt.SkipRoutes.Match(req.URL.Path); route != nil {
+		policy = httpCacheCtxt.SkipPolicy
+		return
+	}
+
+	return
+}
+
+func (policy *RoutePolicy) Key(req *http.Request, vars map[string]string) (reqKey ReqKeyT) {
+
+	var (
+		parts []string
+		value string
+	)
+
+	for _, part := range policy.keyParts {
+
+		if value = getRequestValue(req, vars, part); value == "" {
+			return
+		}
+
+		parts = append(parts, value)
+	}
+
+	reqKey = ReqKeyT(strings.Join(parts, KeyPartSeparator))
+
+	return
+}
+
+func getRequestValue(req *http.Request, vars map[string]string, part keyPart) (value string) {
+
+	switch part.source {
+	case "form":
+		value = req.FormValue(part.name)
+	case "query":
+		value = req.URL.Query().Get(part.name)
+	case "header":
+		value = req.Header.Get(part.name)
+	case "path":
+		value = vars[part.name]
+	case "cookie":
+		if cookie, err := req.Cookie(part.name); err == nil {
+			value = cookie.Value
+		}
+	}
+
+	return
+}
+
+// IsCacheable tells if the request is looked up in and
+// added to the cache at all
+func (policy *RoutePolicy) IsCacheable(req *http.Request) (isCacheable bool) {
+
+	if policy.Handler == RouteHandlerSkip {
+		return
+	}
+
+	if len(policy.Methods) > 0 && !policy.Methods[req.Method] {
+		return
+	}
+
+	isCacheable = true
+
+	return
+}
+
+func (policy *RoutePolicy) IsCacheableStatus(statusCode int) (isCacheable bool) {
+	isCacheable = policy.CacheableStatuses[statusCode]
+	return
+}
+
+func (policy *RoutePolicy) IsCacheableSize(size int64) (isCacheable bool) {
+	isCacheable = policy.MaxBodyBytes <= 0 || size <= policy.MaxBodyBytes
+	return
+}
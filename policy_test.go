@@ -0,0 +1,143 @@
+package httpcache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoutePolicyKey(t *testing.T) {
+
+	var (
+		testCases = []struct {
+			name   string
+			key    string
+			method string
+			url    string
+			body   string
+			header string
+			cookie string
+			vars   map[string]string
+			reqKey ReqKeyT
+		}{
+			{name: "default form from query", method: http.MethodGet, url: "/a?uuid=1", reqKey: "1"},
+			{name: "default form from body", method: http.MethodPost, url: "/a", body: "uuid=2", reqKey: "2"},
+			{name: "query ignores body", key: "query:uuid", method: http.MethodPost, url: "/a", body: "uuid=2"},
+			{name: "header", key: "header:X-Id", method: http.MethodGet, url: "/a", header: "3", reqKey: "3"},
+			{name: "cookie", key: "cookie:sid", method: http.MethodGet, url: "/a", cookie: "4", reqKey: "4"},
+			{name: "path", key: "path:id", method: http.MethodGet, url: "/a", vars: map[string]string{"id": "5"}, reqKey: "5"},
+			{
+				name:   "parts joined in order",
+				key:    "path:id, query:uuid",
+				method: http.MethodGet,
+				url:    "/a?uuid=6",
+				vars:   map[string]string{"id": "5"},
+				reqKey: ReqKeyT("5" + KeyPartSeparator + "6"),
+			},
+			{name: "missing part", key: "path:id,query:uuid", method: http.MethodGet, url: "/a?uuid=6"},
+		}
+	)
+
+	for _, testCase := range testCases {
+
+		policy, err := NewRoutePolicy(&RouteConfig{Name: testCase.name, Key: testCase.key})
+		if err != nil {
+			t.Fatalf("%s: %v", testCase.name, err)
+		}
+
+		req := httptest.NewRequest(testCase.method, testCase.url, strings.NewReader(testCase.body))
+
+		if testCase.body != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+
+		if testCase.header != "" {
+			req.Header.Set("X-Id", testCase.header)
+		}
+
+		if testCase.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "sid", Value: testCase.cookie})
+		}
+
+		if reqKey := policy.Key(req, testCase.vars); reqKey != testCase.reqKey {
+			t.Errorf("%s: key %q instead of %q", testCase.name, reqKey, testCase.reqKey)
+		}
+	}
+}
+
+func TestNewRoutePolicyInvalidKey(t *testing.T) {
+
+	for _, key := range []string{"uuid", "form:", "body:uuid", "query:uuid,"} {
+		if _, err := NewRoutePolicy(&RouteConfig{Name: "invalid", Key: key}); err == nil {
+			t.Errorf("Key %q accepted", key)
+		}
+	}
+}
+
+func TestInvalidateCacheByURL(t *testing.T) {
+
+	var (
+		httpCacheCtxt *HttpCacheCtxt
+		cacheApi      *CacheApi
+		w             *httptest.ResponseRecorder
+		err           error
+		cfg           = &Config{}
+		reqKey        = ReqKeyT("42" + KeyPartSeparator + "acme:1")
+		entryName     = "/api/v2/users/42/avatar"
+	)
+
+	cfg.Server.RemoteHost = "http://127.0.0.1:1"
+	cfg.Routes = []RouteConfig{{
+		Name:  "user-avatar",
+		Match: "/api/{ver}/users/{id}/avatar",
+		Key:   "path:id,form:uuid",
+	}}
+
+	httpCacheCtxt = newTestHttpCacheCtxt(t, cfg)
+
+	testCases := []struct {
+		name          string
+		target        string
+		status        int
+		isInvalidated bool
+	}{
+		{name: "unknown key", target: "/httpCache/invalidate?key=other", status: http.StatusInternalServerError},
+		{name: "route without key", target: "/httpCache/invalidate?url=/api/v2/users/42/avatar", status: http.StatusBadRequest},
+		{
+			name:          "method",
+			target:        "/httpCache/invalidate?method=post&url=/api/v2/users/42/avatar%3Fuuid%3Dacme:1",
+			status:        http.StatusOK,
+			isInvalidated: true,
+		},
+		{name: "url", target: "/httpCache/invalidate?url=/api/v2/users/42/avatar%3Fuuid%3Dacme:1", status: http.StatusOK, isInvalidated: true},
+		{name: "key", target: "/httpCache/invalidate?key=" + string(reqKey), status: http.StatusOK, isInvalidated: true},
+		{name: "uuid", target: "/httpCache/invalidate?uuid=" + string(reqKey), status: http.StatusOK, isInvalidated: true},
+	}
+
+	for _, testCase := range testCases {
+
+		var (
+			tenantName = httpCacheCtxt.getTenantName(httptest.NewRequest(http.MethodGet, "/", nil), reqKey)
+		)
+
+		if err = httpCacheCtxt.Cache.Add(tenantName, reqKey, entryName, &Response{StatusCode: http.StatusOK}); err != nil {
+			t.Fatal(err)
+		}
+
+		w = httptest.NewRecorder()
+		httpCacheCtxt.invalidateCacheHandler(w, httptest.NewRequest(http.MethodPost, testCase.target, nil))
+
+		if w.Code != testCase.status {
+			t.Fatalf("%s: status %d instead of %d", testCase.name, w.Code, testCase.status)
+		}
+
+		if cacheApi, err = httpCacheCtxt.Cache.get(tenantName, reqKey, entryName); err != nil {
+			t.Fatal(err)
+		}
+
+		if isInvalidated := !cacheApi.IsValid(0); isInvalidated != testCase.isInvalidated {
+			t.Fatalf("%s: entry invalidated %v", testCase.name, isInvalidated)
+		}
+	}
+}
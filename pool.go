@@ -0,0 +1,441 @@
+package httpcache
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+type (
+	UpstreamConfig struct {
+		Name   string `json:"name"`
+		URL    string `json:"url"`
+		Weight int    `json:"weight"`
+
+		// Protocol is one of http1, h2 or h2c
+		Protocol string `json:"protocol"`
+
+		TLS *UpstreamTLSConfig `json:"tls"`
+	}
+
+	// UpstreamPool is the set of backends the proxied
+	// requests are spread over
+	UpstreamPool struct {
+		httpCacheCtxt *HttpCacheCtxt
+
+		Balancer  Balancer
+		Discovery *UpstreamDiscovery
+
+		upstreams []*Upstream
+		isRunning bool
+		stopCh    chan struct{}
+		lock      *sync.RWMutex
+		ejectLock *sync.Mutex
+	}
+)
+
+func NewUpstreamPool(httpCacheCtxt *HttpCacheCtxt) (pool *UpstreamPool, err error) {
+
+	var (
+		upstreamCfgs []UpstreamConfig
+		upstreams    []*Upstream
+		upstream     *Upstream
+	)
+
+	pool = &UpstreamPool{
+		httpCacheCtxt: httpCacheCtxt,
+		stopCh:        make(chan struct{}),
+		lock:          &sync.RWMutex{},
+		ejectLock:     &sync.Mutex{},
+	}
+
+	if pool.Balancer, err = NewBalancer(httpCacheCtxt.Config.LoadBalancer.Strategy,
+		httpCacheCtxt.Config.LoadBalancer.HashReplicas); err != nil {
+
+		return
+	}
+
+	// Discovered upstreams are found before the first
+	// request, failures are retried in the background
+	if httpCacheCtxt.Config.Discovery != nil {
+
+		if pool.Discovery, err = NewUpstreamDiscovery(pool, httpCacheCtxt.Config.Discovery); err != nil {
+			return
+		}
+
+		pool.Discovery.Refresh()
+
+		return
+	}
+
+	// Without an upstreams section the pool is made of
+	// the single remote_host of the server section
+	if upstreamCfgs = httpCacheCtxt.Config.Upstreams; len(upstreamCfgs) == 0 {
+		upstreamCfgs = []UpstreamConfig{{
+			URL: httpCacheCtxt.Config.Server.RemoteHost,
+		}}
+	}
+
+	for idx := range upstreamCfgs {
+
+		if upstream, err = NewUpstreamFromConfig(&upstreamCfgs[idx]); err != nil {
+			return
+		}
+
+		upstreams = append(upstreams, upstream)
+	}
+
+	if err = pool.SetUpstreams(upstreams); err != nil {
+		return
+	}
+
+	return
+}
+
+func NewUpstreamFromConfig(upstreamCfg *UpstreamConfig) (upstream *Upstream, err error) {
+
+	if upstream, err = NewUpstream(upstreamCfg.Name, upstreamCfg.URL); err != nil {
+		return
+	}
+
+	if upstreamCfg.Weight > 0 {
+		upstream.Weight = upstreamCfg.Weight
+	}
+
+	if upstreamCfg.TLS != nil {
+		if err = upstream.SetTLS(upstreamCfg.TLS); err != nil {
+			return
+		}
+	}
+
+	if err = upstream.SetProtocol(upstreamCfg.Protocol); err != nil {
+		return
+	}
+
+	return
+}
+
+// SetUpstreams replaces the upstreams of the pool. Upstreams
+// already in the pool keep their state, the new ones are set
+// up and the removed ones stopped once their requests are done
+func (pool *UpstreamPool) SetUpstreams(upstreams []*Upstream) (err error) {
+
+	var (
+		names     map[string]bool
+		removed   map[*Upstream]bool
+		added     []*Upstream
+		isRunning bool
+	)
+
+	names = make(map[string]bool, len(upstreams))
+	removed = make(map[*Upstream]bool)
+
+	for _, upstream := range pool.Upstreams() {
+		removed[upstream] = true
+	}
+
+	for _, upstream := range upstreams {
+
+		if names[upstream.Name] {
+			err = errors.New("Duplicate upstream " + upstream.Name)
+			return
+		}
+
+		names[upstream.Name] = true
+	}
+
+	for _, upstream := range upstreams {
+
+		if removed[upstream] {
+			delete(removed, upstream)
+			continue
+		}
+
+		pool.httpCacheCtxt.initUpstream(upstream)
+		upstream.Health.pool = pool
+
+		added = append(added, upstream)
+	}
+
+	pool.lock.Lock()
+	pool.upstreams = upstreams
+	isRunning = pool.isRunning
+	pool.lock.Unlock()
+
+	pool.Balancer.Update(upstreams)
+
+	pool.httpCacheCtxt.Stats.Upstream.PoolSize.Set(float64(len(upstreams)))
+
+	if isRunning && pool.httpCacheCtxt.Config.HealthCheck.Path != "" {
+		for _, upstream := range added {
+			go upstream.runHealthChecks(&pool.httpCacheCtxt.Config.HealthCheck)
+		}
+	}
+
+	for upstream := range removed {
+
+		upstream.Stop()
+		upstream.Transport.CloseIdleConnections()
+
+		// A replacement under the same name
+		// keeps the metrics it was set up with
+		if names[upstream.Name] {
+			continue
+		}
+
+		upstream.stats.Upstream.Healthy.DeleteLabelValues(upstream.Name)
+		upstream.stats.Upstream.CircuitState.DeletePartialMatch(prometheus.Labels{"upstream": upstream.Name})
+	}
+
+	if len(added) > 0 || len(removed) > 0 {
+
+		pool.httpCacheCtxt.Stats.Upstream.PoolUpdates.Inc()
+		pool.httpCacheCtxt.logger.WithFields(logrus.Fields{
+			"added":      len(added),
+			"removed":    len(removed),
+			"upstreams":  len(upstreams),
+			"event_type": "upstreams_updated",
+		}).Info("Upstreams of the pool updated")
+	}
+
+	return
+}
+
+// UpdateUpstreams sets the pool to the configured upstreams,
+// reusing the upstreams of the pool configured the same way
+func (pool *UpstreamPool) UpdateUpstreams(upstreamCfgs []UpstreamConfig) (err error) {
+
+	var (
+		current   map[string]*Upstream
+		upstreams []*Upstream
+	)
+
+	current = make(map[string]*Upstream)
+
+	for _, upstream := range pool.Upstreams() {
+		current[upstream.Name] = upstream
+	}
+
+	for idx := range upstreamCfgs {
+
+		var (
+			upstreamCfg = &upstreamCfgs[idx]
+			upstream    *Upstream
+			upstreamURL *url.URL
+			name        string
+		)
+
+		if name = upstreamCfg.Name; name == "" {
+			name = upstreamCfg.URL
+		}
+
+		if upstreamURL, err = parseUpstreamURL(upstreamCfg.URL); err != nil {
+			return
+		}
+
+		if upstream = current[name]; upstream == nil || !upstream.isConfiguredAs(upstreamCfg, upstreamURL) {
+
+			if upstream, err = NewUpstreamFromConfig(upstreamCfg); err != nil {
+				return
+			}
+		}
+
+		upstreams = append(upstreams, upstream)
+	}
+
+	err = pool.SetUpstreams(upstreams)
+
+	return
+}
+
+// isConfiguredAs tells whether the upstream is what the
+// config would build, down to its protocol and TLS
+func (upstream *Upstream) isConfiguredAs(upstreamCfg *UpstreamConfig, upstreamURL *url.URL) (isSame bool) {
+
+	var (
+		weight   = upstreamCfg.Weight
+		protocol = upstreamCfg.Protocol
+		tlsCfg   *UpstreamTLSConfig
+	)
+
+	if weight <= 0 {
+		weight = 1
+	}
+
+	if protocol == "" {
+		protocol = UpstreamProtocolHttp1
+	}
+
+	if upstream.URL.String() != upstreamURL.String() || upstream.Weight != weight || upstream.Protocol != protocol {
+		return
+	}
+
+	if upstream.TLSFiles != nil {
+		tlsCfg = upstream.TLSFiles.cfg
+	}
+
+	if (tlsCfg == nil) != (upstreamCfg.TLS == nil) {
+		return
+	}
+
+	// SetTLS fills in the reload interval
+	if tlsCfg != nil {
+
+		newTLSCfg := *upstreamCfg.TLS
+
+		if newTLSCfg.ReloadInterval <= 0 {
+			newTLSCfg.ReloadInterval = DefaultTLSReloadInterval
+		}
+
+		if newTLSCfg != *tlsCfg {
+			return
+		}
+	}
+
+	isSame = true
+
+	return
+}
+
+func (pool *UpstreamPool) Upstreams() (upstreams []*Upstream) {
+
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	upstreams = pool.upstreams
+
+	return
+}
+
+func (pool *UpstreamPool) Process() (err error) {
+
+	pool.lock.Lock()
+	pool.isRunning = true
+	pool.lock.Unlock()
+
+	if pool.Discovery != nil {
+		go pool.Discovery.Process(pool.stopCh)
+	}
+
+	if pool.httpCacheCtxt.Config.HealthCheck.Path == "" {
+		return
+	}
+
+	for _, upstream := range pool.Upstreams() {
+		go upstream.runHealthChecks(&pool.httpCacheCtxt.Config.HealthCheck)
+	}
+
+	return
+}
+
+func (pool *UpstreamPool) Stop() {
+	close(pool.stopCh)
+	return
+}
+
+// Pick chooses the upstream the request with the given key
+// is sent to, among the upstreams which are healthy, not
+// ejected and whose circuit is not open. The picked upstream
+// has been allowed by its circuit breaker
+func (pool *UpstreamPool) Pick(reqKey ReqKeyT) (upstream *Upstream, err error) {
+	upstream, err = pool.PickExcept(reqKey, nil)
+	return
+}
+
+// PickExcept is Pick leaving out the excluded upstream,
+// e.g. the one a request is already waiting on
+func (pool *UpstreamPool) PickExcept(reqKey ReqKeyT, excluded *Upstream) (upstream *Upstream, err error) {
+
+	var (
+		candidates []*Upstream
+		isOpen     bool
+	)
+
+	for _, candidate := range pool.Upstreams() {
+
+		if candidate == excluded || !candidate.IsAvailable() {
+			continue
+		}
+
+		if candidate.Breaker.IsOpen() {
+			isOpen = true
+			continue
+		}
+
+		candidates = append(candidates, candidate)
+	}
+
+	if upstream = pool.Balancer.Pick(reqKey, candidates); upstream == nil {
+
+		if err = (NoUpstreamError{}); isOpen {
+			err = CircuitOpenError{Upstream: "*"}
+		}
+
+		return
+	}
+
+	if err = upstream.Breaker.Allow(); err != nil {
+		upstream = nil
+		return
+	}
+
+	return
+}
+
+// mayEject tells if the upstream may be ejected without
+// going over the max ejection percent of the pool or leaving
+// it with no upstream available
+func (pool *UpstreamPool) mayEject(upstream *Upstream) (mayEject bool) {
+
+	var (
+		upstreams  []*Upstream
+		ejected    int
+		available  int
+		maxEjected int
+	)
+
+	upstreams = pool.Upstreams()
+
+	for _, other := range upstreams {
+
+		if other == upstream {
+			continue
+		}
+
+		if other.Health.IsEjected() {
+			ejected++
+		}
+
+		if other.IsAvailable() {
+			available++
+		}
+	}
+
+	maxEjected = len(upstreams) * pool.httpCacheCtxt.Config.OutlierDetection.MaxEjectionPercent / 100
+
+	mayEject = available > 0 && ejected < maxEjected
+
+	return
+}
+
+// initUpstream hooks the upstream to the stats and logger
+// and gives it its outlier detection and circuit breaker
+func (httpCacheCtxt *HttpCacheCtxt) initUpstream(upstream *Upstream) {
+
+	upstream.stats = httpCacheCtxt.Stats
+	upstream.logger = httpCacheCtxt.logger
+	upstream.Health = NewUpstreamHealth(upstream, &httpCacheCtxt.Config.OutlierDetection)
+	upstream.Breaker = NewCircuitBreaker(upstream, &httpCacheCtxt.Config.CircuitBreaker)
+
+	// A replaced upstream starts over under the same name, the
+	// states of the one it replaces are dropped
+	upstream.stats.Upstream.CircuitState.DeletePartialMatch(prometheus.Labels{"upstream": upstream.Name})
+
+	upstream.stats.Upstream.Healthy.WithLabelValues(upstream.Name).Set(1)
+	upstream.stats.Upstream.CircuitState.WithLabelValues(upstream.Name, CircuitClosed).Set(1)
+
+	return
+}
@@ -0,0 +1,85 @@
+package httpcache
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	PriorityHigh       = "high"
+	PriorityNormal     = "normal"
+	PriorityLow        = "low"
+	PriorityBackground = "background"
+
+	DefaultStarvationLimit = 10
+)
+
+var (
+	// PriorityClasses are the classes in the
+	// order they are served by the workers
+	PriorityClasses = []string{
+		PriorityHigh,
+		PriorityNormal,
+		PriorityLow,
+		PriorityBackground,
+	}
+)
+
+type (
+	// PriorityConfig lets trusted peers pick the class of a
+	// request with Header, overriding the class of its route.
+	// A queued class passed over StarvationLimit times in a row
+	// for higher classes is served next
+	PriorityConfig struct {
+		Header          string `json:"header"`
+		StarvationLimit int    `json:"starvation_limit"`
+	}
+)
+
+func isPriorityClass(class string) (isValid bool) {
+
+	for _, name := range PriorityClasses {
+		if name == class {
+			isValid = true
+			return
+		}
+	}
+
+	return
+}
+
+func validatePriority(class string) (err error) {
+
+	if class != "" && !isPriorityClass(class) {
+		err = errors.New("Unknown priority class " + class + ", use one of " + strings.Join(PriorityClasses, ", "))
+		return
+	}
+
+	return
+}
+
+// getPriority is the class of the request, from the priority
+// header of a trusted peer, else from its route
+func (httpCacheCtxt *HttpCacheCtxt) getPriority(req *http.Request, policy *RoutePolicy) (class string) {
+
+	var (
+		headerName string
+	)
+
+	if class = policy.Priority; class == "" {
+		class = PriorityNormal
+	}
+
+	if headerName = httpCacheCtxt.Config.Priority.Header; headerName == "" {
+		return
+	}
+
+	if value := strings.ToLower(strings.TrimSpace(req.Header.Get(headerName))); isPriorityClass(value) &&
+		httpCacheCtxt.ProxyCtxt.isTrustedProxy(getRemoteIP(req)) {
+
+		class = value
+	}
+
+	return
+}
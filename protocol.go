@@ -0,0 +1,116 @@
+package httpcache
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+const (
+	UpstreamProtocolHttp1 = "http1"
+	UpstreamProtocolH2    = "h2"
+	UpstreamProtocolH2c   = "h2c"
+)
+
+type (
+	// upstreamConn keeps the connection metrics of
+	// the upstream up to date
+	upstreamConn struct {
+		net.Conn
+
+		upstream  *Upstream
+		closeOnce *sync.Once
+	}
+)
+
+// SetProtocol picks the protocol spoken to the upstream.
+// http1 is the default, h2 negotiates HTTP/2 over TLS and
+// falls back to HTTP/1.1, h2c speaks cleartext HTTP/2 with
+// prior knowledge, over TCP or the unix socket. With HTTP/2
+// the concurrent requests share multiplexed connections
+func (upstream *Upstream) SetProtocol(protocol string) (err error) {
+
+	var (
+		protocols *http.Protocols
+	)
+
+	protocols = &http.Protocols{}
+
+	switch protocol {
+
+	case "", UpstreamProtocolHttp1:
+		protocol = UpstreamProtocolHttp1
+		protocols.SetHTTP1(true)
+
+	case UpstreamProtocolH2:
+
+		if upstream.BaseURL.Scheme != UpstreamSchemeHttps {
+			err = errors.New("Upstream " + upstream.Name + " needs an https URL for h2, h2c is HTTP/2 without TLS")
+			return
+		}
+
+		protocols.SetHTTP1(true)
+		protocols.SetHTTP2(true)
+		upstream.Transport.ForceAttemptHTTP2 = true
+
+	case UpstreamProtocolH2c:
+
+		if upstream.BaseURL.Scheme != UpstreamSchemeHttp {
+			err = errors.New("Upstream " + upstream.Name + " needs an http or unix URL for h2c")
+			return
+		}
+
+		protocols.SetUnencryptedHTTP2(true)
+
+	default:
+		err = errors.New("Unknown protocol " + protocol + " for upstream " + upstream.Name)
+		return
+	}
+
+	upstream.Protocol = protocol
+	upstream.Transport.Protocols = protocols
+
+	// Upgrades are sent over HTTP/1.1 connections of their
+	// own, an h2c upstream has to accept HTTP/1.1 as well
+	if upstream.Http1Client = upstream.Client; protocol != UpstreamProtocolHttp1 {
+
+		var (
+			transport = upstream.Transport.Clone()
+		)
+
+		transport.ForceAttemptHTTP2 = false
+		transport.Protocols = &http.Protocols{}
+		transport.Protocols.SetHTTP1(true)
+
+		upstream.Http1Client = newUpstreamClient(transport)
+	}
+
+	return
+}
+
+func (upstream *Upstream) trackConn(conn net.Conn) (tracked net.Conn) {
+
+	upstream.stats.Upstream.Connections.WithLabelValues(upstream.Name).Inc()
+	upstream.stats.Upstream.ConnectionsOpened.WithLabelValues(upstream.Name).Inc()
+
+	tracked = &upstreamConn{
+		Conn: conn,
+
+		upstream:  upstream,
+		closeOnce: &sync.Once{},
+	}
+
+	return
+}
+
+func (conn *upstreamConn) Close() (err error) {
+
+	err = conn.Conn.Close()
+
+	conn.closeOnce.Do(func() {
+		conn.upstream.stats.Upstream.Connections.WithLabelValues(conn.upstream.Name).Dec()
+	})
+
+	return
+}
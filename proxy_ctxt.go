@@ -3,36 +3,81 @@ package httpcache
 import (
 	"context"
 	"errors"
-	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"runtime"
-	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 const (
-	WorkerInpSize     = 20000
 	DefaultNofWorkers = 3
+	DefaultMaxTunnels = 1024
 )
 
 type (
+	// ProxyCtxt sends the proxied requests upstream through
+	// a fixed set of workers. Requests wait in Queue for the
+	// first free worker and get the response back on their
+	// own reply channel
 	ProxyCtxt struct {
 		httpCacheCtxt *HttpCacheCtxt
 
+		Pool        *UpstreamPool
+		Mirror      *Mirror
+		RetryBudget *LoadBudget
+		HedgeBudget *LoadBudget
+		Queue       *JobQueue
+		Limiter     *ConcurrencyLimiter
+
+		RequestHeaders *HeaderPolicy
+		TrustedProxies []*net.IPNet
+
 		NoOfWorkers int
 		Workers     []*ProxyWorker
 
-		quitCh chan bool
+		tunnels int64
+		quitCh  chan bool
 	}
 
 	ProxyWorker struct {
-		Id    int
-		InpCh chan *http.Request
-		OutCh chan *http.Response
+		Id int
+
+		proxyCtxt *ProxyCtxt
+	}
+
+	// proxyJob is a request waiting for its response. Its
+	// context carries the total timeout from the time the
+	// request is queued
+	proxyJob struct {
+		req      *http.Request
+		cacheReq *CacheReq
+		replyCh  chan *proxyResult
+		queuedAt time.Time
+
+		ctx      context.Context
+		cancel   context.CancelFunc
+		timeouts TimeoutConfig
+		started  int32
+
+		// A job waiting to be retried is queued again with
+		// the response of its last attempt, which is given
+		// back when the retry can't be made
+		header   http.Header
+		mirrorCh chan *mirrorResult
+		retries  int
+		lastResp *http.Response
+		lastErr  error
+	}
 
-		proxyClient *http.Client
+	proxyResult struct {
+		resp *http.Response
+		err  error
 	}
 )
 
@@ -50,20 +95,44 @@ func NewProxyCtxt(httpCacheCtxt *HttpCacheCtxt) (proxyCtxt *ProxyCtxt, err error
 		proxyCtxt.NoOfWorkers = proxyCtxt.httpCacheCtxt.Config.Proxy.NoOfWorkers
 	}
 
+	if proxyCtxt.Pool, err = NewUpstreamPool(httpCacheCtxt); err != nil {
+		return
+	}
+
+	if proxyCtxt.TrustedProxies, err = parseTrustedProxies(httpCacheCtxt.Config.Forwarding.TrustedProxies); err != nil {
+		return
+	}
+
+	if proxyCtxt.RequestHeaders, err = NewHeaderPolicy(&httpCacheCtxt.Config.RequestHeaders); err != nil {
+		return
+	}
+
+	if proxyCtxt.Mirror, err = NewMirror(httpCacheCtxt); err != nil {
+		return
+	}
+
+	proxyCtxt.RetryBudget = NewLoadBudget(httpCacheCtxt.Config.Retry.BudgetRatio,
+		httpCacheCtxt.Config.Retry.MinPerSecond)
+
+	// Hedged requests have no minimum, they only
+	// ever add the configured share of extra load
+	proxyCtxt.HedgeBudget = NewLoadBudget(httpCacheCtxt.Config.Hedging.BudgetRatio, 0)
+
+	if proxyCtxt.Limiter, err = NewConcurrencyLimiter(&httpCacheCtxt.Config.ConcurrencyLimit,
+		httpCacheCtxt.Stats); err != nil {
+
+		return
+	}
+
+	proxyCtxt.Queue = NewJobQueue(httpCacheCtxt.Config.Proxy.QueueSize,
+		httpCacheCtxt.Config.Proxy.TenantQueueSize, httpCacheCtxt.Config.Priority.StarvationLimit)
+
 	for idx := 0; idx < proxyCtxt.NoOfWorkers; idx++ {
 
 		proxyCtxt.Workers = append(proxyCtxt.Workers, &ProxyWorker{
-			Id:    idx,
-			InpCh: make(chan *http.Request, WorkerInpSize),
-			OutCh: make(chan *http.Response, WorkerInpSize),
-
-			proxyClient: &http.Client{
-				Transport: &http.Transport{
-					DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
-						return net.Dial("unix", proxyCtxt.httpCacheCtxt.Config.Server.RemoteHost)
-					},
-				},
-			},
+			Id: idx,
+
+			proxyCtxt: proxyCtxt,
 		})
 
 	}
@@ -71,114 +140,447 @@ func NewProxyCtxt(httpCacheCtxt *HttpCacheCtxt) (proxyCtxt *ProxyCtxt, err error
 	return
 }
 
-func (proxyCtxt *ProxyCtxt) getNextWorkerIdx() (workerIdx int) {
-	workerIdx = int(time.Now().Unix() % int64(proxyCtxt.NoOfWorkers))
-	return
-}
-
 func (proxyCtxt *ProxyCtxt) Process() (err error) {
 
 	for _, worker := range proxyCtxt.Workers {
 		go worker.Process()
 	}
 
+	if err = proxyCtxt.Pool.Process(); err != nil {
+		return
+	}
+
 	<-proxyCtxt.quitCh
 
+	proxyCtxt.Queue.Close()
+	proxyCtxt.Pool.Stop()
+
 	return
 }
 
-func (proxyCtxt *ProxyCtxt) Send(req *http.Request) (resp *http.Response, err error) {
-
-	defer func() {
-		if r := recover(); r != nil {
-			log.Println("Recovered while sending request", r)
-			err = errors.New("Failure to proxy request")
-		}
-	}()
+// Send queues the request for the workers and waits for its
+// response. A request whose client goes away stops waiting,
+// the response it may still get is then discarded
+func (proxyCtxt *ProxyCtxt) Send(req *http.Request, cacheReq *CacheReq) (resp *http.Response, err error) {
 
 	var (
-		workerIdx int
-		worker    *ProxyWorker
-
-		reqKey ReqKeyT
+		job       *proxyJob
+		result    *proxyResult
+		startTime time.Time
+		isTimeout bool
 	)
 
-	reqKey = ReqKeyT(req.FormValue("uuid"))
+	if err = proxyCtxt.Limiter.Acquire(); err != nil {
+
+		proxyCtxt.httpCacheCtxt.logger.WithFields(logrus.Fields{
+			"tenant":     cacheReq.TenantName,
+			"req_key":    cacheReq.ReqKey,
+			"event_type": "proxy_shed",
+		}).Warn("Concurrency limit reached, request shed")
 
-	if reqKey == "" {
-		err = errors.New("No CP found in the request body")
 		return
 	}
 
-	workerIdx = proxyCtxt.getNextWorkerIdx()
+	startTime = time.Now()
+
+	job = &proxyJob{
+		req:      req,
+		cacheReq: cacheReq,
+		replyCh:  make(chan *proxyResult, 1),
+
+		timeouts: proxyCtxt.getTimeouts(cacheReq.Policy),
+	}
+
+	if job.ctx, job.cancel = req.Context(), func() {}; job.timeouts.Total > 0 {
+		job.ctx, job.cancel = context.WithTimeoutCause(job.ctx, time.Duration(job.timeouts.Total)*time.Millisecond,
+			UpstreamTimeoutError{Phase: TimeoutPhaseTotal})
+	}
+
+	if err = proxyCtxt.enqueue(job); err != nil {
+
+		job.cancel()
+		proxyCtxt.Limiter.Cancel()
+		proxyCtxt.httpCacheCtxt.Stats.Proxy.Rejected.WithLabelValues(cacheReq.TenantName).Inc()
+
+		proxyCtxt.httpCacheCtxt.logger.WithFields(logrus.Fields{
+			"tenant":     cacheReq.TenantName,
+			"req_key":    cacheReq.ReqKey,
+			"priority":   job.priority(),
+			"event_type": "proxy_rejected",
+		}).Warn("Proxy queue full, request rejected")
 
-	if worker = proxyCtxt.Workers[workerIdx]; worker == nil {
-		err = errors.New("Worker not found with ID " + strconv.Itoa(workerIdx))
 		return
 	}
 
-	if len(worker.InpCh) > (WorkerInpSize-1000) ||
-		len(worker.OutCh) > (WorkerInpSize-1000) {
+	select {
+
+	case result = <-job.replyCh:
+
+		proxyCtxt.Limiter.Release(time.Since(startTime), isDropped(result))
+
+	case <-job.ctx.Done():
+
+		err = getTimeoutError(job.ctx, job.ctx.Err())
+
+		// A request which ran out of time is the clearest
+		// sign of overload, unlike a client going away
+		if _, isTimeout = err.(UpstreamTimeoutError); isTimeout {
+			proxyCtxt.Limiter.Release(time.Since(startTime), true)
+		}
+
+		go proxyCtxt.discardResult(job, isTimeout)
+
+		// A request which ran out of time before
+		// a worker took it is told apart
+		if isTimeout && atomic.LoadInt32(&job.started) == 0 {
+			err = UpstreamTimeoutError{Phase: TimeoutPhaseQueue}
+		}
 
-		err = errors.New("Worker busy, canceling request")
 		return
 	}
 
-	worker.InpCh <- req
+	if resp, err = result.resp, result.err; resp == nil && err == nil {
+		err = errors.New("Failure to proxy request")
+		return
+	}
 
-	resp = <-worker.OutCh
+	return
+}
+
+func (proxyCtxt *ProxyCtxt) enqueue(job *proxyJob) (err error) {
+
+	job.queuedAt = time.Now()
+
+	if err = proxyCtxt.Queue.Push(job); err != nil {
+		return
+	}
+
+	proxyCtxt.httpCacheCtxt.Stats.Proxy.Queued.Inc()
+	proxyCtxt.httpCacheCtxt.Stats.Proxy.QueuedByPriority.WithLabelValues(job.priority()).Inc()
+
+	return
+}
+
+// priority is the class the job is queued in,
+// normal when the request has none
+func (job *proxyJob) priority() (class string) {
+
+	if class = job.cacheReq.Priority; class == "" {
+		class = PriorityNormal
+	}
+
+	return
+}
+
+// discardResult waits for the response nobody waits for
+// anymore, giving back the admission unless it was released
+func (proxyCtxt *ProxyCtxt) discardResult(job *proxyJob, isReleased bool) {
+
+	var (
+		result *proxyResult
+	)
+
+	result = <-job.replyCh
+
+	if !isReleased {
+		proxyCtxt.Limiter.Cancel()
+	}
+
+	if result.resp != nil {
+		result.resp.Body.Close()
+	}
+
+	job.cancel()
 
 	return
 }
 
 func (proxyWorker *ProxyWorker) Process() (err error) {
 
+	var (
+		job *proxyJob
+	)
+
 	log.Println("Starting Worker with ID", proxyWorker.Id)
 
 	for {
-		select {
-		case req := <-proxyWorker.InpCh:
+		if job = proxyWorker.proxyCtxt.Queue.Pop(); job == nil {
+			return
+		}
+
+		atomic.StoreInt32(&job.started, 1)
 
-			var (
-				resp *http.Response
-			)
+		proxyWorker.proxyCtxt.httpCacheCtxt.Stats.Proxy.Queued.Dec()
+		proxyWorker.proxyCtxt.httpCacheCtxt.Stats.Proxy.QueuedByPriority.WithLabelValues(job.priority()).Dec()
+		proxyWorker.proxyCtxt.httpCacheCtxt.Stats.Proxy.QueueWait.WithLabelValues(job.priority()).Observe(
+			time.Since(job.queuedAt).Seconds())
 
-			resp, err = proxyWorker.proxyRequest(req)
+		// A job backing off before its retry
+		// is replied to once it is done
+		if result := proxyWorker.handle(job); result != nil {
+			job.replyCh <- result
+		}
+	}
+}
 
-			proxyWorker.OutCh <- resp
+// handle runs the job, a panic while proxying fails
+// the job without taking the worker down
+func (proxyWorker *ProxyWorker) handle(job *proxyJob) (result *proxyResult) {
+
+	var (
+		proxyCtxt    = proxyWorker.proxyCtxt
+		resp         *http.Response
+		isBackingOff bool
+		err          error
+	)
 
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("Recovered while sending request", r)
+			result = proxyCtxt.finish(job, nil, errors.New("Failure to proxy request"))
 		}
+	}()
+
+	// Nobody waits for the requests whose client went
+	// away or whose time ran out while they were queued
+	if err = job.ctx.Err(); err != nil {
+		discardResponse(job.lastResp)
+		result = proxyCtxt.finish(job, nil, getTimeoutError(job.ctx, err))
+		return
 	}
+
+	if resp, isBackingOff, err = proxyWorker.proxyJob(job); isBackingOff {
+		return
+	}
+
+	result = proxyCtxt.finish(job, resp, err)
+
 	return
 }
 
-func (proxyWorker *ProxyWorker) proxyRequest(req *http.Request) (resp *http.Response, err error) {
+// finish ties the context of the job to the body of its
+// response, which a mirrored request may be waiting for
+func (proxyCtxt *ProxyCtxt) finish(job *proxyJob, resp *http.Response, err error) (result *proxyResult) {
+
+	if resp == nil {
+		job.cancel()
+	} else {
+		resp.Body = &upstreamBody{
+			ReadCloser: resp.Body,
+
+			closeOnce: &sync.Once{},
+			onClose:   job.cancel,
+		}
+	}
+
+	if job.mirrorCh != nil {
+		proxyCtxt.Mirror.capture(resp, job.mirrorCh)
+	}
+
+	result = &proxyResult{
+		resp: resp,
+		err:  err,
+	}
+
+	return
+}
+
+// proxyJob sends the request to the picked upstream, hedging
+// the slow attempts of hedged routes. When allowed by the retry
+// policy a failed attempt is retried on another upstream, the
+// job then waits for its backoff outside of the worker. The
+// whole job is bounded by the total timeout of the route
+func (proxyWorker *ProxyWorker) proxyJob(job *proxyJob) (resp *http.Response, isBackingOff bool, err error) {
 
 	var (
-		apiName string
+		proxyCtxt   = proxyWorker.proxyCtxt
+		upstream    *Upstream
+		isRetryable bool
+		isHedgeable bool
+	)
 
-		proxyReq *http.Request
+	// The upstream is picked once a worker is free, based on
+	// the state of the pool at that time. A retry finding no
+	// upstream gives the response of the last attempt instead
+	if upstream, err = proxyCtxt.Pool.Pick(job.cacheReq.ReqKey); err != nil {
+		if job.retries > 0 {
+			resp, err = job.lastResp, job.lastErr
+		}
+
+		return
+	}
+
+	isRetryable = proxyCtxt.isRetryable(job)
+	isHedgeable = proxyCtxt.isHedgeable(job)
+
+	if job.retries == 0 {
+
+		job.header = proxyCtxt.buildRequestHeader(job.req, job.cacheReq)
+		job.mirrorCh = proxyCtxt.Mirror.Send(job.req, job.header)
+
+		proxyCtxt.RetryBudget.RecordRequest()
+
+		// The hedge budget is a share of the
+		// requests which may be hedged
+		if isHedgeable {
+			proxyCtxt.HedgeBudget.RecordRequest()
+		}
+
+	} else {
+
+		discardResponse(job.lastResp)
+		job.lastResp, job.lastErr = nil, nil
+
+		proxyCtxt.httpCacheCtxt.Stats.Counter.Retries.Inc()
+
+		proxyCtxt.httpCacheCtxt.logger.WithFields(logrus.Fields{
+			"upstream":   upstream.Name,
+			"retry":      job.retries,
+			"event_type": "upstream_retry",
+		}).Info("Retrying upstream request")
+	}
+
+	if isHedgeable {
+		resp, err = proxyWorker.hedgeRequest(job.ctx, job, job.header, upstream, &job.timeouts)
+	} else {
+		resp, err = proxyWorker.proxyRequest(job.ctx, job.req, job.header, upstream, &job.timeouts)
+	}
+
+	if !isRetryable || job.retries >= proxyCtxt.httpCacheCtxt.Config.Retry.MaxRetries ||
+		job.ctx.Err() != nil || !proxyCtxt.shouldRetry(resp, err) {
+
+		return
+	}
+
+	if !proxyCtxt.RetryBudget.Withdraw() {
+		proxyCtxt.httpCacheCtxt.Stats.Counter.RetriesExhausted.Inc()
+		return
+	}
+
+	job.retries++
+	job.lastResp, job.lastErr = resp, err
+
+	resp, err = nil, nil
+	isBackingOff = true
+
+	go proxyCtxt.retryLater(job, proxyCtxt.getBackoff(job.retries))
+
+	return
+}
+
+// retryLater queues the job again once its backoff is over.
+// When its time runs out first, or the queue is full, the job
+// is done with the response of its last attempt
+func (proxyCtxt *ProxyCtxt) retryLater(job *proxyJob, backoff time.Duration) {
+
+	var (
+		timer *time.Timer
 	)
 
-	apiName = req.URL.String()
+	timer = time.NewTimer(backoff)
+	defer timer.Stop()
+
+	select {
 
-	proxyReq, _ = http.NewRequest(req.Method,
-		"http://unix"+apiName, req.Body)
+	case <-job.ctx.Done():
 
-	proxyReq.Header.Set("Host", req.Host)
-	proxyReq.Header.Set("X-Forwarded-For", req.RemoteAddr)
-	proxyReq.Header.Set("Authorization",
-		fmt.Sprintf("X-LAVELLE-AUTH sessionid=%s", req.Header.Get("Authorization")))
+		discardResponse(job.lastResp)
+		job.replyCh <- proxyCtxt.finish(job, nil, getTimeoutError(job.ctx, job.ctx.Err()))
 
-	for header, values := range req.Header {
-		for _, value := range values {
-			proxyReq.Header.Add(header, value)
+		return
+
+	case <-timer.C:
+	}
+
+	if err := proxyCtxt.enqueue(job); err != nil {
+		job.replyCh <- proxyCtxt.finish(job, job.lastResp, job.lastErr)
+	}
+
+	return
+}
+
+// proxyRequest makes a single attempt on the upstream,
+// bounded by the connect and header timeouts
+func (proxyWorker *ProxyWorker) proxyRequest(ctx context.Context, req *http.Request, header http.Header,
+	upstream *Upstream, timeouts *TimeoutConfig) (resp *http.Response, err error) {
+
+	var (
+		proxyReq *http.Request
+		body     io.ReadCloser
+		cancel   context.CancelCauseFunc
+		timer    *time.Timer
+	)
+
+	// The original body has been drained while reading the
+	// cache key, the buffered copy is replayed instead
+	if body = req.Body; req.GetBody != nil {
+		if body, err = req.GetBody(); err != nil {
+			upstream.Breaker.Cancel()
+			return
 		}
 	}
 
-	if resp, err = proxyWorker.proxyClient.Do(proxyReq); err != nil {
+	ctx, cancel = context.WithCancelCause(withConnectTimeout(ctx, timeouts.Connect))
+
+	if proxyReq, err = newUpstreamRequest(ctx, req, header, upstream, body); err != nil {
+		cancel(nil)
+		upstream.Breaker.Cancel()
 		return
 	}
 
+	proxyReq.ContentLength = req.ContentLength
+	proxyReq.GetBody = req.GetBody
+
+	if timeouts.Header > 0 {
+		timer = time.AfterFunc(time.Duration(timeouts.Header)*time.Millisecond, func() {
+			cancel(UpstreamTimeoutError{Phase: TimeoutPhaseHeader})
+		})
+	}
+
+	resp, err = upstream.Do(proxyReq)
+
+	// The headers which made it just as the timer fired
+	// come with a body which can't be read anymore
+	if timer != nil && !timer.Stop() && err == nil {
+		resp.Body.Close()
+		resp, err = nil, context.Cause(ctx)
+	}
+
+	if err != nil {
+		cancel(nil)
+		err = getTimeoutError(ctx, err)
+		return
+	}
+
+	resp.Body = &upstreamBody{
+		ReadCloser: resp.Body,
+
+		closeOnce: &sync.Once{},
+		onClose:   func() { cancel(nil) },
+	}
+
+	return
+}
+
+// newUpstreamRequest is the client request aimed at the
+// upstream, with the header built for it
+func newUpstreamRequest(ctx context.Context, req *http.Request, header http.Header,
+	upstream *Upstream, body io.Reader) (proxyReq *http.Request, err error) {
+
+	if proxyReq, err = http.NewRequestWithContext(ctx, req.Method,
+		upstream.RequestURL(req.URL).String(), body); err != nil {
+
+		return
+	}
+
+	proxyReq.Header = header.Clone()
+
+	// The host is not a header of the request, a rule
+	// setting it overrides the host of the upstream
+	if host := proxyReq.Header.Get("Host"); host != "" {
+		proxyReq.Host = host
+		proxyReq.Header.Del("Host")
+	}
+
 	return
 }
@@ -0,0 +1,151 @@
+package httpcache
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestCacheReq(httpCacheCtxt *HttpCacheCtxt, reqKey string) (cacheReq *CacheReq) {
+
+	cacheReq = &CacheReq{
+		Policy:     httpCacheCtxt.DefaultPolicy,
+		TenantName: DefaultTenantName,
+		ReqKey:     ReqKeyT(reqKey),
+		ApiName:    "/test",
+	}
+
+	return
+}
+
+func TestProxyCtxtSendPairsResponses(t *testing.T) {
+
+	var (
+		upstream      *httptest.Server
+		httpCacheCtxt *HttpCacheCtxt
+		wg            *sync.WaitGroup
+		cfg           = &Config{}
+	)
+
+	// Responses come back out of order, each
+	// one echoing the id of its request
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(time.Duration(rand.Intn(2000)) * time.Microsecond)
+		w.Write([]byte(req.Header.Get("X-Request-Id")))
+	}))
+	defer upstream.Close()
+
+	cfg.Server.RemoteHost = upstream.URL
+	cfg.Proxy.NoOfWorkers = 8
+
+	httpCacheCtxt = newTestHttpCacheCtxt(t, cfg)
+
+	wg = &sync.WaitGroup{}
+
+	for idx := 0; idx < 500; idx++ {
+
+		wg.Add(1)
+
+		go func(id string) {
+
+			var (
+				req  *http.Request
+				resp *http.Response
+				body []byte
+				err  error
+			)
+
+			defer wg.Done()
+
+			req = httptest.NewRequest(http.MethodGet, "/test?id="+id, nil)
+			req.Header.Set("X-Request-Id", id)
+
+			if resp, err = httpCacheCtxt.ProxyCtxt.Send(req, newTestCacheReq(httpCacheCtxt, id)); err != nil {
+				t.Errorf("Request %s failed: %v", id, err)
+				return
+			}
+
+			defer resp.Body.Close()
+
+			if body, err = ioutil.ReadAll(resp.Body); err != nil {
+				t.Errorf("Reading the response of %s failed: %v", id, err)
+				return
+			}
+
+			if string(body) != id {
+				t.Errorf("Request %s got the response of %s", id, body)
+			}
+		}(strconv.Itoa(idx))
+	}
+
+	wg.Wait()
+}
+
+func TestProxyCtxtSendQueueTimeout(t *testing.T) {
+
+	var (
+		upstream      *httptest.Server
+		httpCacheCtxt *HttpCacheCtxt
+		releaseCh     chan struct{}
+		blockedCh     chan error
+		slowPolicy    *RoutePolicy
+		err           error
+		cfg           = &Config{}
+	)
+
+	releaseCh = make(chan struct{})
+
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-releaseCh
+	}))
+	defer upstream.Close()
+	defer close(releaseCh)
+
+	cfg.Server.RemoteHost = upstream.URL
+	cfg.Proxy.NoOfWorkers = 1
+	cfg.Timeouts.Total = 200
+
+	httpCacheCtxt = newTestHttpCacheCtxt(t, cfg)
+
+	// The only worker is kept busy by the first request,
+	// which has more time, the second one runs out of time
+	// in the queue
+	if slowPolicy, err = NewRoutePolicy(&RouteConfig{
+		Name:     "slow",
+		Timeouts: TimeoutConfig{Total: 1000},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	blockedCh = make(chan error, 1)
+
+	go func() {
+		cacheReq := newTestCacheReq(httpCacheCtxt, "blocked")
+		cacheReq.Policy = slowPolicy
+
+		_, err := httpCacheCtxt.ProxyCtxt.Send(httptest.NewRequest(http.MethodGet, "/test", nil), cacheReq)
+		blockedCh <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	_, err = httpCacheCtxt.ProxyCtxt.Send(httptest.NewRequest(http.MethodGet, "/test", nil),
+		newTestCacheReq(httpCacheCtxt, "queued"))
+
+	if err != (UpstreamTimeoutError{Phase: TimeoutPhaseQueue}) {
+		t.Fatalf("Queued request failed with %v instead of a queue timeout", err)
+	}
+
+	if getErrorStatus(err) != http.StatusGatewayTimeout {
+		t.Fatalf("Queue timeout maps to %d", getErrorStatus(err))
+	}
+
+	if err = <-blockedCh; err != (UpstreamTimeoutError{Phase: TimeoutPhaseTotal}) {
+		t.Fatalf("Running request failed with %v instead of a total timeout", err)
+	}
+}
@@ -0,0 +1,230 @@
+package httpcache
+
+import (
+	"container/list"
+	"sync"
+)
+
+const (
+	DefaultQueueSize        = 20000
+	DefaultTenantQueueShare = 4
+)
+
+type (
+	// JobQueue holds the requests waiting for a proxy worker.
+	// The requests are queued by priority class, the workers
+	// serving the higher classes first. A class passed over
+	// StarvationLimit times in a row is served next, so the
+	// lower classes still make progress under load. Within a
+	// class every tenant has its own queue and the workers take
+	// from the tenants in turn, so a busy tenant can neither
+	// fill the queue nor delay the requests of the others. A
+	// tenant holds at most TenantSize requests, the queues
+	// together at most Size
+	JobQueue struct {
+		Size            int
+		TenantSize      int
+		StarvationLimit int
+
+		classes   map[string]*classQueue
+		tenantLen map[string]int
+		length    int
+		closed    bool
+
+		lock *sync.Mutex
+		cond *sync.Cond
+	}
+
+	classQueue struct {
+		queues  map[string]*list.List
+		order   []string
+		next    int
+		length  int
+		skipped int
+	}
+)
+
+func NewJobQueue(size int, tenantSize int, starvationLimit int) (queue *JobQueue) {
+
+	queue = &JobQueue{
+		Size:            size,
+		TenantSize:      tenantSize,
+		StarvationLimit: starvationLimit,
+
+		classes:   make(map[string]*classQueue),
+		tenantLen: make(map[string]int),
+
+		lock: &sync.Mutex{},
+	}
+
+	for _, class := range PriorityClasses {
+		queue.classes[class] = &classQueue{
+			queues: make(map[string]*list.List),
+		}
+	}
+
+	queue.cond = sync.NewCond(queue.lock)
+
+	return
+}
+
+// Push admits the job, failing with a ProxyBusyError
+// when the queue or the queue of its tenant is full
+func (queue *JobQueue) Push(job *proxyJob) (err error) {
+
+	var (
+		tenant  string
+		class   *classQueue
+		pending *list.List
+		isFound bool
+	)
+
+	tenant = job.cacheReq.TenantName
+	class = queue.classes[job.priority()]
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	if queue.closed || queue.length >= queue.Size {
+		err = ProxyBusyError{}
+		return
+	}
+
+	if queue.tenantLen[tenant] >= queue.TenantSize {
+		err = ProxyBusyError{Tenant: tenant}
+		return
+	}
+
+	if pending, isFound = class.queues[tenant]; !isFound {
+		pending = list.New()
+		class.queues[tenant] = pending
+		class.order = append(class.order, tenant)
+	}
+
+	pending.PushBack(job)
+	class.length++
+
+	queue.tenantLen[tenant]++
+	queue.length++
+
+	queue.cond.Signal()
+
+	return
+}
+
+// Pop waits for the next job, taking from the highest class
+// unless a lower one is starving. It returns nil once the
+// queue is closed
+func (queue *JobQueue) Pop() (job *proxyJob) {
+
+	var (
+		picked  string
+		class   *classQueue
+		isLower bool
+	)
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	for queue.length == 0 {
+
+		if queue.closed {
+			return
+		}
+
+		queue.cond.Wait()
+	}
+
+	for _, name := range PriorityClasses {
+		if class = queue.classes[name]; class.length > 0 && class.skipped >= queue.StarvationLimit {
+			picked = name
+			break
+		}
+	}
+
+	if picked == "" {
+		for _, name := range PriorityClasses {
+			if queue.classes[name].length > 0 {
+				picked = name
+				break
+			}
+		}
+	}
+
+	for _, name := range PriorityClasses {
+
+		if class = queue.classes[name]; name == picked {
+			isLower = true
+			class.skipped = 0
+			continue
+		}
+
+		if isLower && class.length > 0 {
+			class.skipped++
+		}
+	}
+
+	job = queue.classes[picked].pop()
+
+	if queue.tenantLen[job.cacheReq.TenantName]--; queue.tenantLen[job.cacheReq.TenantName] == 0 {
+		delete(queue.tenantLen, job.cacheReq.TenantName)
+	}
+
+	queue.length--
+
+	return
+}
+
+// pop takes the next job of the class from
+// its tenants in turn
+func (class *classQueue) pop() (job *proxyJob) {
+
+	var (
+		tenant  string
+		pending *list.List
+	)
+
+	if class.next >= len(class.order) {
+		class.next = 0
+	}
+
+	tenant = class.order[class.next]
+	pending = class.queues[tenant]
+
+	job = pending.Remove(pending.Front()).(*proxyJob)
+	class.length--
+
+	// Tenants without pending jobs leave the rotation,
+	// the next tenant then takes their place
+	if pending.Len() == 0 {
+		delete(class.queues, tenant)
+		class.order = append(class.order[:class.next], class.order[class.next+1:]...)
+	} else {
+		class.next++
+	}
+
+	return
+}
+
+func (queue *JobQueue) Len() (length int) {
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	length = queue.length
+
+	return
+}
+
+// Close wakes up the waiting workers, the jobs
+// still queued are handed out first
+func (queue *JobQueue) Close() {
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	queue.closed = true
+	queue.cond.Broadcast()
+
+	return
+}
@@ -0,0 +1,142 @@
+package httpcache
+
+import (
+	"strings"
+	"testing"
+)
+
+// newTestJob is a job of the tenant and class, named after
+// its key. Names are the tenant and an index, like a1
+func newTestJob(class string, name string) (job *proxyJob) {
+
+	job = &proxyJob{
+		cacheReq: &CacheReq{
+			ReqKey:     ReqKeyT(name),
+			TenantName: name[:1],
+			Priority:   class,
+		},
+	}
+
+	return
+}
+
+func TestJobQueueOrder(t *testing.T) {
+
+	var (
+		testCases = []struct {
+			name            string
+			starvationLimit int
+			// jobs are pushed in order, as class:name
+			jobs []string
+			pops string
+		}{
+			{
+				name:            "higher classes first",
+				starvationLimit: 10,
+				jobs:            []string{"normal:a1", "background:a2", "low:a3", "high:a4", ":a5"},
+				pops:            "a4 a1 a5 a3 a2",
+			},
+			{
+				name:            "starving class served",
+				starvationLimit: 2,
+				jobs:            []string{"high:a1", "high:a2", "high:a3", "high:a4", "high:a5", "low:b1"},
+				pops:            "a1 a2 b1 a3 a4 a5",
+			},
+			{
+				name:            "starving classes served in order",
+				starvationLimit: 2,
+				jobs:            []string{"high:a1", "high:a2", "high:a3", "high:a4", "normal:b1", "low:c1"},
+				pops:            "a1 a2 b1 c1 a3 a4",
+			},
+			{
+				name:            "limit of one alternates",
+				starvationLimit: 1,
+				jobs:            []string{"low:a1", "low:a2", "normal:b1", "normal:b2"},
+				pops:            "b1 a1 b2 a2",
+			},
+			{
+				name:            "tenants in turn",
+				starvationLimit: 10,
+				jobs:            []string{"normal:a1", "normal:a2", "normal:a3", "normal:b1", "normal:c1", "normal:c2"},
+				pops:            "a1 b1 c1 a2 c2 a3",
+			},
+		}
+	)
+
+	for _, testCase := range testCases {
+
+		var (
+			queue = NewJobQueue(100, 100, testCase.starvationLimit)
+			pops  []string
+		)
+
+		for _, job := range testCase.jobs {
+
+			class, name, _ := strings.Cut(job, ":")
+
+			if err := queue.Push(newTestJob(class, name)); err != nil {
+				t.Fatalf("%s: %s refused with %v", testCase.name, job, err)
+			}
+		}
+
+		for queue.Len() > 0 {
+			pops = append(pops, string(queue.Pop().cacheReq.ReqKey))
+		}
+
+		if strings.Join(pops, " ") != testCase.pops {
+			t.Errorf("%s: popped %v instead of %s", testCase.name, pops, testCase.pops)
+		}
+	}
+}
+
+func TestJobQueueLimits(t *testing.T) {
+
+	var (
+		queue = NewJobQueue(3, 2, DefaultStarvationLimit)
+		err   error
+	)
+
+	testCases := []struct {
+		job string
+		err error
+	}{
+		{"a1", nil},
+		{"a2", nil},
+		{"a3", ProxyBusyError{Tenant: "a"}},
+		{"b1", nil},
+		{"c1", ProxyBusyError{}},
+	}
+
+	for _, testCase := range testCases {
+		if err = queue.Push(newTestJob(PriorityNormal, testCase.job)); err != testCase.err {
+			t.Fatalf("%s: pushed with %v instead of %v", testCase.job, err, testCase.err)
+		}
+	}
+
+	// Popping frees the place of the tenant
+	if job := queue.Pop(); job.cacheReq.ReqKey != "a1" {
+		t.Fatalf("Popped %s instead of a1", job.cacheReq.ReqKey)
+	}
+
+	if err = queue.Push(newTestJob(PriorityNormal, "a3")); err != nil {
+		t.Fatalf("a3 refused with %v", err)
+	}
+
+	// A closed queue refuses jobs and hands
+	// out the queued ones before nil
+	queue.Close()
+
+	if err = queue.Push(newTestJob(PriorityNormal, "d1")); err == nil {
+		t.Fatal("Closed queue took a job")
+	}
+
+	for idx := 0; idx < 3; idx++ {
+		if queue.Pop() == nil {
+			t.Fatalf("Job %d not handed out after closing", idx)
+		}
+	}
+
+	if job := queue.Pop(); job != nil {
+		t.Fatalf("Popped %s from an empty closed queue", job.cacheReq.ReqKey)
+	}
+}
@@ -0,0 +1,205 @@
+package httpcache
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultContentType = "application/json"
+)
+
+var (
+	// HopByHopHeaders only concern a single connection
+	// and are never relayed by the proxy
+	HopByHopHeaders = []string{
+		"Connection",
+		"Keep-Alive",
+		"Proxy-Authenticate",
+		"Proxy-Authorization",
+		"Proxy-Connection",
+		"Te",
+		"Trailer",
+		"Transfer-Encoding",
+		"Upgrade",
+	}
+)
+
+type (
+	// Response is what the client gets, from the
+	// cache, a local handler or the upstream. The body
+	// of a Streamed response has been written already,
+	// Body is then the copy kept for the cache if any
+	Response struct {
+		StatusCode int
+		Header     http.Header
+		Body       []byte
+		Streamed   bool
+	}
+)
+
+// getAcceptedEncodings is the Accept-Encoding of the request
+// in a canonical form, the encodings it accepts sorted. It is
+// empty when only the identity encoding is accepted
+func getAcceptedEncodings(req *http.Request) (encodings string) {
+
+	var (
+		accepted []string
+	)
+
+	for _, value := range req.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(value, ",") {
+
+			var (
+				params   []string
+				encoding string
+			)
+
+			params = strings.Split(part, ";")
+
+			if encoding = strings.ToLower(strings.TrimSpace(params[0])); encoding == "" || encoding == "identity" {
+				continue
+			}
+
+			// Encodings with a zero quality are refused
+			if len(params) > 1 && isZeroQuality(params[1]) {
+				continue
+			}
+
+			accepted = append(accepted, encoding)
+		}
+	}
+
+	sort.Strings(accepted)
+
+	encodings = strings.Join(accepted, ",")
+
+	return
+}
+
+func isZeroQuality(param string) (isZero bool) {
+
+	var (
+		name    string
+		value   string
+		isFound bool
+	)
+
+	if name, value, isFound = strings.Cut(param, "="); !isFound ||
+		strings.ToLower(strings.TrimSpace(name)) != "q" {
+
+		return
+	}
+
+	quality, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	isZero = err == nil && quality == 0
+
+	return
+}
+
+func newLocalResponse(respBody []byte) (resp *Response) {
+
+	resp = &Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       respBody,
+	}
+
+	resp.Header.Set("Content-Type", DefaultContentType)
+
+	return
+}
+
+func newCachedResponse(cacheApi *CacheApi) (resp *Response) {
+
+	resp = &Response{
+		StatusCode: cacheApi.StatusCode,
+		Header:     cacheApi.Header.Clone(),
+		Body:       cacheApi.Data,
+	}
+
+	// Entries cached before the status was kept are 200s
+	if resp.StatusCode == 0 {
+		resp.StatusCode = http.StatusOK
+	}
+
+	return
+}
+
+// filterResponseHeader keeps the upstream headers which
+// may be relayed to the client, all the end to end ones
+// or only the ones of the response_headers allowlist
+func (httpCacheCtxt *HttpCacheCtxt) filterResponseHeader(upstreamHeader http.Header) (header http.Header) {
+
+	var (
+		allowed []string
+	)
+
+	header = upstreamHeader.Clone()
+
+	removeConnectionHeaders(header)
+
+	// The length is set again when the body is written
+	header.Del("Content-Length")
+
+	if allowed = httpCacheCtxt.Config.ResponseHeaders; len(allowed) == 0 {
+		return
+	}
+
+	for name := range header {
+
+		isAllowed := false
+
+		for _, allowedName := range allowed {
+			if strings.EqualFold(name, allowedName) {
+				isAllowed = true
+				break
+			}
+		}
+
+		if !isAllowed {
+			header.Del(name)
+		}
+	}
+
+	return
+}
+
+// removeConnectionHeaders drops the hop by hop headers,
+// including the ones listed in the Connection header
+func removeConnectionHeaders(header http.Header) {
+
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+
+	for _, name := range HopByHopHeaders {
+		header.Del(name)
+	}
+
+	return
+}
+
+func writeResponse(w http.ResponseWriter, resp *Response) {
+
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", DefaultContentType)
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	w.Write(resp.Body)
+
+	return
+}
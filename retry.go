@@ -0,0 +1,134 @@
+package httpcache
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	DefaultRetryBaseBackoff  = 25
+	DefaultRetryMaxBackoff   = 1000
+	DefaultRetryBudgetRatio  = 0.1
+	DefaultRetryMinPerSecond = 1
+	RetryDrainBodyLimit      = 4096
+)
+
+var (
+	DefaultRetryStatuses = []int{
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	}
+
+	IdempotentMethods = map[string]bool{
+		http.MethodGet:     true,
+		http.MethodHead:    true,
+		http.MethodOptions: true,
+		http.MethodTrace:   true,
+		http.MethodPut:     true,
+		http.MethodDelete:  true,
+	}
+)
+
+type (
+	// RetryConfig drives the retries of failed upstream
+	// requests. Only idempotent methods, or routes marked
+	// retry_safe, are retried, after a transport error or
+	// one of RetryStatuses. Backoffs are in milliseconds,
+	// each retry waits a random time up to BaseBackoff
+	// doubled with every attempt, capped at MaxBackoff.
+	// Retries are limited to BudgetRatio of the requests
+	// plus MinPerSecond
+	RetryConfig struct {
+		MaxRetries    int     `json:"max_retries"`
+		BaseBackoff   int64   `json:"base_backoff_ms"`
+		MaxBackoff    int64   `json:"max_backoff_ms"`
+		BudgetRatio   float64 `json:"budget_ratio"`
+		MinPerSecond  float64 `json:"min_retries_per_second"`
+		RetryStatuses []int   `json:"retry_statuses"`
+	}
+)
+
+// isRetryable tells if the request could be sent again
+// at all, whatever the outcome of the first attempt
+func (proxyCtxt *ProxyCtxt) isRetryable(job *proxyJob) (isRetryable bool) {
+
+	var (
+		req = job.req
+	)
+
+	if proxyCtxt.httpCacheCtxt.Config.Retry.MaxRetries <= 0 {
+		return
+	}
+
+	if !IdempotentMethods[req.Method] && !job.cacheReq.Policy.RetrySafe {
+		return
+	}
+
+	// The body has to be replayable
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return
+	}
+
+	isRetryable = true
+
+	return
+}
+
+func (proxyCtxt *ProxyCtxt) shouldRetry(resp *http.Response, err error) (shouldRetry bool) {
+
+	if err != nil {
+		shouldRetry = true
+		return
+	}
+
+	for _, status := range proxyCtxt.httpCacheCtxt.Config.Retry.RetryStatuses {
+		if resp.StatusCode == status {
+			shouldRetry = true
+			return
+		}
+	}
+
+	return
+}
+
+// getBackoff is the full jitter exponential backoff
+// before the given retry, starting at 1
+func (proxyCtxt *ProxyCtxt) getBackoff(retry int) (backoff time.Duration) {
+
+	var (
+		cfg     = &proxyCtxt.httpCacheCtxt.Config.Retry
+		ceiling time.Duration
+	)
+
+	ceiling = time.Duration(cfg.BaseBackoff) * time.Millisecond << uint(retry-1)
+
+	if maxBackoff := time.Duration(cfg.MaxBackoff) * time.Millisecond; ceiling > maxBackoff || ceiling <= 0 {
+		ceiling = maxBackoff
+	}
+
+	if ceiling <= 0 {
+		return
+	}
+
+	backoff = time.Duration(rand.Int63n(int64(ceiling)))
+
+	return
+}
+
+// discardResponse lets the connection of a response which
+// is not used be reused, when its body is small
+func discardResponse(resp *http.Response) {
+
+	if resp == nil {
+		return
+	}
+
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, RetryDrainBodyLimit))
+	resp.Body.Close()
+
+	return
+}
@@ -0,0 +1,288 @@
+package httpcache
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	RouteKindExact    = "exact"
+	RouteKindTemplate = "template"
+	RouteKindGlob     = "glob"
+	RouteKindRegex    = "regex"
+
+	RouteRegexPrefix = "regex:"
+	RouteGlobPrefix  = "glob:"
+)
+
+type (
+	// Route is a single compiled path pattern. Patterns can be
+	//   - mux style templates, /api/{ver}/users/{id:[0-9]+}/avatar
+	//   - globs, /api/*/users/** where * stays within a segment
+	//   - regexes, regex:^/api/v[0-9]+/users/(?P<id>[^/]+)$
+	// A pattern without the leading slash matches the path
+	// under any prefix, e.g. skipapi/checksums matches both
+	// /skipapi/checksums and /api/v5/skipapi/checksums
+	Route struct {
+		Name    string
+		Pattern string
+		Kind    string
+
+		// Policy is set for the routes of the routes
+		// section of the config
+		Policy *RoutePolicy
+
+		regex *regexp.Regexp
+	}
+
+	RouteMatcher struct {
+		Routes []*Route
+	}
+)
+
+func NewRoute(name string, pattern string) (route *Route, err error) {
+
+	var (
+		expr string
+	)
+
+	route = &Route{
+		Name:    name,
+		Pattern: pattern,
+	}
+
+	if route.Name == "" {
+		route.Name = pattern
+	}
+
+	switch {
+
+	case strings.HasPrefix(pattern, RouteRegexPrefix):
+		route.Kind = RouteKindRegex
+		expr = strings.TrimPrefix(pattern, RouteRegexPrefix)
+
+	case strings.HasPrefix(pattern, RouteGlobPrefix):
+		route.Kind = RouteKindGlob
+		expr = globToRegex(strings.TrimPrefix(pattern, RouteGlobPrefix))
+
+	case strings.Contains(pattern, "{"):
+		route.Kind = RouteKindTemplate
+		if expr, err = templateToRegex(pattern); err != nil {
+			return
+		}
+
+	case strings.ContainsAny(pattern, "*?"):
+		route.Kind = RouteKindGlob
+		expr = globToRegex(pattern)
+
+	default:
+		route.Kind = RouteKindExact
+		expr = "^" + relativePrefix(pattern) + regexp.QuoteMeta(strings.TrimPrefix(pattern, "/")) + "$"
+	}
+
+	if route.regex, err = regexp.Compile(expr); err != nil {
+		err = errors.New("Invalid route pattern " + pattern + ": " + err.Error())
+		return
+	}
+
+	return
+}
+
+func NewRouteMatcher(patterns []string) (matcher *RouteMatcher, err error) {
+
+	var (
+		route *Route
+	)
+
+	matcher = &RouteMatcher{}
+
+	for _, pattern := range patterns {
+
+		if route, err = NewRoute("", pattern); err != nil {
+			return
+		}
+
+		matcher.Add(route)
+	}
+
+	return
+}
+
+func (matcher *RouteMatcher) Add(route *Route) {
+	matcher.Routes = append(matcher.Routes, route)
+	return
+}
+
+// Match returns the first route, in the order they were
+// added, which matches the path along with the variables
+// captured by the pattern
+func (matcher *RouteMatcher) Match(path string) (route *Route, vars map[string]string) {
+
+	for _, candidate := range matcher.Routes {
+
+		if vars = candidate.Match(path); vars != nil {
+			route = candidate
+			return
+		}
+	}
+
+	return
+}
+
+func (route *Route) Match(path string) (vars map[string]string) {
+
+	var (
+		submatches []string
+	)
+
+	if submatches = route.regex.FindStringSubmatch(path); submatches == nil {
+		return
+	}
+
+	vars = make(map[string]string)
+
+	for idx, name := range route.regex.SubexpNames() {
+		if name != "" {
+			vars[name] = submatches[idx]
+		}
+	}
+
+	return
+}
+
+func relativePrefix(pattern string) (prefix string) {
+
+	if strings.HasPrefix(pattern, "/") {
+		prefix = "/"
+		return
+	}
+
+	prefix = "/(?:.*/)?"
+
+	return
+}
+
+func globToRegex(pattern string) (expr string) {
+
+	var (
+		builder strings.Builder
+		rest    string
+	)
+
+	builder.WriteString("^")
+	builder.WriteString(relativePrefix(pattern))
+
+	rest = strings.TrimPrefix(pattern, "/")
+
+	for len(rest) > 0 {
+
+		switch {
+
+		case strings.HasPrefix(rest, "**/"):
+			builder.WriteString("(?:.*/)?")
+			rest = rest[3:]
+
+		case strings.HasPrefix(rest, "**"):
+			builder.WriteString(".*")
+			rest = rest[2:]
+
+		case rest[0] == '*':
+			builder.WriteString("[^/]*")
+			rest = rest[1:]
+
+		case rest[0] == '?':
+			builder.WriteString("[^/]")
+			rest = rest[1:]
+
+		default:
+			builder.WriteString(regexp.QuoteMeta(rest[:1]))
+			rest = rest[1:]
+		}
+	}
+
+	builder.WriteString("$")
+
+	expr = builder.String()
+
+	return
+}
+
+func templateToRegex(pattern string) (expr string, err error) {
+
+	var (
+		builder strings.Builder
+		rest    string
+
+		start, end int
+		variable   string
+		name       string
+		varExpr    string
+	)
+
+	builder.WriteString("^")
+	builder.WriteString(relativePrefix(pattern))
+
+	rest = strings.TrimPrefix(pattern, "/")
+
+	for len(rest) > 0 {
+
+		if start = strings.Index(rest, "{"); start < 0 {
+			builder.WriteString(regexp.QuoteMeta(rest))
+			break
+		}
+
+		if end = matchingBrace(rest, start); end < 0 {
+			err = errors.New("Unbalanced braces in route pattern " + pattern)
+			return
+		}
+
+		builder.WriteString(regexp.QuoteMeta(rest[:start]))
+
+		variable = rest[start+1 : end]
+		name, varExpr = variable, "[^/]+"
+
+		if idx := strings.Index(variable, ":"); idx >= 0 {
+			name, varExpr = variable[:idx], variable[idx+1:]
+		}
+
+		if name == "" {
+			err = errors.New("Missing variable name in route pattern " + pattern)
+			return
+		}
+
+		builder.WriteString("(?P<" + name + ">" + varExpr + ")")
+
+		rest = rest[end+1:]
+	}
+
+	builder.WriteString("$")
+
+	expr = builder.String()
+
+	return
+}
+
+func matchingBrace(pattern string, start int) (end int) {
+
+	var (
+		level int
+	)
+
+	for idx := start; idx < len(pattern); idx++ {
+
+		switch pattern[idx] {
+		case '{':
+			level++
+		case '}':
+			if level--; level == 0 {
+				end = idx
+				return
+			}
+		}
+	}
+
+	end = -1
+
+	return
+}
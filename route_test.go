@@ -0,0 +1,129 @@
+package httpcache
+
+import (
+	"testing"
+)
+
+func TestRouteMatch(t *testing.T) {
+
+	var (
+		testCases = []struct {
+			pattern string
+			kind    string
+			path    string
+			isMatch bool
+			vars    map[string]string
+		}{
+			{pattern: "/api/v5/checksums", kind: RouteKindExact, path: "/api/v5/checksums", isMatch: true},
+			{pattern: "/api/v5/checksums", kind: RouteKindExact, path: "/api/v5/checksums/1"},
+			{pattern: "/api/v5.1", kind: RouteKindExact, path: "/api/v501"},
+			{pattern: "skipapi/checksums", kind: RouteKindExact, path: "/skipapi/checksums", isMatch: true},
+			{pattern: "skipapi/checksums", kind: RouteKindExact, path: "/api/v5/skipapi/checksums", isMatch: true},
+			{pattern: "skipapi/checksums", kind: RouteKindExact, path: "/api/v5/noskipapi/checksums"},
+			{
+				pattern: "/api/{ver}/users/{id}/avatar",
+				kind:    RouteKindTemplate,
+				path:    "/api/v2/users/42/avatar",
+				isMatch: true,
+				vars:    map[string]string{"ver": "v2", "id": "42"},
+			},
+			{pattern: "/api/{ver}/users/{id}/avatar", kind: RouteKindTemplate, path: "/api/v2/users/4/2/avatar"},
+			{
+				pattern: "/users/{id:[0-9]{1,3}}",
+				kind:    RouteKindTemplate,
+				path:    "/users/123",
+				isMatch: true,
+				vars:    map[string]string{"id": "123"},
+			},
+			{pattern: "/users/{id:[0-9]{1,3}}", kind: RouteKindTemplate, path: "/users/1234"},
+			{pattern: "/api/*/users", kind: RouteKindGlob, path: "/api/v2/users", isMatch: true},
+			{pattern: "/api/*/users", kind: RouteKindGlob, path: "/api/v2/x/users"},
+			{pattern: "/api/**/users", kind: RouteKindGlob, path: "/api/users", isMatch: true},
+			{pattern: "/api/**/users", kind: RouteKindGlob, path: "/api/v2/x/users", isMatch: true},
+			{pattern: "/api/**", kind: RouteKindGlob, path: "/api/v2/x", isMatch: true},
+			{pattern: "/api/v?", kind: RouteKindGlob, path: "/api/v2", isMatch: true},
+			{pattern: "/api/v?", kind: RouteKindGlob, path: "/api/v22"},
+			{pattern: "glob:/api/v1", kind: RouteKindGlob, path: "/api/v1", isMatch: true},
+			{
+				pattern: "regex:^/api/v[0-9]+/users/(?P<id>[^/]+)$",
+				kind:    RouteKindRegex,
+				path:    "/api/v2/users/42",
+				isMatch: true,
+				vars:    map[string]string{"id": "42"},
+			},
+			{pattern: "regex:^/api/v[0-9]+/users/(?P<id>[^/]+)$", kind: RouteKindRegex, path: "/api/vx/users/42"},
+		}
+	)
+
+	for _, testCase := range testCases {
+
+		route, err := NewRoute("", testCase.pattern)
+		if err != nil {
+			t.Fatalf("%s: %v", testCase.pattern, err)
+		}
+
+		if route.Kind != testCase.kind {
+			t.Errorf("%s: kind %s instead of %s", testCase.pattern, route.Kind, testCase.kind)
+		}
+
+		vars := route.Match(testCase.path)
+
+		if isMatch := vars != nil; isMatch != testCase.isMatch {
+			t.Errorf("%s: %s matched %v", testCase.pattern, testCase.path, isMatch)
+			continue
+		}
+
+		for name, value := range testCase.vars {
+			if vars[name] != value {
+				t.Errorf("%s: %s is %q instead of %q", testCase.pattern, name, vars[name], value)
+			}
+		}
+	}
+}
+
+func TestNewRouteInvalidPattern(t *testing.T) {
+
+	for _, pattern := range []string{"/users/{id", "/users/{:[0-9]+}", "regex:^/users/(", "/users/{id:[0-9}"} {
+		if _, err := NewRoute("", pattern); err == nil {
+			t.Errorf("Pattern %s accepted", pattern)
+		}
+	}
+}
+
+func TestRouteMatcherOrder(t *testing.T) {
+
+	var (
+		matcher *RouteMatcher
+		route   *Route
+		err     error
+	)
+
+	if matcher, err = NewRouteMatcher([]string{"/api/v2/users/me", "/api/{ver}/users/{id}", "/api/**"}); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		path    string
+		pattern string
+	}{
+		{"/api/v2/users/me", "/api/v2/users/me"},
+		{"/api/v2/users/42", "/api/{ver}/users/{id}"},
+		{"/api/v2/groups", "/api/**"},
+		{"/other", ""},
+	}
+
+	for _, testCase := range testCases {
+
+		if route, _ = matcher.Match(testCase.path); route == nil {
+			if testCase.pattern != "" {
+				t.Errorf("%s: no route", testCase.path)
+			}
+
+			continue
+		}
+
+		if route.Pattern != testCase.pattern {
+			t.Errorf("%s: matched %s instead of %s", testCase.path, route.Pattern, testCase.pattern)
+		}
+	}
+}
@@ -18,12 +18,71 @@ type (
 			Skipped        prometheus.Counter
 			LocalHandled   prometheus.Counter
 			CacheAdded     prometheus.Counter
+			CacheRejected  prometheus.Counter
+			CacheUnchecked prometheus.Counter
 			CachedResponse prometheus.Counter
+			StaleResponse  prometheus.Counter
+			Revalidations  prometheus.Counter
+
+			Retries          prometheus.Counter
+			RetriesExhausted prometheus.Counter
+
+			Hedges          prometheus.Counter
+			HedgeWins       prometheus.Counter
+			HedgesExhausted prometheus.Counter
+		}
+
+		Tenant struct {
+			Bytes     *prometheus.GaugeVec
+			Entries   *prometheus.GaugeVec
+			Hits      *prometheus.CounterVec
+			Misses    *prometheus.CounterVec
+			Evictions *prometheus.CounterVec
+			Flushes   *prometheus.CounterVec
+		}
+
+		Proxy struct {
+			Queued   prometheus.Gauge
+			Rejected *prometheus.CounterVec
+
+			QueuedByPriority *prometheus.GaugeVec
+			QueueWait        *prometheus.HistogramVec
+
+			Tunnels       *prometheus.GaugeVec
+			TunnelsOpened *prometheus.CounterVec
+
+			ConcurrencyLimit prometheus.Gauge
+			InFlight         prometheus.Gauge
+			Shed             prometheus.Counter
+
+			Mirrored      prometheus.Counter
+			MirrorSkipped prometheus.Counter
+			MirrorErrors  prometheus.Counter
+			MirrorDiffs   prometheus.Counter
+		}
+
+		Upstream struct {
+			Requests    *prometheus.CounterVec
+			Errors      *prometheus.CounterVec
+			Outstanding *prometheus.GaugeVec
+			Healthy     *prometheus.GaugeVec
+			Ejections   *prometheus.CounterVec
+
+			CircuitState       *prometheus.GaugeVec
+			CircuitTransitions *prometheus.CounterVec
+
+			Connections       *prometheus.GaugeVec
+			ConnectionsOpened *prometheus.CounterVec
+			Responses         *prometheus.CounterVec
+
+			PoolSize        prometheus.Gauge
+			PoolUpdates     prometheus.Counter
+			DiscoveryErrors prometheus.Counter
 		}
 	}
 )
 
-func NewMonitorServer() (server *http.Server, err error) {
+func NewMonitorServer(httpCacheCtxt *HttpCacheCtxt) (server *http.Server, err error) {
 
 	var (
 		router *mux.Router
@@ -32,6 +91,7 @@ func NewMonitorServer() (server *http.Server, err error) {
 	router = mux.NewRouter()
 
 	router.Handle("/metrics", promhttp.Handler())
+	router.HandleFunc("/health/upstreams", httpCacheCtxt.ProxyCtxt.Pool.healthHandler)
 
 	server = &http.Server{
 		Handler:      router,
@@ -49,6 +109,18 @@ func NewStats() (stats *Stats, err error) {
 		return
 	}
 
+	if err = stats.RegisterTenantStats(); err != nil {
+		return
+	}
+
+	if err = stats.RegisterProxyStats(); err != nil {
+		return
+	}
+
+	if err = stats.RegisterUpstreamStats(); err != nil {
+		return
+	}
+
 	return
 }
 
@@ -60,7 +132,16 @@ func (stats *Stats) RegisterCounterStats() (err error) {
 	stats.Counter.Skipped = prometheus.NewCounter(prometheus.CounterOpts{Name: "cache_skipped"})
 	stats.Counter.LocalHandled = prometheus.NewCounter(prometheus.CounterOpts{Name: "cache_local_handled"})
 	stats.Counter.CacheAdded = prometheus.NewCounter(prometheus.CounterOpts{Name: "cache_added"})
+	stats.Counter.CacheRejected = prometheus.NewCounter(prometheus.CounterOpts{Name: "cache_rejected"})
+	stats.Counter.CacheUnchecked = prometheus.NewCounter(prometheus.CounterOpts{Name: "cache_validation_skipped"})
 	stats.Counter.CachedResponse = prometheus.NewCounter(prometheus.CounterOpts{Name: "cache_response"})
+	stats.Counter.StaleResponse = prometheus.NewCounter(prometheus.CounterOpts{Name: "cache_stale_response"})
+	stats.Counter.Revalidations = prometheus.NewCounter(prometheus.CounterOpts{Name: "cache_revalidations"})
+	stats.Counter.Retries = prometheus.NewCounter(prometheus.CounterOpts{Name: "upstream_retries"})
+	stats.Counter.RetriesExhausted = prometheus.NewCounter(prometheus.CounterOpts{Name: "upstream_retry_budget_exhausted"})
+	stats.Counter.Hedges = prometheus.NewCounter(prometheus.CounterOpts{Name: "upstream_hedges"})
+	stats.Counter.HedgeWins = prometheus.NewCounter(prometheus.CounterOpts{Name: "upstream_hedge_wins"})
+	stats.Counter.HedgesExhausted = prometheus.NewCounter(prometheus.CounterOpts{Name: "upstream_hedge_budget_exhausted"})
 
 	prometheus.MustRegister(stats.Counter.Invalidations)
 	prometheus.MustRegister(stats.Counter.Requests)
@@ -68,7 +149,107 @@ func (stats *Stats) RegisterCounterStats() (err error) {
 	prometheus.MustRegister(stats.Counter.Skipped)
 	prometheus.MustRegister(stats.Counter.LocalHandled)
 	prometheus.MustRegister(stats.Counter.CacheAdded)
+	prometheus.MustRegister(stats.Counter.CacheRejected)
+	prometheus.MustRegister(stats.Counter.CacheUnchecked)
 	prometheus.MustRegister(stats.Counter.CachedResponse)
+	prometheus.MustRegister(stats.Counter.StaleResponse)
+	prometheus.MustRegister(stats.Counter.Revalidations)
+	prometheus.MustRegister(stats.Counter.Retries)
+	prometheus.MustRegister(stats.Counter.RetriesExhausted)
+	prometheus.MustRegister(stats.Counter.Hedges)
+	prometheus.MustRegister(stats.Counter.HedgeWins)
+	prometheus.MustRegister(stats.Counter.HedgesExhausted)
+
+	return
+}
+
+func (stats *Stats) RegisterTenantStats() (err error) {
+
+	stats.Tenant.Bytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "cache_tenant_bytes"}, []string{"tenant"})
+	stats.Tenant.Entries = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "cache_tenant_entries"}, []string{"tenant"})
+	stats.Tenant.Hits = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "cache_tenant_hits"}, []string{"tenant"})
+	stats.Tenant.Misses = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "cache_tenant_misses"}, []string{"tenant"})
+	stats.Tenant.Evictions = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "cache_tenant_evictions"}, []string{"tenant"})
+	stats.Tenant.Flushes = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "cache_tenant_flushes"}, []string{"tenant"})
+
+	prometheus.MustRegister(stats.Tenant.Bytes)
+	prometheus.MustRegister(stats.Tenant.Entries)
+	prometheus.MustRegister(stats.Tenant.Hits)
+	prometheus.MustRegister(stats.Tenant.Misses)
+	prometheus.MustRegister(stats.Tenant.Evictions)
+	prometheus.MustRegister(stats.Tenant.Flushes)
+
+	return
+}
+
+func (stats *Stats) RegisterProxyStats() (err error) {
+
+	stats.Proxy.Queued = prometheus.NewGauge(prometheus.GaugeOpts{Name: "proxy_queued"})
+	stats.Proxy.Rejected = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "proxy_rejected"}, []string{"tenant"})
+
+	stats.Proxy.QueuedByPriority = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "proxy_queued_by_priority"}, []string{"priority"})
+	stats.Proxy.QueueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "proxy_queue_wait_seconds"}, []string{"priority"})
+
+	stats.Proxy.Tunnels = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "proxy_tunnels_active"}, []string{"upstream"})
+	stats.Proxy.TunnelsOpened = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "proxy_tunnels_opened"}, []string{"upstream"})
+
+	stats.Proxy.ConcurrencyLimit = prometheus.NewGauge(prometheus.GaugeOpts{Name: "proxy_concurrency_limit"})
+	stats.Proxy.InFlight = prometheus.NewGauge(prometheus.GaugeOpts{Name: "proxy_in_flight"})
+	stats.Proxy.Shed = prometheus.NewCounter(prometheus.CounterOpts{Name: "proxy_shed"})
+
+	stats.Proxy.Mirrored = prometheus.NewCounter(prometheus.CounterOpts{Name: "proxy_mirrored"})
+	stats.Proxy.MirrorSkipped = prometheus.NewCounter(prometheus.CounterOpts{Name: "proxy_mirror_skipped"})
+	stats.Proxy.MirrorErrors = prometheus.NewCounter(prometheus.CounterOpts{Name: "proxy_mirror_errors"})
+	stats.Proxy.MirrorDiffs = prometheus.NewCounter(prometheus.CounterOpts{Name: "proxy_mirror_diffs"})
+
+	prometheus.MustRegister(stats.Proxy.Queued)
+	prometheus.MustRegister(stats.Proxy.Rejected)
+	prometheus.MustRegister(stats.Proxy.QueuedByPriority)
+	prometheus.MustRegister(stats.Proxy.QueueWait)
+	prometheus.MustRegister(stats.Proxy.Tunnels)
+	prometheus.MustRegister(stats.Proxy.TunnelsOpened)
+	prometheus.MustRegister(stats.Proxy.ConcurrencyLimit)
+	prometheus.MustRegister(stats.Proxy.InFlight)
+	prometheus.MustRegister(stats.Proxy.Shed)
+	prometheus.MustRegister(stats.Proxy.Mirrored)
+	prometheus.MustRegister(stats.Proxy.MirrorSkipped)
+	prometheus.MustRegister(stats.Proxy.MirrorErrors)
+	prometheus.MustRegister(stats.Proxy.MirrorDiffs)
+
+	return
+}
+
+func (stats *Stats) RegisterUpstreamStats() (err error) {
+
+	stats.Upstream.Requests = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "upstream_requests"}, []string{"upstream"})
+	stats.Upstream.Errors = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "upstream_errors"}, []string{"upstream"})
+	stats.Upstream.Outstanding = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "upstream_outstanding"}, []string{"upstream"})
+	stats.Upstream.Healthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "upstream_healthy"}, []string{"upstream"})
+	stats.Upstream.Ejections = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "upstream_ejections"}, []string{"upstream"})
+	stats.Upstream.CircuitState = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "upstream_circuit_state"}, []string{"upstream", "state"})
+	stats.Upstream.CircuitTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "upstream_circuit_transitions"}, []string{"upstream", "state"})
+
+	stats.Upstream.Connections = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "upstream_connections"}, []string{"upstream"})
+	stats.Upstream.ConnectionsOpened = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "upstream_connections_opened"}, []string{"upstream"})
+	stats.Upstream.Responses = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "upstream_responses"}, []string{"upstream", "protocol"})
+
+	stats.Upstream.PoolSize = prometheus.NewGauge(prometheus.GaugeOpts{Name: "upstream_pool_size"})
+	stats.Upstream.PoolUpdates = prometheus.NewCounter(prometheus.CounterOpts{Name: "upstream_pool_updates"})
+	stats.Upstream.DiscoveryErrors = prometheus.NewCounter(prometheus.CounterOpts{Name: "upstream_discovery_errors"})
+
+	prometheus.MustRegister(stats.Upstream.Requests)
+	prometheus.MustRegister(stats.Upstream.Errors)
+	prometheus.MustRegister(stats.Upstream.Outstanding)
+	prometheus.MustRegister(stats.Upstream.Healthy)
+	prometheus.MustRegister(stats.Upstream.Ejections)
+	prometheus.MustRegister(stats.Upstream.CircuitState)
+	prometheus.MustRegister(stats.Upstream.CircuitTransitions)
+	prometheus.MustRegister(stats.Upstream.Connections)
+	prometheus.MustRegister(stats.Upstream.ConnectionsOpened)
+	prometheus.MustRegister(stats.Upstream.Responses)
+	prometheus.MustRegister(stats.Upstream.PoolSize)
+	prometheus.MustRegister(stats.Upstream.PoolUpdates)
+	prometheus.MustRegister(stats.Upstream.DiscoveryErrors)
 
 	return
 }
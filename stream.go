@@ -0,0 +1,168 @@
+package httpcache
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+const (
+	DefaultMaxCacheableBytes = 8 * 1024 * 1024
+	StreamChunkSize          = 32 * 1024
+)
+
+type (
+	// CacheBuffer keeps a copy of a streamed body for the
+	// cache. A body going over MaxBytes is not cached, the
+	// copy is then dropped while the streaming goes on
+	CacheBuffer struct {
+		MaxBytes    int64
+		IsOverflown bool
+
+		buf *bytes.Buffer
+	}
+
+	// ClientWriteError is a failure to write to the client,
+	// as opposed to a failure to read from the upstream
+	ClientWriteError struct {
+		Err error
+	}
+)
+
+func (customErr ClientWriteError) Error() (res string) {
+	res = "Failed to write to the client: " + customErr.Err.Error()
+	return
+}
+
+func NewCacheBuffer(maxBytes int64) (cacheBuf *CacheBuffer) {
+
+	cacheBuf = &CacheBuffer{
+		MaxBytes: maxBytes,
+
+		buf: &bytes.Buffer{},
+	}
+
+	return
+}
+
+func (cacheBuf *CacheBuffer) Write(data []byte) (n int, err error) {
+
+	n = len(data)
+
+	if cacheBuf.IsOverflown {
+		return
+	}
+
+	if cacheBuf.MaxBytes > 0 && int64(cacheBuf.buf.Len()+len(data)) > cacheBuf.MaxBytes {
+		cacheBuf.IsOverflown = true
+		cacheBuf.buf = &bytes.Buffer{}
+		return
+	}
+
+	cacheBuf.buf.Write(data)
+
+	return
+}
+
+func (cacheBuf *CacheBuffer) Bytes() (data []byte) {
+	data = cacheBuf.buf.Bytes()
+	return
+}
+
+// getMaxCacheableBytes is the largest body of the route
+// which is cached, the route max_body_bytes or the global
+// max_cacheable_bytes
+func (httpCacheCtxt *HttpCacheCtxt) getMaxCacheableBytes(policy *RoutePolicy) (maxBytes int64) {
+
+	if maxBytes = policy.MaxBodyBytes; maxBytes > 0 {
+		return
+	}
+
+	maxBytes = httpCacheCtxt.Config.Proxy.MaxCacheableBytes
+
+	return
+}
+
+// writeStreamHeader sends the status and headers of a
+// response whose body is streamed afterwards
+func writeStreamHeader(w http.ResponseWriter, resp *Response, contentLength int64) {
+
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", DefaultContentType)
+	}
+
+	if contentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	}
+
+	w.WriteHeader(resp.StatusCode)
+
+	return
+}
+
+// streamBody copies the upstream body to the client as it
+// arrives, flushing every chunk, and into the cache buffer
+// when there is one. Without a client the body is only read
+// into the cache buffer
+func streamBody(w http.ResponseWriter, body io.Reader, cacheBuf *CacheBuffer) (err error) {
+
+	var (
+		chunk   []byte
+		n       int
+		readErr error
+		flusher http.Flusher
+	)
+
+	// Nobody is there to read the body for
+	if w == nil && cacheBuf == nil {
+		return
+	}
+
+	chunk = make([]byte, StreamChunkSize)
+
+	if w != nil {
+		flusher, _ = w.(http.Flusher)
+	}
+
+	for {
+		n, readErr = body.Read(chunk)
+
+		if n > 0 {
+
+			if cacheBuf != nil {
+				cacheBuf.Write(chunk[:n])
+			}
+
+			if w != nil {
+
+				if _, err = w.Write(chunk[:n]); err != nil {
+					err = ClientWriteError{Err: err}
+					return
+				}
+
+				if flusher != nil {
+					flusher.Flush()
+				}
+
+			} else if cacheBuf.IsOverflown {
+				return
+			}
+		}
+
+		if readErr == io.EOF {
+			return
+		}
+
+		if readErr != nil {
+			err = readErr
+			return
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package httpcache
+
+import (
+	"container/list"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultTenantName = "default"
+	DefaultMaxTenants = 100
+)
+
+type (
+	// Tenant is a namespace of cache entries. Every tenant
+	// owns its own entries, byte quota and LRU list so that
+	// one customer filling the cache can only evict its own
+	// responses
+	Tenant struct {
+		cache *Cache
+
+		Name       string
+		QuotaBytes int64
+		UsedBytes  int64
+
+		CacheObj map[ReqKeyT]*CacheObj
+		objLock  *sync.RWMutex
+
+		// lru holds the *CacheApi entries of the tenant,
+		// the most recently used entry being at the front
+		lru     *list.List
+		lruLock *sync.Mutex
+	}
+
+	TenantUsage struct {
+		Name       string `json:"name"`
+		QuotaBytes int64  `json:"quota_bytes"`
+		UsedBytes  int64  `json:"used_bytes"`
+		Entries    int    `json:"entries"`
+	}
+)
+
+func NewTenant(cache *Cache, name string, quotaBytes int64) (tenant *Tenant, err error) {
+
+	tenant = &Tenant{
+		cache: cache,
+
+		Name:       name,
+		QuotaBytes: quotaBytes,
+
+		CacheObj: make(map[ReqKeyT]*CacheObj, 1024),
+		objLock:  &sync.RWMutex{},
+
+		lru:     list.New(),
+		lruLock: &sync.Mutex{},
+	}
+
+	return
+}
+
+func (httpCacheCtxt *HttpCacheCtxt) getTenantName(req *http.Request, reqKey ReqKeyT) (tenantName string) {
+
+	var (
+		separator string
+		idx       int
+	)
+
+	if header := httpCacheCtxt.Config.Tenants.Header; header != "" {
+		if tenantName = req.Header.Get(header); tenantName != "" {
+			tenantName = httpCacheCtxt.Cache.admitTenant(tenantName)
+			return
+		}
+	}
+
+	if separator = httpCacheCtxt.Config.Tenants.KeySeparator; separator != "" {
+		if idx = strings.Index(string(reqKey), separator); idx > 0 {
+			tenantName = httpCacheCtxt.Cache.admitTenant(string(reqKey)[:idx])
+			return
+		}
+	}
+
+	tenantName = httpCacheCtxt.Config.Tenants.Default
+
+	return
+}
+
+func (tenant *Tenant) getCacheObj(reqKey ReqKeyT) (cacheObj *CacheObj, err error) {
+
+	var (
+		isPresent bool
+	)
+
+	tenant.objLock.RLock()
+	defer tenant.objLock.RUnlock()
+
+	if cacheObj, isPresent = tenant.CacheObj[reqKey]; !isPresent {
+		err = errors.New("No CloudPort Found for key " + string(reqKey))
+		return
+	}
+
+	return
+}
+
+func (tenant *Tenant) get(reqKey ReqKeyT, apiName string) (cacheApi *CacheApi, err error) {
+
+	var (
+		cacheObj *CacheObj
+	)
+
+	if cacheObj, err = tenant.getCacheObj(reqKey); err != nil {
+		return
+	}
+
+	if cacheApi, err = cacheObj.GetCacheApi(apiName); err != nil {
+		return
+	}
+
+	tenant.touch(cacheApi)
+
+	return
+}
+
+func (tenant *Tenant) Add(reqKey ReqKeyT, apiName string, resp *Response) (err error) {
+
+	var (
+		cacheObj     *CacheObj
+		cacheApi     *CacheApi
+		prevCacheApi *CacheApi
+		isPresent    bool
+
+		currTime int64
+		size     int64
+	)
+
+	currTime = time.Now().UnixNano()
+	size = int64(len(resp.Body))
+
+	tenant.objLock.Lock()
+	defer tenant.objLock.Unlock()
+
+	if tenant.QuotaBytes > 0 && size > tenant.QuotaBytes {
+		tenant.remove(reqKey, apiName)
+		tenant.updateStats()
+
+		err = errors.New("Response exceeds the quota of tenant " + tenant.Name)
+		return
+	}
+
+	if cacheObj, isPresent = tenant.CacheObj[reqKey]; !isPresent {
+
+		// Initialize the cache object per request element
+		cacheObj, _ = NewCacheObj()
+		tenant.CacheObj[reqKey] = cacheObj
+	}
+
+	// Readers hold on to the entry they looked up, so the
+	// response is never updated in place but replaced
+	cacheApi = &CacheApi{
+		Base: cacheObj,
+
+		ReqKey:  reqKey,
+		ApiName: apiName,
+
+		UpdatedAt:  currTime,
+		Data:       resp.Body,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+	}
+
+	if prevCacheApi = cacheObj.SetCacheApi(cacheApi); prevCacheApi != nil {
+		tenant.UsedBytes -= int64(len(prevCacheApi.Data))
+	}
+
+	tenant.UsedBytes += size
+
+	tenant.track(cacheApi, prevCacheApi)
+	tenant.evict(cacheApi)
+	tenant.updateStats()
+
+	return
+}
+
+func (tenant *Tenant) Invalidate(reqKey ReqKeyT) (err error) {
+
+	var (
+		cacheObj *CacheObj
+	)
+
+	if cacheObj, err = tenant.getCacheObj(reqKey); err != nil {
+		return
+	}
+
+	atomic.StoreInt64(&cacheObj.InvalidatedAt, time.Now().UnixNano())
+
+	return
+}
+
+func (tenant *Tenant) Flush() (err error) {
+
+	var (
+		currTime int64
+	)
+
+	currTime = time.Now().UnixNano()
+
+	tenant.objLock.Lock()
+	defer tenant.objLock.Unlock()
+
+	// Entries already looked up are stale as well
+	for _, cacheObj := range tenant.CacheObj {
+		atomic.StoreInt64(&cacheObj.InvalidatedAt, currTime)
+	}
+
+	tenant.lruLock.Lock()
+	for elem := tenant.lru.Front(); elem != nil; elem = tenant.lru.Front() {
+		elem.Value.(*CacheApi).lruElem = nil
+		tenant.lru.Remove(elem)
+	}
+	tenant.lruLock.Unlock()
+
+	tenant.CacheObj = make(map[ReqKeyT]*CacheObj, 1024)
+	tenant.UsedBytes = 0
+
+	tenant.cache.httpCacheCtxt.Stats.Tenant.Flushes.WithLabelValues(tenant.Name).Inc()
+	tenant.updateStats()
+
+	return
+}
+
+func (tenant *Tenant) Usage() (usage *TenantUsage) {
+
+	tenant.objLock.RLock()
+	defer tenant.objLock.RUnlock()
+
+	tenant.lruLock.Lock()
+	defer tenant.lruLock.Unlock()
+
+	usage = &TenantUsage{
+		Name:       tenant.Name,
+		QuotaBytes: tenant.QuotaBytes,
+		UsedBytes:  tenant.UsedBytes,
+		Entries:    tenant.lru.Len(),
+	}
+
+	return
+}
+
+// touch marks an entry as recently used. Entries which
+// have been evicted in the meantime are left alone
+func (tenant *Tenant) touch(cacheApi *CacheApi) {
+
+	tenant.lruLock.Lock()
+	defer tenant.lruLock.Unlock()
+
+	if cacheApi.lruElem == nil {
+		return
+	}
+
+	tenant.lru.MoveToFront(cacheApi.lruElem)
+
+	return
+}
+
+// track adds a new entry to the LRU list, taking the
+// place of the entry it replaces if any. Has to be called
+// with the objLock held
+func (tenant *Tenant) track(cacheApi *CacheApi, prevCacheApi *CacheApi) {
+
+	tenant.lruLock.Lock()
+	defer tenant.lruLock.Unlock()
+
+	if prevCacheApi == nil || prevCacheApi.lruElem == nil {
+		cacheApi.lruElem = tenant.lru.PushFront(cacheApi)
+		return
+	}
+
+	cacheApi.lruElem, prevCacheApi.lruElem = prevCacheApi.lruElem, nil
+	cacheApi.lruElem.Value = cacheApi
+
+	tenant.lru.MoveToFront(cacheApi.lruElem)
+
+	return
+}
+
+// evict drops the least recently used entries of the tenant
+// until it fits in its quota again. The entry which has just
+// been added is never chosen. Has to be called with the
+// objLock held
+func (tenant *Tenant) evict(current *CacheApi) {
+
+	var (
+		elem     *list.Element
+		cacheApi *CacheApi
+	)
+
+	if tenant.QuotaBytes <= 0 {
+		return
+	}
+
+	for tenant.UsedBytes > tenant.QuotaBytes {
+
+		tenant.lruLock.Lock()
+		elem = tenant.lru.Back()
+		tenant.lruLock.Unlock()
+
+		if elem == nil {
+			break
+		}
+
+		if cacheApi = elem.Value.(*CacheApi); cacheApi == current {
+			break
+		}
+
+		tenant.remove(cacheApi.ReqKey, cacheApi.ApiName)
+		tenant.cache.httpCacheCtxt.Stats.Tenant.Evictions.WithLabelValues(tenant.Name).Inc()
+	}
+
+	return
+}
+
+// remove deletes a single entry from the tenant. Has to
+// be called with the objLock held
+func (tenant *Tenant) remove(reqKey ReqKeyT, apiName string) {
+
+	var (
+		cacheObj  *CacheObj
+		cacheApi  *CacheApi
+		isPresent bool
+		err       error
+	)
+
+	if cacheObj, isPresent = tenant.CacheObj[reqKey]; !isPresent {
+		return
+	}
+
+	if cacheApi, err = cacheObj.GetCacheApi(apiName); err != nil {
+		return
+	}
+
+	tenant.lruLock.Lock()
+	if cacheApi.lruElem != nil {
+		tenant.lru.Remove(cacheApi.lruElem)
+		cacheApi.lruElem = nil
+	}
+	tenant.lruLock.Unlock()
+
+	tenant.UsedBytes -= int64(len(cacheApi.Data))
+
+	if cacheObj.DeleteCacheApi(apiName) == 0 {
+		delete(tenant.CacheObj, reqKey)
+	}
+
+	return
+}
+
+func (tenant *Tenant) updateStats() {
+
+	var (
+		stats   *Stats
+		entries int
+	)
+
+	stats = tenant.cache.httpCacheCtxt.Stats
+
+	tenant.lruLock.Lock()
+	entries = tenant.lru.Len()
+	tenant.lruLock.Unlock()
+
+	stats.Tenant.Bytes.WithLabelValues(tenant.Name).Set(float64(tenant.UsedBytes))
+	stats.Tenant.Entries.WithLabelValues(tenant.Name).Set(float64(entries))
+
+	return
+}
@@ -0,0 +1,106 @@
+package httpcache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	TimeoutPhaseConnect = "connect"
+	TimeoutPhaseHeader  = "header"
+	TimeoutPhaseTotal   = "total"
+	TimeoutPhaseQueue   = "queue"
+
+	DefaultConnectTimeout = 5000
+	DefaultTotalTimeout   = 15000
+)
+
+type (
+	// TimeoutConfig bounds the requests sent upstream, in
+	// milliseconds. Connect is the time to open a connection
+	// and Header the time until the response headers of each
+	// attempt, 0 leaves them bounded by Total only. Total
+	// covers the whole request including the time spent in
+	// the proxy queue, retries and the reading of the body
+	TimeoutConfig struct {
+		Connect int64 `json:"connect_ms"`
+		Header  int64 `json:"header_ms"`
+		Total   int64 `json:"total_ms"`
+	}
+
+	connectTimeoutKey struct{}
+)
+
+// getTimeouts overrides the global timeouts with the
+// ones set on the route of the request
+func (proxyCtxt *ProxyCtxt) getTimeouts(policy *RoutePolicy) (timeouts TimeoutConfig) {
+
+	timeouts = proxyCtxt.httpCacheCtxt.Config.Timeouts
+
+	if policy.Timeouts.Connect > 0 {
+		timeouts.Connect = policy.Timeouts.Connect
+	}
+
+	if policy.Timeouts.Header > 0 {
+		timeouts.Header = policy.Timeouts.Header
+	}
+
+	if policy.Timeouts.Total > 0 {
+		timeouts.Total = policy.Timeouts.Total
+	}
+
+	return
+}
+
+// withConnectTimeout passes the connect timeout of the
+// request down to the dialer of the upstream
+func withConnectTimeout(ctx context.Context, timeout int64) (timeoutCtx context.Context) {
+
+	if timeoutCtx = ctx; timeout <= 0 {
+		return
+	}
+
+	timeoutCtx = context.WithValue(ctx, connectTimeoutKey{}, time.Duration(timeout)*time.Millisecond)
+
+	return
+}
+
+func getConnectTimeout(ctx context.Context) (timeout time.Duration) {
+	timeout, _ = ctx.Value(connectTimeoutKey{}).(time.Duration)
+	return
+}
+
+// getTimeoutError turns the failure of a request sent with
+// ctx into an UpstreamTimeoutError when it is due to one of
+// the timeouts
+func getTimeoutError(ctx context.Context, err error) (timeoutErr error) {
+
+	var (
+		cause  UpstreamTimeoutError
+		opErr  *net.OpError
+		netErr net.Error
+	)
+
+	if timeoutErr = err; err == nil {
+		return
+	}
+
+	if errors.As(context.Cause(ctx), &cause) {
+		timeoutErr = cause
+		return
+	}
+
+	if errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout() {
+		timeoutErr = UpstreamTimeoutError{Phase: TimeoutPhaseConnect}
+		return
+	}
+
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		timeoutErr = UpstreamTimeoutError{Phase: TimeoutPhaseTotal}
+		return
+	}
+
+	return
+}
@@ -0,0 +1,266 @@
+package httpcache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultTLSReloadInterval = 30
+)
+
+var (
+	TLSVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+)
+
+type (
+	// UpstreamTLSConfig secures the connections to an https
+	// upstream. CAFile replaces the system roots to verify the
+	// upstream, CertFile and KeyFile are the client certificate
+	// for mutual TLS. ServerName overrides the SNI and the name
+	// verified. The files are checked for changes every
+	// ReloadInterval seconds and reloaded without a restart
+	UpstreamTLSConfig struct {
+		CAFile         string `json:"ca_file"`
+		CertFile       string `json:"cert_file"`
+		KeyFile        string `json:"key_file"`
+		ServerName     string `json:"server_name"`
+		MinVersion     string `json:"min_version"`
+		ReloadInterval int64  `json:"reload_interval"`
+	}
+
+	// TLSFiles holds the certificates last loaded from disk
+	TLSFiles struct {
+		upstream *Upstream
+		cfg      *UpstreamTLSConfig
+
+		roots      *x509.CertPool
+		clientCert *tls.Certificate
+		modTimes   map[string]time.Time
+		checkedAt  time.Time
+
+		lock *sync.RWMutex
+	}
+)
+
+// SetTLS applies the TLS config to the transport of the
+// upstream, failing when the files can't be loaded
+func (upstream *Upstream) SetTLS(cfg *UpstreamTLSConfig) (err error) {
+
+	var (
+		tlsCfg    *tls.Config
+		tlsFiles  *TLSFiles
+		isPresent bool
+	)
+
+	if upstream.BaseURL.Scheme != UpstreamSchemeHttps {
+		err = errors.New("Upstream " + upstream.Name + " needs an https URL for TLS")
+		return
+	}
+
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		err = errors.New("Upstream " + upstream.Name + " needs both a cert_file and a key_file")
+		return
+	}
+
+	if cfg.ReloadInterval <= 0 {
+		cfg.ReloadInterval = DefaultTLSReloadInterval
+	}
+
+	tlsFiles = &TLSFiles{
+		upstream: upstream,
+		cfg:      cfg,
+
+		modTimes: make(map[string]time.Time),
+
+		lock: &sync.RWMutex{},
+	}
+
+	if err = tlsFiles.load(); err != nil {
+		return
+	}
+
+	tlsCfg = upstream.Transport.TLSClientConfig
+
+	if cfg.ServerName != "" {
+		tlsCfg.ServerName = cfg.ServerName
+	}
+
+	if cfg.MinVersion != "" {
+		if tlsCfg.MinVersion, isPresent = TLSVersions[cfg.MinVersion]; !isPresent {
+			err = errors.New("Unknown TLS version " + cfg.MinVersion + " for upstream " + upstream.Name)
+			return
+		}
+	}
+
+	// The roots can't be swapped in a tls.Config in use, the
+	// chain is verified against the current roots instead
+	if cfg.CAFile != "" {
+		tlsCfg.InsecureSkipVerify = true
+		tlsCfg.VerifyConnection = tlsFiles.verifyConnection
+	}
+
+	if cfg.CertFile != "" {
+		tlsCfg.GetClientCertificate = tlsFiles.getClientCertificate
+	}
+
+	upstream.TLSFiles = tlsFiles
+
+	return
+}
+
+// load reads the files which changed since the last load.
+// Nothing is replaced when any of them fails to load
+func (tlsFiles *TLSFiles) load() (err error) {
+
+	var (
+		modTimes   map[string]time.Time
+		isChanged  bool
+		caData     []byte
+		roots      *x509.CertPool
+		clientCert tls.Certificate
+	)
+
+	modTimes = make(map[string]time.Time)
+
+	for _, path := range []string{tlsFiles.cfg.CAFile, tlsFiles.cfg.CertFile, tlsFiles.cfg.KeyFile} {
+
+		var (
+			info os.FileInfo
+		)
+
+		if path == "" {
+			continue
+		}
+
+		if info, err = os.Stat(path); err != nil {
+			return
+		}
+
+		if modTimes[path] = info.ModTime(); !info.ModTime().Equal(tlsFiles.modTimes[path]) {
+			isChanged = true
+		}
+	}
+
+	if !isChanged {
+		return
+	}
+
+	if tlsFiles.cfg.CAFile != "" {
+
+		if caData, err = ioutil.ReadFile(tlsFiles.cfg.CAFile); err != nil {
+			return
+		}
+
+		roots = x509.NewCertPool()
+
+		if !roots.AppendCertsFromPEM(caData) {
+			err = errors.New("No certificate found in " + tlsFiles.cfg.CAFile)
+			return
+		}
+	}
+
+	if tlsFiles.cfg.CertFile != "" {
+		if clientCert, err = tls.LoadX509KeyPair(tlsFiles.cfg.CertFile, tlsFiles.cfg.KeyFile); err != nil {
+			return
+		}
+	}
+
+	tlsFiles.lock.Lock()
+	defer tlsFiles.lock.Unlock()
+
+	tlsFiles.roots = roots
+	tlsFiles.modTimes = modTimes
+
+	if tlsFiles.cfg.CertFile != "" {
+		tlsFiles.clientCert = &clientCert
+	}
+
+	return
+}
+
+// refresh reloads the files at most once per reload interval,
+// keeping the previous certificates when the reload fails
+func (tlsFiles *TLSFiles) refresh() {
+
+	var (
+		err error
+	)
+
+	tlsFiles.lock.Lock()
+
+	if time.Since(tlsFiles.checkedAt) < time.Duration(tlsFiles.cfg.ReloadInterval)*time.Second {
+		tlsFiles.lock.Unlock()
+		return
+	}
+
+	tlsFiles.checkedAt = time.Now()
+	tlsFiles.lock.Unlock()
+
+	if err = tlsFiles.load(); err != nil {
+
+		tlsFiles.upstream.logger.WithFields(logrus.Fields{
+			"upstream":   tlsFiles.upstream.Name,
+			"error":      err.Error(),
+			"event_type": "tls_reload_failed",
+		}).Warn("Failed to reload upstream certificates")
+	}
+
+	return
+}
+
+func (tlsFiles *TLSFiles) verifyConnection(state tls.ConnectionState) (err error) {
+
+	var (
+		opts x509.VerifyOptions
+	)
+
+	tlsFiles.refresh()
+
+	if len(state.PeerCertificates) == 0 {
+		err = errors.New("Upstream " + tlsFiles.upstream.Name + " sent no certificate")
+		return
+	}
+
+	tlsFiles.lock.RLock()
+
+	opts = x509.VerifyOptions{
+		DNSName:       state.ServerName,
+		Roots:         tlsFiles.roots,
+		Intermediates: x509.NewCertPool(),
+	}
+
+	tlsFiles.lock.RUnlock()
+
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err = state.PeerCertificates[0].Verify(opts)
+
+	return
+}
+
+func (tlsFiles *TLSFiles) getClientCertificate(*tls.CertificateRequestInfo) (cert *tls.Certificate, err error) {
+
+	tlsFiles.refresh()
+
+	tlsFiles.lock.RLock()
+	defer tlsFiles.lock.RUnlock()
+
+	cert = tlsFiles.clientCert
+
+	return
+}
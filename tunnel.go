@@ -0,0 +1,216 @@
+package httpcache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// isUpgradeRequest tells if the client asks to switch
+// protocols, e.g. to open a WebSocket
+func isUpgradeRequest(req *http.Request) (isUpgrade bool) {
+
+	if req.Header.Get("Upgrade") == "" {
+		return
+	}
+
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				isUpgrade = true
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// tunnelHandler passes an upgrade request to the upstream
+// and, once it switches protocols, relays the bytes of both
+// connections until either side closes. Nothing is cached.
+// The handshake counts against the concurrency limit and the
+// open tunnels against the max tunnels
+func (httpCacheCtxt *HttpCacheCtxt) tunnelHandler(w http.ResponseWriter, req *http.Request) {
+
+	var (
+		proxyCtxt  = httpCacheCtxt.ProxyCtxt
+		startTime  time.Time
+		isAcquired bool
+		cacheReq   *CacheReq
+		upstream   *Upstream
+		header     http.Header
+		timeouts   TimeoutConfig
+		proxyReq   *http.Request
+		resp       *http.Response
+		upConn     io.ReadWriteCloser
+		clientConn net.Conn
+		clientBuf  *bufio.ReadWriter
+		isUpConn   bool
+		err        error
+	)
+
+	defer func() {
+		if err != nil {
+			log.Println("Failed to tunnel", req.URL.Path, err)
+		}
+	}()
+
+	if err = proxyCtxt.Limiter.Acquire(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	startTime = time.Now()
+	isAcquired = true
+
+	// The limit only covers the handshake, how long
+	// a tunnel stays open says nothing of the upstream
+	defer func() {
+		if isAcquired {
+			proxyCtxt.Limiter.Cancel()
+		}
+	}()
+
+	defer atomic.AddInt64(&proxyCtxt.tunnels, -1)
+
+	if atomic.AddInt64(&proxyCtxt.tunnels, 1) > httpCacheCtxt.Config.Proxy.MaxTunnels {
+		err = ProxyBusyError{}
+		writeError(w, err)
+		return
+	}
+
+	cacheReq = &CacheReq{ApiName: req.URL.Path}
+	cacheReq.Policy, _, cacheReq.Vars = httpCacheCtxt.resolvePolicy(req)
+
+	if upstream, err = proxyCtxt.Pool.Pick(ReqKeyT(req.URL.Path)); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	timeouts = proxyCtxt.getTimeouts(cacheReq.Policy)
+
+	// The upgrade headers are hop by hop, they are
+	// passed on explicitly for the upstream to switch
+	header = proxyCtxt.buildRequestHeader(req, cacheReq)
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", req.Header.Get("Upgrade"))
+
+	if proxyReq, err = newUpstreamRequest(withConnectTimeout(req.Context(), timeouts.Connect),
+		req, header, upstream, nil); err != nil {
+
+		upstream.Breaker.Cancel()
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp, err = upstream.Do(proxyReq)
+
+	isAcquired = false
+	proxyCtxt.Limiter.Release(time.Since(startTime), isDropped(&proxyResult{resp: resp, err: err}))
+
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	defer resp.Body.Close()
+
+	// The upstream refused to switch, its
+	// response goes to the client as is
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		writeStreamHeader(w, &Response{
+			StatusCode: resp.StatusCode,
+			Header:     httpCacheCtxt.filterResponseHeader(resp.Header),
+		}, resp.ContentLength)
+
+		err = streamBody(w, resp.Body, nil)
+		return
+	}
+
+	if upConn, isUpConn = resp.Body.(io.ReadWriteCloser); !isUpConn {
+		err = fmt.Errorf("Upstream connection of %s can't be written to", upstream.Name)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	if clientConn, clientBuf, err = http.NewResponseController(w).Hijack(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	defer clientConn.Close()
+
+	// The deadlines of the server are meant for requests,
+	// not for connections which stay open
+	clientConn.SetDeadline(time.Time{})
+
+	fmt.Fprintf(clientBuf, "HTTP/1.1 %d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Write(clientBuf)
+	clientBuf.WriteString("\r\n")
+
+	if err = clientBuf.Flush(); err != nil {
+		return
+	}
+
+	httpCacheCtxt.Stats.Proxy.Tunnels.WithLabelValues(upstream.Name).Inc()
+	httpCacheCtxt.Stats.Proxy.TunnelsOpened.WithLabelValues(upstream.Name).Inc()
+
+	defer httpCacheCtxt.Stats.Proxy.Tunnels.WithLabelValues(upstream.Name).Dec()
+
+	httpCacheCtxt.logger.WithFields(logrus.Fields{
+		"upstream":   upstream.Name,
+		"path":       req.URL.Path,
+		"protocol":   resp.Header.Get("Upgrade"),
+		"event_type": "tunnel_opened",
+	}).Info("Tunnel opened")
+
+	relayTunnel(clientConn, clientBuf.Reader, upConn)
+
+	httpCacheCtxt.logger.WithFields(logrus.Fields{
+		"upstream":   upstream.Name,
+		"path":       req.URL.Path,
+		"event_type": "tunnel_closed",
+	}).Info("Tunnel closed")
+
+	return
+}
+
+// relayTunnel copies the bytes both ways, the client side
+// starting with what was read ahead of the hijack. Both
+// connections are closed as soon as one side is done
+func relayTunnel(clientConn net.Conn, clientReader io.Reader, upConn io.ReadWriteCloser) {
+
+	var (
+		doneCh chan struct{}
+	)
+
+	doneCh = make(chan struct{}, 2)
+
+	go func() {
+		io.Copy(upConn, clientReader)
+		doneCh <- struct{}{}
+	}()
+
+	go func() {
+		io.Copy(clientConn, upConn)
+		doneCh <- struct{}{}
+	}()
+
+	<-doneCh
+
+	clientConn.Close()
+	upConn.Close()
+
+	<-doneCh
+
+	return
+}
@@ -0,0 +1,358 @@
+package httpcache
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	UpstreamSchemeHttp  = "http"
+	UpstreamSchemeHttps = "https"
+	UpstreamSchemeUnix  = "unix"
+
+	// UnixUpstreamHost is the host put in the URL of the
+	// requests sent over a unix socket
+	UnixUpstreamHost = "unix"
+
+	DefaultUpstreamDialTimeout  = 5 * time.Second
+	DefaultUpstreamIdleConns    = 64
+	DefaultUpstreamIdleTimeout  = 90 * time.Second
+	DefaultUpstreamTLSHandshake = 10 * time.Second
+)
+
+type (
+	// Upstream is a single backend the requests are proxied
+	// to. It is created from an URL which is one of
+	//   - unix:///var/run/backend.sock, or a bare socket path
+	//   - http://host:port
+	//   - https://host
+	// A path in the URL is prepended to the proxied paths
+	Upstream struct {
+		Name   string
+		URL    *url.URL
+		Weight int
+
+		// Network and Address are what is dialed, the
+		// requests themselves are sent to BaseURL
+		Network string
+		Address string
+		BaseURL *url.URL
+
+		Protocol  string
+		Transport *http.Transport
+		Client    *http.Client
+		TLSFiles  *TLSFiles
+
+		// Http1Client sends the upgrade requests, which
+		// HTTP/2 has no room for
+		Http1Client *http.Client
+
+		Health  *UpstreamHealth
+		Breaker *CircuitBreaker
+
+		outstanding int64
+		stats       *Stats
+		logger      *logrus.Logger
+		stopCh      chan struct{}
+	}
+
+	// upstreamBody releases the upstream once the body
+	// of its response has been consumed
+	upstreamBody struct {
+		io.ReadCloser
+
+		closeOnce *sync.Once
+		onClose   func()
+	}
+)
+
+func NewUpstream(name string, rawURL string) (upstream *Upstream, err error) {
+
+	var (
+		upstreamURL *url.URL
+		dialer      *net.Dialer
+	)
+
+	if upstreamURL, err = parseUpstreamURL(rawURL); err != nil {
+		return
+	}
+
+	upstream = &Upstream{
+		Name:     name,
+		URL:      upstreamURL,
+		Weight:   1,
+		Protocol: UpstreamProtocolHttp1,
+
+		stopCh: make(chan struct{}),
+
+		BaseURL: &url.URL{
+			Scheme: UpstreamSchemeHttp,
+			Host:   upstreamURL.Host,
+		},
+	}
+
+	if upstream.Name == "" {
+		upstream.Name = rawURL
+	}
+
+	switch upstreamURL.Scheme {
+
+	case UpstreamSchemeUnix:
+		upstream.Network = "unix"
+		upstream.Address = upstreamURL.Path
+		upstream.BaseURL.Host = UnixUpstreamHost
+
+	case UpstreamSchemeHttp:
+		upstream.Network = "tcp"
+		upstream.Address = hostWithPort(upstreamURL, "80")
+		upstream.BaseURL.Path = strings.TrimSuffix(upstreamURL.Path, "/")
+
+	case UpstreamSchemeHttps:
+		upstream.Network = "tcp"
+		upstream.Address = hostWithPort(upstreamURL, "443")
+		upstream.BaseURL.Scheme = UpstreamSchemeHttps
+		upstream.BaseURL.Path = strings.TrimSuffix(upstreamURL.Path, "/")
+
+	default:
+		err = errors.New("Unsupported upstream scheme " + upstreamURL.Scheme)
+		return
+	}
+
+	dialer = &net.Dialer{
+		Timeout:   DefaultUpstreamDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	upstream.Transport = &http.Transport{
+
+		// The address is fixed per upstream, whatever the
+		// host of the request URL is
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+
+			// Routes can ask for a shorter connect timeout
+			if timeout := getConnectTimeout(ctx); timeout > 0 {
+
+				var (
+					cancel context.CancelFunc
+				)
+
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+
+			conn, err := dialer.DialContext(ctx, upstream.Network, upstream.Address)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return upstream.trackConn(conn), nil
+		},
+
+		TLSClientConfig: &tls.Config{
+			ServerName: upstreamURL.Hostname(),
+		},
+
+		MaxIdleConns:        DefaultUpstreamIdleConns,
+		MaxIdleConnsPerHost: DefaultUpstreamIdleConns,
+		IdleConnTimeout:     DefaultUpstreamIdleTimeout,
+		TLSHandshakeTimeout: DefaultUpstreamTLSHandshake,
+	}
+
+	upstream.Client = newUpstreamClient(upstream.Transport)
+	upstream.Http1Client = upstream.Client
+
+	return
+}
+
+func newUpstreamClient(transport *http.Transport) (client *http.Client) {
+
+	client = &http.Client{
+		Transport: transport,
+
+		// Redirects are for the client to follow
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return
+}
+
+func parseUpstreamURL(rawURL string) (upstreamURL *url.URL, err error) {
+
+	// A bare path is the socket of the backend, which is
+	// how remote_host has always been configured
+	if strings.HasPrefix(rawURL, "/") {
+		upstreamURL = &url.URL{
+			Scheme: UpstreamSchemeUnix,
+			Path:   rawURL,
+		}
+		return
+	}
+
+	if upstreamURL, err = url.Parse(rawURL); err != nil {
+		return
+	}
+
+	if upstreamURL.Scheme == UpstreamSchemeUnix && upstreamURL.Path == "" {
+		err = errors.New("Missing socket path in upstream " + rawURL)
+		return
+	}
+
+	if upstreamURL.Scheme != UpstreamSchemeUnix && upstreamURL.Host == "" {
+		err = errors.New("Missing host in upstream " + rawURL)
+		return
+	}
+
+	return
+}
+
+func hostWithPort(upstreamURL *url.URL, defaultPort string) (address string) {
+
+	var (
+		port string
+	)
+
+	if port = upstreamURL.Port(); port == "" {
+		port = defaultPort
+	}
+
+	address = net.JoinHostPort(upstreamURL.Hostname(), port)
+
+	return
+}
+
+// RequestURL is the URL the request is sent to on
+// this upstream
+func (upstream *Upstream) RequestURL(reqURL *url.URL) (upstreamURL *url.URL) {
+
+	upstreamURL = &url.URL{
+		Scheme:   upstream.BaseURL.Scheme,
+		Host:     upstream.BaseURL.Host,
+		Path:     upstream.BaseURL.Path + reqURL.Path,
+		RawQuery: reqURL.RawQuery,
+	}
+
+	if reqURL.RawPath != "" {
+		upstreamURL.RawPath = upstream.BaseURL.Path + reqURL.RawPath
+	}
+
+	return
+}
+
+// Do sends the request to the upstream. The request counts
+// as outstanding until the body of its response is closed.
+// The request has to be allowed by the circuit breaker of
+// the upstream beforehand
+func (upstream *Upstream) Do(req *http.Request) (resp *http.Response, err error) {
+
+	var (
+		client    = upstream.Client
+		startTime time.Time
+	)
+
+	if isUpgradeRequest(req) {
+		client = upstream.Http1Client
+	}
+
+	upstream.acquire()
+
+	startTime = time.Now()
+
+	if resp, err = client.Do(req); err != nil {
+
+		// The client went away, which says nothing
+		// about the upstream
+		if context.Cause(req.Context()) == context.Canceled {
+			upstream.Breaker.Cancel()
+			upstream.release()
+			return
+		}
+
+		upstream.Health.RecordResult(time.Since(startTime), true)
+		upstream.Breaker.RecordResult(true)
+		upstream.stats.Upstream.Errors.WithLabelValues(upstream.Name).Inc()
+		upstream.release()
+
+		return
+	}
+
+	upstream.stats.Upstream.Responses.WithLabelValues(upstream.Name, resp.Proto).Inc()
+
+	upstream.Health.RecordResult(time.Since(startTime), upstream.Health.IsFailureStatus(resp.StatusCode))
+	upstream.Breaker.RecordResult(resp.StatusCode >= http.StatusInternalServerError)
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		upstream.stats.Upstream.Errors.WithLabelValues(upstream.Name).Inc()
+	}
+
+	// An upgraded connection is a tunnel rather than an
+	// outstanding request, and its body has to stay writable
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		upstream.release()
+		return
+	}
+
+	resp.Body = &upstreamBody{
+		ReadCloser: resp.Body,
+
+		closeOnce: &sync.Once{},
+		onClose:   upstream.release,
+	}
+
+	return
+}
+
+func (upstream *Upstream) Outstanding() (outstanding int64) {
+	outstanding = atomic.LoadInt64(&upstream.outstanding)
+	return
+}
+
+func (upstream *Upstream) acquire() {
+
+	atomic.AddInt64(&upstream.outstanding, 1)
+
+	upstream.stats.Upstream.Requests.WithLabelValues(upstream.Name).Inc()
+	upstream.stats.Upstream.Outstanding.WithLabelValues(upstream.Name).Inc()
+
+	return
+}
+
+func (upstream *Upstream) release() {
+
+	atomic.AddInt64(&upstream.outstanding, -1)
+
+	upstream.stats.Upstream.Outstanding.WithLabelValues(upstream.Name).Dec()
+
+	return
+}
+
+func (body *upstreamBody) Close() (err error) {
+
+	err = body.ReadCloser.Close()
+	body.closeOnce.Do(body.onClose)
+
+	return
+}
+
+func (upstream *Upstream) IsAvailable() (isAvailable bool) {
+	isAvailable = upstream.Health.IsAvailable()
+	return
+}
+
+func (upstream *Upstream) Stop() {
+	close(upstream.stopCh)
+	return
+}
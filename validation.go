@@ -0,0 +1,437 @@
+package httpcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	JSONPathOperators = []string{"==", "!=", "<=", ">=", "<", ">"}
+)
+
+type (
+	// ResponseValidator tells if the response may be cached,
+	// an error keeps it out of the cache
+	ResponseValidator func(req *http.Request, resp *Response) (err error)
+
+	// ValidationConfig lists the checks a response goes through
+	// before it is cached. ContentTypes are media types, e.g.
+	// application/json or application/*+json. With JSON the body
+	// has to be well formed JSON. Rules are JSONPath predicates,
+	// e.g. $.status == "success" or $.data.items[0] to require a
+	// value. Validators are the names of the validators registered
+	// with RegisterResponseValidator
+	ValidationConfig struct {
+		ContentTypes []string `json:"content_types"`
+		JSON         bool     `json:"json"`
+		Rules        []string `json:"rules"`
+		Validators   []string `json:"validators"`
+	}
+
+	ResponseValidation struct {
+		ContentTypes []string
+		IsJSON       bool
+		Rules        []*JSONPredicate
+		Validators   []string
+	}
+
+	// JSONPredicate compares the value at Path with Value.
+	// Without an operator the value only has to be present
+	JSONPredicate struct {
+		Expr string
+
+		path     []interface{}
+		operator string
+		value    interface{}
+	}
+)
+
+func NewResponseValidation(cfg *ValidationConfig) (validation *ResponseValidation, err error) {
+
+	var (
+		rule *JSONPredicate
+	)
+
+	validation = &ResponseValidation{
+		IsJSON:     cfg.JSON || len(cfg.Rules) > 0,
+		Validators: cfg.Validators,
+	}
+
+	for _, contentType := range cfg.ContentTypes {
+
+		if _, err = path.Match(contentType, ""); err != nil {
+			err = errors.New("Invalid content type " + contentType)
+			return
+		}
+
+		validation.ContentTypes = append(validation.ContentTypes, strings.ToLower(contentType))
+	}
+
+	for _, expr := range cfg.Rules {
+
+		if rule, err = NewJSONPredicate(expr); err != nil {
+			return
+		}
+
+		validation.Rules = append(validation.Rules, rule)
+	}
+
+	return
+}
+
+// NewJSONPredicate parses `<path> [<operator> <json value>]`.
+// The path starts with $ and goes down with .name, ['name']
+// or [index]
+func NewJSONPredicate(expr string) (rule *JSONPredicate, err error) {
+
+	var (
+		rest string
+	)
+
+	rule = &JSONPredicate{Expr: expr}
+
+	if rest = strings.TrimSpace(expr); !strings.HasPrefix(rest, "$") {
+		err = errors.New("JSONPath rule " + expr + " has to start with $")
+		return
+	}
+
+	rest = rest[1:]
+
+	for rest != "" && (rest[0] == '.' || rest[0] == '[') {
+
+		var (
+			end int
+		)
+
+		if rest[0] == '.' {
+
+			if end = strings.IndexAny(rest[1:], ".[ =!<>"); end < 0 {
+				end = len(rest) - 1
+			}
+
+			if end == 0 {
+				err = errors.New("Empty name in JSONPath rule " + expr)
+				return
+			}
+
+			rule.path = append(rule.path, rest[1:end+1])
+			rest = rest[end+1:]
+
+			continue
+		}
+
+		if end = strings.Index(rest, "]"); end < 0 {
+			err = errors.New("Unterminated [ in JSONPath rule " + expr)
+			return
+		}
+
+		if name := rest[1:end]; len(name) >= 2 && (name[0] == '\'' || name[0] == '"') && name[len(name)-1] == name[0] {
+			rule.path = append(rule.path, name[1:len(name)-1])
+		} else if idx, idxErr := strconv.Atoi(name); idxErr == nil && idx >= 0 {
+			rule.path = append(rule.path, idx)
+		} else {
+			err = errors.New("Invalid index " + name + " in JSONPath rule " + expr)
+			return
+		}
+
+		rest = rest[end+1:]
+	}
+
+	if rest = strings.TrimSpace(rest); rest == "" {
+		return
+	}
+
+	for _, operator := range JSONPathOperators {
+		if strings.HasPrefix(rest, operator) {
+			rule.operator = operator
+			break
+		}
+	}
+
+	if rule.operator == "" {
+		err = errors.New("Unknown operator in JSONPath rule " + expr)
+		return
+	}
+
+	if err = json.Unmarshal([]byte(strings.TrimSpace(rest[len(rule.operator):])), &rule.value); err != nil {
+		err = errors.New("Invalid value in JSONPath rule " + expr + ": " + err.Error())
+		return
+	}
+
+	return
+}
+
+// Evaluate runs the predicate on the decoded document,
+// a missing value fails it whatever the operator
+func (rule *JSONPredicate) Evaluate(doc interface{}) (isMatch bool) {
+
+	var (
+		value interface{}
+	)
+
+	value = doc
+
+	for _, step := range rule.path {
+
+		switch key := step.(type) {
+
+		case string:
+			object, isObject := value.(map[string]interface{})
+			if !isObject {
+				return
+			}
+
+			if value, isObject = object[key]; !isObject {
+				return
+			}
+
+		case int:
+			array, isArray := value.([]interface{})
+			if !isArray || key >= len(array) {
+				return
+			}
+
+			value = array[key]
+		}
+	}
+
+	switch rule.operator {
+
+	case "":
+		isMatch = value != nil
+
+	case "==":
+		isMatch = reflect.DeepEqual(value, rule.value)
+
+	case "!=":
+		isMatch = !reflect.DeepEqual(value, rule.value)
+
+	default:
+		isMatch = compareJSON(value, rule.value, rule.operator)
+	}
+
+	return
+}
+
+// compareJSON orders two numbers or two strings
+func compareJSON(left interface{}, right interface{}, operator string) (isMatch bool) {
+
+	var (
+		cmp int
+	)
+
+	switch leftValue := left.(type) {
+
+	case float64:
+		rightValue, isNumber := right.(float64)
+		if !isNumber {
+			return
+		}
+
+		switch {
+		case leftValue < rightValue:
+			cmp = -1
+		case leftValue > rightValue:
+			cmp = 1
+		}
+
+	case string:
+		rightValue, isString := right.(string)
+		if !isString {
+			return
+		}
+
+		cmp = strings.Compare(leftValue, rightValue)
+
+	default:
+		return
+	}
+
+	switch operator {
+	case "<":
+		isMatch = cmp < 0
+	case "<=":
+		isMatch = cmp <= 0
+	case ">":
+		isMatch = cmp > 0
+	case ">=":
+		isMatch = cmp >= 0
+	}
+
+	return
+}
+
+// Validate runs the checks in order, failing on the first
+// which the response doesn't pass. The JSON checks are
+// skipped for a body in an encoding which can't be decoded
+func (validation *ResponseValidation) Validate(req *http.Request, resp *Response,
+	validators map[string]ResponseValidator) (isSkipped bool, err error) {
+
+	var (
+		mediaType string
+		body      []byte
+		doc       interface{}
+		validator ResponseValidator
+		isPresent bool
+	)
+
+	if len(validation.ContentTypes) > 0 {
+
+		mediaType, _, _ = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+
+		if !matchesContentType(strings.ToLower(mediaType), validation.ContentTypes) {
+			err = ResponseValidationError{Reason: "unexpected content type " + mediaType}
+			return
+		}
+	}
+
+	if validation.IsJSON {
+
+		if body, isSkipped, err = decodeBody(resp); err != nil {
+			err = ResponseValidationError{Reason: "undecodable body: " + err.Error()}
+			return
+		}
+	}
+
+	if validation.IsJSON && !isSkipped {
+
+		if err = json.Unmarshal(body, &doc); err != nil {
+			err = ResponseValidationError{Reason: "malformed JSON: " + err.Error()}
+			return
+		}
+
+		for _, rule := range validation.Rules {
+			if !rule.Evaluate(doc) {
+				err = ResponseValidationError{Reason: "rule " + rule.Expr + " failed"}
+				return
+			}
+		}
+	}
+
+	for _, name := range validation.Validators {
+
+		// Validators are looked up at request time as they may be
+		// registered after the config is loaded. A missing one
+		// keeps the response out of the cache
+		if validator, isPresent = validators[name]; !isPresent {
+			err = ResponseValidationError{Reason: "validator " + name + " not registered"}
+			return
+		}
+
+		if err = validator(req, resp); err != nil {
+			err = ResponseValidationError{Reason: "validator " + name + ": " + err.Error()}
+			return
+		}
+	}
+
+	return
+}
+
+// decodeBody undoes the Content-Encoding of the body, which
+// is passed through as the client's Accept-Encoding is sent
+// upstream. Encodings other than gzip and deflate are
+// reported as unknown
+func decodeBody(resp *Response) (body []byte, isUnknown bool, err error) {
+
+	var (
+		reader io.ReadCloser
+	)
+
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+
+	case "", "identity":
+		body = resp.Body
+		return
+
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(bytes.NewReader(resp.Body))
+
+	case "deflate":
+		reader, err = zlib.NewReader(bytes.NewReader(resp.Body))
+
+	default:
+		isUnknown = true
+		return
+	}
+
+	if err != nil {
+		return
+	}
+
+	defer reader.Close()
+
+	body, err = ioutil.ReadAll(reader)
+
+	return
+}
+
+func matchesContentType(mediaType string, patterns []string) (isMatch bool) {
+
+	for _, pattern := range patterns {
+		if isMatch, _ = path.Match(pattern, mediaType); isMatch {
+			return
+		}
+	}
+
+	return
+}
+
+// isAdmitted tells if the response passes the validation of
+// its route and may be cached, logging the ones rejected
+func (httpCacheCtxt *HttpCacheCtxt) isAdmitted(req *http.Request, cacheReq *CacheReq, resp *Response) (isAdmitted bool) {
+
+	var (
+		isSkipped bool
+		err       error
+	)
+
+	if cacheReq.Policy.Validation == nil {
+		isAdmitted = true
+		return
+	}
+
+	if isSkipped, err = cacheReq.Policy.Validation.Validate(req, resp, httpCacheCtxt.ResponseValidators); err != nil {
+
+		httpCacheCtxt.Stats.Counter.CacheRejected.Inc()
+
+		httpCacheCtxt.logger.WithFields(logrus.Fields{
+			"req_key":    cacheReq.ReqKey,
+			"api_name":   cacheReq.ApiName,
+			"route":      cacheReq.Policy.Name,
+			"error":      err.Error(),
+			"event_type": "cache_rejected",
+		}).Warn("Cache Response rejected by validation, not added")
+
+		return
+	}
+
+	if isSkipped {
+
+		httpCacheCtxt.Stats.Counter.CacheUnchecked.Inc()
+
+		httpCacheCtxt.logger.WithFields(logrus.Fields{
+			"req_key":    cacheReq.ReqKey,
+			"api_name":   cacheReq.ApiName,
+			"route":      cacheReq.Policy.Name,
+			"encoding":   resp.Header.Get("Content-Encoding"),
+			"event_type": "cache_validation_skipped",
+		}).Warn("Cache Response in an undecodable encoding, JSON checks skipped")
+	}
+
+	isAdmitted = true
+
+	return
+}
@@ -0,0 +1,205 @@
+package httpcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewJSONPredicate(t *testing.T) {
+
+	var (
+		testCases = []struct {
+			expr     string
+			path     []interface{}
+			operator string
+			isErr    bool
+		}{
+			{expr: "$", path: nil},
+			{expr: "$.status", path: []interface{}{"status"}},
+			{expr: `$.status == "ok"`, path: []interface{}{"status"}, operator: "=="},
+			{expr: "$.data.items[0].id >= 10", path: []interface{}{"data", "items", 0, "id"}, operator: ">="},
+			{expr: "$['a.b'][\"c\"] != null", path: []interface{}{"a.b", "c"}, operator: "!="},
+			{expr: "$.count<3", path: []interface{}{"count"}, operator: "<"},
+			{expr: "status", isErr: true},
+			{expr: "$..status", isErr: true},
+			{expr: "$.items[0", isErr: true},
+			{expr: "$.items[-1]", isErr: true},
+			{expr: "$.items[x]", isErr: true},
+			{expr: "$.status ~ 1", isErr: true},
+			{expr: "$.status == ok", isErr: true},
+		}
+	)
+
+	for _, testCase := range testCases {
+
+		rule, err := NewJSONPredicate(testCase.expr)
+
+		if testCase.isErr {
+			if err == nil {
+				t.Errorf("%s: parsed", testCase.expr)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", testCase.expr, err)
+			continue
+		}
+
+		if len(rule.path) != len(testCase.path) || rule.operator != testCase.operator {
+			t.Errorf("%s: parsed to %v %q", testCase.expr, rule.path, rule.operator)
+			continue
+		}
+
+		for idx := range rule.path {
+			if rule.path[idx] != testCase.path[idx] {
+				t.Errorf("%s: step %d is %v instead of %v", testCase.expr, idx, rule.path[idx], testCase.path[idx])
+			}
+		}
+	}
+}
+
+func TestJSONPredicateEvaluate(t *testing.T) {
+
+	var (
+		doc = []byte(`{"status": "ok", "count": 2, "data": {"items": [{"id": 7}], "empty": null}}`)
+
+		testCases = []struct {
+			expr    string
+			isMatch bool
+		}{
+			{`$.status == "ok"`, true},
+			{`$.status != "ok"`, false},
+			{`$.count == 2`, true},
+			{`$.count < 3`, true},
+			{`$.count >= 3`, false},
+			{`$.status > "a"`, true},
+			{`$.status < 1`, false},
+			{`$.data.items[0].id`, true},
+			{`$.data.items[1]`, false},
+			{`$.data.empty`, false},
+			{`$.data.missing != 1`, false},
+			{`$.status.name`, false},
+			{`$.data.items == [{"id": 7}]`, true},
+		}
+	)
+
+	for _, testCase := range testCases {
+
+		validation, err := NewResponseValidation(&ValidationConfig{Rules: []string{testCase.expr}})
+		if err != nil {
+			t.Fatalf("%s: %v", testCase.expr, err)
+		}
+
+		_, err = validation.Validate(nil, &Response{Header: http.Header{}, Body: doc}, nil)
+
+		if isMatch := err == nil; isMatch != testCase.isMatch {
+			t.Errorf("%s: matched %v", testCase.expr, isMatch)
+		}
+	}
+}
+
+func TestResponseValidationEncodings(t *testing.T) {
+
+	var (
+		validation *ResponseValidation
+		gzipped    = &bytes.Buffer{}
+		deflated   = &bytes.Buffer{}
+		err        error
+	)
+
+	if validation, err = NewResponseValidation(&ValidationConfig{Rules: []string{`$.status == "ok"`}}); err != nil {
+		t.Fatal(err)
+	}
+
+	gzipWriter := gzip.NewWriter(gzipped)
+	gzipWriter.Write([]byte(`{"status": "ok"}`))
+	gzipWriter.Close()
+
+	zlibWriter := zlib.NewWriter(deflated)
+	zlibWriter.Write([]byte(`{"status": "failed"}`))
+	zlibWriter.Close()
+
+	testCases := []struct {
+		encoding  string
+		body      []byte
+		isSkipped bool
+		isErr     bool
+	}{
+		{encoding: "", body: []byte(`{"status": "ok"}`)},
+		{encoding: "gzip", body: gzipped.Bytes()},
+		{encoding: "deflate", body: deflated.Bytes(), isErr: true},
+		{encoding: "gzip", body: []byte(`{"status": "ok"}`), isErr: true},
+		{encoding: "br", body: []byte{0x0b, 0x01}, isSkipped: true},
+	}
+
+	for _, testCase := range testCases {
+
+		resp := &Response{Header: http.Header{}, Body: testCase.body}
+		resp.Header.Set("Content-Encoding", testCase.encoding)
+
+		isSkipped, err := validation.Validate(nil, resp, nil)
+
+		if isSkipped != testCase.isSkipped || (err != nil) != testCase.isErr {
+			t.Errorf("%q: skipped %v, error %v", testCase.encoding, isSkipped, err)
+		}
+	}
+}
+
+func TestValidatedGzipResponseIsCached(t *testing.T) {
+
+	var (
+		upstream      *httptest.Server
+		httpCacheCtxt *HttpCacheCtxt
+		req           *http.Request
+		w             *httptest.ResponseRecorder
+		cacheReq      *CacheReq
+		err           error
+		cfg           = &Config{}
+	)
+
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+
+		gzipWriter := gzip.NewWriter(w)
+		gzipWriter.Write([]byte(`{"status": "ok"}`))
+		gzipWriter.Close()
+	}))
+	defer upstream.Close()
+
+	cfg.Server.RemoteHost = upstream.URL
+	cfg.Proxy.NoOfWorkers = 1
+	cfg.Routes = []RouteConfig{{
+		Name:     "validated",
+		Match:    "/validated",
+		Key:      "query:uuid",
+		Validate: &ValidationConfig{Rules: []string{`$.status == "ok"`}},
+	}}
+
+	httpCacheCtxt = newTestHttpCacheCtxt(t, cfg)
+
+	req = httptest.NewRequest(http.MethodGet, "/validated?uuid=1", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	w = httptest.NewRecorder()
+	httpCacheCtxt.rootHandler(w, req)
+
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Got %d with encoding %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+
+	if cacheReq, err = httpCacheCtxt.newCacheReq(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = httpCacheCtxt.Cache.Peek(cacheReq.TenantName, cacheReq.ReqKey, cacheReq.EntryName()); err != nil {
+		t.Fatalf("Gzip response not cached: %v", err)
+	}
+}